@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const API_SHUTDOWN_TIMEOUT = 5 * time.Second
+
+// Host the API binds to when API_TOKEN is unset
+const API_LOOPBACK_HOST = "127.0.0.1"
+
+// APIServer serves the HTTP admin/control API on API_PORT, next to the
+//    ServerWrapper's TCP listener
+type APIServer struct {
+	sw				*ServerWrapper
+
+	listener		net.Listener
+	httpServer		*http.Server
+
+	// API_TOKEN, required as "Authorization: Bearer <token>" on every
+	//    request; nil if unset (see newAPIServer())
+	token			[]byte
+
+	// closed once a graceful shutdown has been requested through the API
+	ShutdownChan	chan bool
+	shutdownOnce	sync.Once
+}
+
+// newAPIServer() defined in main.go (private to main)
+
+// JSON snapshots of the Server/Community/Client hierarchy
+type ServerInfo struct {
+	ID			string		`json:"id"`
+	Comms		[]CommInfo	`json:"comms"`
+}
+
+type CommInfo struct {
+	ID			string			`json:"id"`
+	Clients		[]ClientInfo	`json:"clients"`
+}
+
+type ClientInfo struct {
+	ID			uint32	`json:"id"`
+	Name		string	`json:"name"`
+	UserID		string	`json:"user_id,omitempty"`
+	TrustedPeer	string	`json:"trusted_peer,omitempty"`
+	QueueLen	int		`json:"queue_len"`
+	DroppedMsgs	uint64	`json:"dropped_msgs"`
+}
+
+// Write queue totals across every connected Client (see write_queue.go)
+type WriteQueueStats struct {
+	Clients					int		`json:"clients"`
+	QueuedMsgs				int		`json:"queued_msgs"`
+	MaxQueueLen				int		`json:"max_queue_len"`
+	DroppedMsgs				uint64	`json:"dropped_msgs"` // since startup
+	SlowConsumerDisconnects	uint64	`json:"slow_consumer_disconnects"`
+}
+
+// This node's view of the cluster (see cluster.go)
+type ClusterInfo struct {
+	NodeID			string				`json:"node_id"`
+	Nodes			[]ClusterNode		`json:"nodes"`
+	Regions			map[string][]string	`json:"regions"` // by owner node ID
+	ForwardedOut	int					`json:"forwarded_out"`
+	ForwardedIn		int					`json:"forwarded_in"`
+}
+
+func (api *APIServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/servers", api.handleServers)
+	mux.HandleFunc("/stats", api.handleStats)
+	mux.HandleFunc("/metrics", api.handleMetrics)
+	mux.HandleFunc("/cluster", api.handleCluster)
+	mux.HandleFunc("/kick", api.handleKick)
+	mux.HandleFunc("/comm/roster", api.handleCommRoster)
+	mux.HandleFunc("/comm/shutdown", api.handleCommShutdown)
+	mux.HandleFunc("/shutdown", api.handleShutdown)
+	if api.token == nil {
+		return mux
+	}
+	return api.requireToken(mux)
+}
+
+// Wrap next so requests w/o the API_TOKEN bearer token get a 401
+func (api *APIServer) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(
+			r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), api.token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or invalid API token",
+				http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Blocks until api.Shutdown() is called
+func (api *APIServer) Serve() {
+	slog.Info("API listening", "addr", api.listener.Addr().String())
+	err := api.httpServer.Serve(api.listener)
+	if err != nil && err != http.ErrServerClosed {
+		slog.Error("API server stopped unexpectedly", "err", err)
+	}
+}
+
+func (api *APIServer) Shutdown() (err error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), API_SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	return api.httpServer.Shutdown(ctx)
+}
+
+// GET /servers
+func (api *APIServer) handleServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, api.sw.Info())
+}
+
+// GET /stats
+func (api *APIServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, api.sw.WriteQueueStats())
+}
+
+// GET /cluster
+func (api *APIServer) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cl := api.sw.cluster
+	info := ClusterInfo{
+		NodeID:		cl.NodeID,
+		Nodes:		append([]ClusterNode{}, cl.Nodes...),
+		Regions:	cl.Regions(),
+	}
+	info.ForwardedOut, info.ForwardedIn = cl.ForwardedCounts()
+	writeJSON(w, info)
+}
+
+// POST /kick?client=<id>[&server=<id>]
+func (api *APIServer) handleKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cID, err := strconv.ParseUint(r.URL.Query().Get("client"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid client id", http.StatusBadRequest)
+		return
+	}
+
+	cPtr, ok := api.sw.FindClient(r.URL.Query().Get("server"), uint32(cID))
+	if !ok {
+		http.Error(w, fmt.Sprintf("client %v not found", cID),
+			http.StatusNotFound)
+		return
+	}
+
+	cPtr.Log().Info("Kicking Client (api)")
+	api.sw.sessions.End(cPtr) // it may not resume
+	cPtr.Disconnect(DISCONNECT_KICKED)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /comm/roster?server=<id>&comm=<id>
+// Lists the same members a Client joining the Community gets in MsgRoster
+func (api *APIServer) handleCommRoster(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sID := r.URL.Query().Get("server")
+	commID := r.URL.Query().Get("comm")
+
+	s, ok := api.sw.GetServer(sID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("server %s not found", sID),
+			http.StatusNotFound)
+		return
+	}
+	comm, ok := s.GetComm(commID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("comm %s not found", commID),
+			http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, comm.Roster())
+}
+
+// POST /comm/shutdown?server=<id>&comm=<id>
+func (api *APIServer) handleCommShutdown(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sID := r.URL.Query().Get("server")
+	commID := r.URL.Query().Get("comm")
+
+	s, ok := api.sw.GetServer(sID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("server %s not found", sID),
+			http.StatusNotFound)
+		return
+	}
+
+	if err := s.ShutdownComm(commID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.sw.sessions.ClearComm(sID, commID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /shutdown
+func (api *APIServer) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	api.shutdownOnce.Do(func() {
+		slog.Info("Graceful shutdown requested (api)")
+		close(api.ShutdownChan)
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Unable to encode API response", "err", err)
+	}
+}
+
+// BLOCKING: sw.serversRWMutex (read)
+func (sw *ServerWrapper) Info() (info []ServerInfo) {
+	sw.serversRWMutex.RLock()
+	defer sw.serversRWMutex.RUnlock()
+
+	info = make([]ServerInfo, 0, len(sw.Servers))
+	for _, s := range sw.Servers {
+		info = append(info, s.Info())
+	}
+	sort.Slice(info, func(i, j int) bool { return info[i].ID < info[j].ID })
+
+	return
+}
+
+// BLOCKING: sw.directoryRWMutex (read)
+func (sw *ServerWrapper) WriteQueueStats() (stats WriteQueueStats) {
+	sw.directoryRWMutex.RLock()
+	defer sw.directoryRWMutex.RUnlock()
+
+	stats.Clients = len(sw.directory)
+	for _, cPtr := range sw.directory {
+		queueLen := cPtr.QueueLen()
+		stats.QueuedMsgs += queueLen
+		if queueLen > stats.MaxQueueLen {
+			stats.MaxQueueLen = queueLen
+		}
+	}
+	stats.DroppedMsgs = atomic.LoadUint64(&totalDroppedMsgs)
+	stats.SlowConsumerDisconnects = atomic.LoadUint64(&totalSlowDisconnects)
+
+	return
+}
+
+// BLOCKING: s.commsRWMutex (read)
+func (s *Server) Info() (info ServerInfo) {
+	s.commsRWMutex.RLock()
+	defer s.commsRWMutex.RUnlock()
+
+	info.ID = s.ID
+	info.Comms = make([]CommInfo, 0, len(s.Comms))
+	for _, comm := range s.Comms {
+		info.Comms = append(info.Comms, comm.Info())
+	}
+	sort.Slice(info.Comms, func(i, j int) bool {
+		return info.Comms[i].ID < info.Comms[j].ID
+	})
+
+	return
+}
+
+// BLOCKING: comm.clientsRWMutex (read)
+func (comm *Community) Info() (info CommInfo) {
+	comm.clientsRWMutex.RLock()
+	defer comm.clientsRWMutex.RUnlock()
+
+	info.ID = comm.ID
+	info.Clients = make([]ClientInfo, 0, len(comm.Clients))
+	for _, cPtr := range comm.Clients {
+		info.Clients = append(info.Clients, ClientInfo{
+			cPtr.ID, cPtr.DisplayName(), cPtr.UserID, cPtr.TrustedPeer,
+			cPtr.QueueLen(), cPtr.DroppedMsgs()})
+	}
+	sort.Slice(info.Clients, func(i, j int) bool {
+		return info.Clients[i].ID < info.Clients[j].ID
+	})
+
+	return
+}
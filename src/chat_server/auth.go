@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AUTH_MODE values
+const (
+	// Clients identify themselves w/ MsgClientID; nothing is verified
+	AUTH_MODE_NONE = "none"
+	// MsgClientToken holds an HS256 JWT signed w/ AUTH_JWT_SECRET
+	AUTH_MODE_JWT = "jwt"
+	// MsgClientToken is verified by POSTing it to AUTH_VERIFY_URL
+	AUTH_MODE_REMOTE = "remote"
+)
+
+// Clock skew allowed when checking a JWT's exp & nbf
+const JWT_LEEWAY = 30 * time.Second
+
+// The user a bearer token was issued to
+type Identity struct {
+	UserID		string `json:"user_id"` // stable, e.g. a JWT "sub"
+	Name		string `json:"name"` // may be empty
+}
+
+// Authenticator verifies the bearer token a Client sends in its
+//    MsgClientToken
+type Authenticator interface {
+	Verify(ctx context.Context, token string) (id Identity, err error)
+}
+
+// Low bits of an IDTable's Client.IDs, numbering its users; the high bits
+//    hold the node's index in CLUSTER_CONFIG (see MAX_CLUSTER_NODES)
+const ID_TABLE_USER_BITS = 24
+
+// IDTable assigns each verified user a Client.ID, kept for the life of the
+//    process & unique across the cluster's nodes; a user connecting
+//    through different nodes gets a different ID from each
+type IDTable struct {
+	prefix		uint32 // the node's index, in the high bits
+	ids			map[string]uint32 // by UserID; never pruned
+	lastID		uint32 // w/o prefix
+	mutex		sync.Mutex // guards ids & lastID
+}
+
+func NewIDTable(nodeIndex int) (t *IDTable) {
+	t = new(IDTable)
+	t.prefix = uint32(nodeIndex) << ID_TABLE_USER_BITS
+	t.ids = make(map[string]uint32)
+	return
+}
+
+// The ID for userID, assigned on its 1st call; never INVALID_CLIENT_USERID
+// BLOCKING: t.mutex
+func (t *IDTable) ID(userID string) (id uint32, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if id, ok := t.ids[userID]; ok {
+		return id, nil
+	}
+	if t.lastID == 1 << ID_TABLE_USER_BITS - 1 {
+		return INVALID_CLIENT_USERID, errors.New(fmt.Sprintf(
+			"All %v user IDs are assigned", t.lastID))
+	}
+	t.lastID++ // from 1, so node 0's IDs are never INVALID_CLIENT_USERID
+	id = t.prefix | t.lastID
+	t.ids[userID] = id
+	return
+}
+
+// HMACJWTAuthenticator verifies HS256 JWTs signed w/ a shared secret
+type HMACJWTAuthenticator struct {
+	Secret		[]byte
+	Issuer		string // required "iss" if non-empty
+	Audience	string // required in "aud" if non-empty
+}
+
+type jwtHeader struct {
+	Alg			string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Subject		string			`json:"sub"`
+	Name		string			`json:"name"`
+	Issuer		string			`json:"iss"`
+	Audience	json.RawMessage	`json:"aud"` // string or []string
+	Expiry		*float64		`json:"exp"`
+	NotBefore	*float64		`json:"nbf"`
+}
+
+func NewHMACJWTAuthenticator(secret []byte, issuer string,
+	audience string) (a *HMACJWTAuthenticator, err error) {
+	if len(secret) == 0 {
+		return nil, errors.New("JWT secret is empty")
+	}
+
+	a = new(HMACJWTAuthenticator)
+	a.Secret = secret
+	a.Issuer = issuer
+	a.Audience = audience
+	return
+}
+
+func (a *HMACJWTAuthenticator) Verify(ctx context.Context, token string) (
+	id Identity, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return id, errors.New("Token is not a JWT")
+	}
+
+	var header jwtHeader
+	if err = decodeJWTPart(parts[0], &header); err != nil {
+		return id, err
+	}
+	if header.Alg != "HS256" {
+		return id, errors.New(fmt.Sprintf(
+			"Unsupported JWT alg %q", header.Alg))
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return id, errors.New("JWT signature is not base64url")
+	}
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return id, errors.New("JWT signature is invalid")
+	}
+
+	var claims jwtClaims
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return id, err
+	}
+	if err = a.checkClaims(&claims, time.Now()); err != nil {
+		return id, err
+	}
+
+	return Identity{claims.Subject, claims.Name}, nil
+}
+
+func (a *HMACJWTAuthenticator) checkClaims(claims *jwtClaims,
+	now time.Time) (err error) {
+	if claims.Subject == "" {
+		return errors.New("JWT has no sub")
+	}
+	if claims.Expiry != nil &&
+		now.After(unixTime(*claims.Expiry).Add(JWT_LEEWAY)) {
+		return errors.New("JWT has expired")
+	}
+	if claims.NotBefore != nil &&
+		now.Add(JWT_LEEWAY).Before(unixTime(*claims.NotBefore)) {
+		return errors.New("JWT is not valid yet")
+	}
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return errors.New(fmt.Sprintf(
+			"JWT issued by %q, not %q", claims.Issuer, a.Issuer))
+	}
+	if a.Audience != "" && !jwtHasAudience(claims.Audience, a.Audience) {
+		return errors.New(fmt.Sprintf(
+			"JWT not issued for audience %q", a.Audience))
+	}
+	return
+}
+
+func decodeJWTPart(part string, v interface{}) (err error) {
+	bin, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("JWT part is not base64url")
+	}
+	if err = json.Unmarshal(bin, v); err != nil {
+		return errors.New(fmt.Sprintf("JWT part is not JSON: %v", err))
+	}
+	return
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds * float64(time.Second)))
+}
+
+func jwtHasAudience(aud json.RawMessage, want string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == want
+	}
+	var multiple []string
+	if json.Unmarshal(aud, &multiple) == nil {
+		for _, a := range multiple {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RemoteAuthenticator asks an HTTP service to verify tokens: it POSTs
+//    {"token": "..."} to URL & expects a 200 w/ an Identity as JSON; any
+//    other status rejects the token
+type RemoteAuthenticator struct {
+	URL			string
+	Client		*http.Client
+}
+
+// Max bytes of a verify response that are read
+const MAX_VERIFY_RESPONSE_LEN = 64 * 1024
+
+func NewRemoteAuthenticator(url string) *RemoteAuthenticator {
+	return &RemoteAuthenticator{
+		URL:	url,
+		Client:	&http.Client{Timeout: AUTH_TIMEOUT},
+	}
+}
+
+func (a *RemoteAuthenticator) Verify(ctx context.Context, token string) (
+	id Identity, err error) {
+	body, err := json.Marshal(map[string]string{"token": token})
+	if err != nil {
+		return id, err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return id, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return id, errors.New(fmt.Sprintf(
+			"Unable to reach token verifier: %v", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return id, errors.New(fmt.Sprintf(
+			"Token rejected by verifier (%s)", resp.Status))
+	}
+
+	dec := json.NewDecoder(io.LimitReader(resp.Body, MAX_VERIFY_RESPONSE_LEN))
+	if err = dec.Decode(&id); err != nil {
+		return id, errors.New(fmt.Sprintf(
+			"Invalid verifier response: %v", err))
+	}
+	if id.UserID == "" {
+		return id, errors.New("Verifier response has no user_id")
+	}
+
+	return id, nil
+}
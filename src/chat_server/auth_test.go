@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIDTable(t *testing.T) {
+	east, west := NewIDTable(0), NewIDTable(1)
+
+	seen := make(map[uint32]string)
+	for _, table := range []*IDTable{east, west} {
+		for _, userID := range []string{"alice", "bob", "carol"} {
+			id, err := table.ID(userID)
+			if err != nil {
+				t.Fatalf("ID(%q) = %v", userID, err)
+			}
+			if id == INVALID_CLIENT_USERID {
+				t.Errorf("ID(%q) = INVALID_CLIENT_USERID", userID)
+			}
+			if other, ok := seen[id]; ok {
+				t.Errorf("ID(%q) = %v, already assigned to %q",
+					userID, id, other)
+			}
+			seen[id] = userID
+
+			if again, _ := table.ID(userID); again != id {
+				t.Errorf("ID(%q) = %v, then %v", userID, id, again)
+			}
+		}
+	}
+}
+
+func TestIDTableExhausted(t *testing.T) {
+	table := NewIDTable(0)
+	table.lastID = 1 << ID_TABLE_USER_BITS - 2
+
+	last, err := table.ID("last")
+	if err != nil || last != 1 << ID_TABLE_USER_BITS - 1 {
+		t.Fatalf("ID() = %v, %v; want the node's last ID", last, err)
+	}
+	if _, err = table.ID("one too many"); err == nil {
+		t.Errorf("ID() assigned an ID past the node's last")
+	}
+	if id, err := table.ID("last"); err != nil || id != last {
+		t.Errorf("ID() = %v, %v for an assigned user; want %v",
+			id, err, last)
+	}
+}
+
+func jwtPart(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	bin, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bin)
+}
+
+// An HS256-signed JWT w/ header & claims
+func signTestJWT(t *testing.T, secret string, header map[string]interface{},
+	claims map[string]interface{}) string {
+	t.Helper()
+
+	signed := jwtPart(t, header) + "." + jwtPart(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestHMACJWTAuthenticator(t *testing.T) {
+	a, err := NewHMACJWTAuthenticator([]byte("secret"), "issuer", "chat")
+	if err != nil {
+		t.Fatalf("NewHMACJWTAuthenticator() = %v", err)
+	}
+	now := time.Now().Unix()
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	// valid claims w/ the given ones changed, or removed if nil
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":	"alice",
+			"name":	"Alice",
+			"iss":	"issuer",
+			"aud":	"chat",
+			"exp":	now + 60,
+			"nbf":	now - 60,
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	sign := func(changes map[string]interface{}) string {
+		return signTestJWT(t, "secret", hs256, claims(changes))
+	}
+	valid := sign(nil)
+	parts := strings.Split(valid, ".")
+	garbage := base64.RawURLEncoding.EncodeToString([]byte("{not json"))
+
+	cases := []struct {
+		name	string
+		token	string
+		wantErr	string // "" if the token should verify
+	}{
+		{"valid", valid, ""},
+		{"bad signature", signTestJWT(t, "guess", hs256, claims(nil)),
+			"signature is invalid"},
+		{"claims swapped under signature", parts[0] + "." +
+			jwtPart(t, claims(map[string]interface{}{"sub": "mallory"})) +
+			"." + parts[2], "signature is invalid"},
+		{"alg none", jwtPart(t, map[string]string{"alg": "none"}) + "." +
+			parts[1] + ".", "Unsupported JWT alg"},
+		{"alg none w/ signature", signTestJWT(t, "secret",
+			map[string]interface{}{"alg": "none"}, claims(nil)),
+			"Unsupported JWT alg"},
+		{"alg HS512", signTestJWT(t, "secret",
+			map[string]interface{}{"alg": "HS512"}, claims(nil)),
+			"Unsupported JWT alg"},
+		{"alg RS256", signTestJWT(t, "secret",
+			map[string]interface{}{"alg": "RS256"}, claims(nil)),
+			"Unsupported JWT alg"},
+		{"no alg", signTestJWT(t, "secret", map[string]interface{}{},
+			claims(nil)), "Unsupported JWT alg"},
+		{"expired within leeway", sign(map[string]interface{}{
+			"exp": now - 10}), ""},
+		{"expired", sign(map[string]interface{}{"exp": now - 60}),
+			"expired"},
+		{"not yet valid within leeway", sign(map[string]interface{}{
+			"nbf": now + 10}), ""},
+		{"not yet valid", sign(map[string]interface{}{"nbf": now + 60}),
+			"not valid yet"},
+		{"no exp or nbf", sign(map[string]interface{}{
+			"exp": nil, "nbf": nil}), ""},
+		{"no sub", sign(map[string]interface{}{"sub": nil}), "no sub"},
+		{"wrong iss", sign(map[string]interface{}{"iss": "other"}),
+			"issued by"},
+		{"no iss", sign(map[string]interface{}{"iss": nil}), "issued by"},
+		{"wrong aud", sign(map[string]interface{}{"aud": "other"}),
+			"audience"},
+		{"no aud", sign(map[string]interface{}{"aud": nil}), "audience"},
+		{"aud array", sign(map[string]interface{}{
+			"aud": []string{"other", "chat"}}), ""},
+		{"wrong aud array", sign(map[string]interface{}{
+			"aud": []string{"other", "CHAT"}}), "audience"},
+		{"empty aud array", sign(map[string]interface{}{
+			"aud": []string{}}), "audience"},
+		{"aud of the wrong type", sign(map[string]interface{}{"aud": 7}),
+			"audience"},
+		{"2 segments", parts[0] + "." + parts[1], "not a JWT"},
+		{"4 segments", valid + "." + parts[2], "not a JWT"},
+		{"empty", "", "not a JWT"},
+		{"header not base64url", "!!." + parts[1] + "." + parts[2],
+			"not base64url"},
+		{"header not JSON", garbage + "." + parts[1] + "." + parts[2],
+			"not JSON"},
+		{"signature not base64url", parts[0] + "." + parts[1] + ".!!",
+			"not base64url"},
+		{"claims not JSON", func() string {
+			signed := parts[0] + "." + garbage
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(signed))
+			return signed + "." +
+				base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		}(), "not JSON"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			id, err := a.Verify(context.Background(), tc.token)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Verify() = %v", err)
+				}
+				if id != (Identity{"alice", "Alice"}) {
+					t.Errorf("Verify() = %+v", id)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Verify() = %v, want an error containing %q",
+					err, tc.wantErr)
+			}
+		})
+	}
+
+	if _, err = NewHMACJWTAuthenticator(nil, "", ""); err == nil {
+		t.Errorf("NewHMACJWTAuthenticator() accepted an empty secret")
+	}
+}
+
+// Issuer & Audience are only checked if configured
+func TestHMACJWTAuthenticatorOptionalClaims(t *testing.T) {
+	a, err := NewHMACJWTAuthenticator([]byte("secret"), "", "")
+	if err != nil {
+		t.Fatalf("NewHMACJWTAuthenticator() = %v", err)
+	}
+	token := signTestJWT(t, "secret", map[string]interface{}{"alg": "HS256"},
+		map[string]interface{}{"sub": "alice", "iss": "any", "aud": "any"})
+	if id, err := a.Verify(context.Background(), token); err != nil ||
+		id.UserID != "alice" {
+		t.Errorf("Verify() = %+v, %v", id, err)
+	}
+}
+
+func TestRemoteAuthenticator(t *testing.T) {
+	release := make(chan bool) // unblocks the "slow" verifier
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var req map[string]string
+			if r.Method != http.MethodPost ||
+				r.Header.Get("Content-Type") != "application/json" ||
+				json.NewDecoder(r.Body).Decode(&req) != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			switch req["token"] {
+			case "good":
+				w.Write([]byte(`{"user_id": "alice", "name": "Alice"}`))
+			case "no-name":
+				w.Write([]byte(`{"user_id": "bob"}`))
+			case "rejected":
+				w.WriteHeader(http.StatusUnauthorized)
+			case "slow":
+				select {
+				case <-r.Context().Done():
+				case <-release:
+				}
+			case "not-json":
+				w.Write([]byte("<html>"))
+			case "no-user-id":
+				w.Write([]byte(`{"name": "Alice"}`))
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) }) // before server.Close()
+
+	a := NewRemoteAuthenticator(server.URL)
+
+	cases := []struct {
+		token	string
+		want	Identity
+		wantErr	string
+	}{
+		{"good", Identity{"alice", "Alice"}, ""},
+		{"no-name", Identity{"bob", ""}, ""},
+		{"rejected", Identity{}, "401"},
+		{"slow", Identity{}, "Unable to reach"},
+		{"not-json", Identity{}, "Invalid verifier response"},
+		{"no-user-id", Identity{}, "no user_id"},
+		{"unexpected", Identity{}, "500"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.token, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				100 * time.Millisecond)
+			defer cancel()
+
+			id, err := a.Verify(ctx, tc.token)
+			if tc.wantErr == "" {
+				if err != nil || id != tc.want {
+					t.Errorf("Verify() = %+v, %v; want %+v", id, err,
+						tc.want)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Verify() = %+v, %v; want an error containing %q",
+					id, err, tc.wantErr)
+			}
+		})
+	}
+
+	// the verifier being down rejects the token too
+	server.Close()
+	if _, err := a.Verify(context.Background(), "good"); err == nil {
+		t.Errorf("Verify() succeeded w/ the verifier down")
+	}
+}
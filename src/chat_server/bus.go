@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// BusEnvelope kinds
+const (
+	// TCPBus only; the dialing node's answer to a BUS_CHALLENGE, w/ its
+	// own nonce & its MAC of the challenge's as the Payload (see
+	// busMAC())
+	BUS_HELLO uint8 = iota + 1
+	// accepting node -> owner: a Client to place, w/ its forwardAttach as
+	// the JSON Payload
+	BUS_ATTACH
+	// accepting node -> owner: a Message the Client sent
+	BUS_FROM_CLIENT
+	// owner -> accepting node: a Message for the Client
+	BUS_TO_CLIENT
+	// accepting node -> owner: the Client's connection closed
+	BUS_DETACH
+	// owner -> accepting node: the owner disconnected the Client
+	BUS_CLOSE
+	// TCPBus only; the 1st envelope on each connection, sent by the
+	// listening node w/ a nonce as the Payload
+	BUS_CHALLENGE
+	// TCPBus only; the listening node's answer to a BUS_HELLO, w/ its MAC
+	// of the hello's nonce as the Payload
+	BUS_WELCOME
+	// any node -> the others: a direct text its directory had no target
+	// for, w/ its binary forwardDirect as the Payload
+	BUS_DIRECT
+	// answers a BUS_DIRECT w/ the same ConnID, w/ a MsgDirectAck
+	BUS_DIRECT_ACK
+)
+
+const (
+	INPROC_BUS_QUEUE_LEN = 1024 // envelopes waiting for a node's handler
+	BUS_SEND_TIMEOUT = 5 * time.Second
+	BUS_DIAL_TIMEOUT = 5 * time.Second
+	// a Message's type & binary data, a forwardAttach, or a
+	//    forwardDirect: a MsgDirectText's text & 2 IDs
+	MAX_BUS_PAYLOAD = MAX_FRAME_LEN + 4
+	MAX_NODE_ID_LEN = math.MaxUint8 // bytes
+	BUS_NONCE_LEN = 32 // bytes
+	// each node's index fills the Client.ID bits an IDTable leaves it
+	MAX_CLUSTER_NODES = 1 << (32 - ID_TABLE_USER_BITS)
+)
+
+// Carried between the nodes of a cluster by a Bus
+type BusEnvelope struct {
+	Kind	uint8 // a BUS_X value
+	From	string // ID of the sending node; set by Send()
+	// the forwarded Client's, on the node that accepted it; a BUS_DIRECT's
+	//    request ID
+	ConnID	uint64
+	Msg		*Message // BUS_FROM_CLIENT, BUS_TO_CLIENT & BUS_DIRECT_ACK only
+	Payload	[]byte // BUS_ATTACH & the TCPBus handshake only
+}
+
+// Bus carries BusEnvelopes between the nodes of a cluster; the envelopes
+//    1 node sends another arrive in the order they were sent
+type Bus interface {
+	// Starts passing the envelopes sent to this node to handler, 1 at a
+	//    time per sending node, & the IDs of nodes this one loses touch
+	//    w/ to nodeDown
+	Listen(handler func(env *BusEnvelope), nodeDown func(nodeID string)) (
+		err error)
+	// Sends env to node nodeID w/o waiting for it to be handled
+	Send(nodeID string, env *BusEnvelope) (err error)
+	Close() (err error)
+}
+
+// Connects the nodes of a cluster run in a single process
+//    (CLUSTER_BUS=inproc), each through its own InProcBus
+type InProcNetwork struct {
+	mutex	sync.RWMutex
+	nodes	map[string]*InProcBus // listening nodes; guarded by mutex
+}
+
+// Shared by every node in this process
+var inProcNetwork = NewInProcNetwork()
+
+func NewInProcNetwork() (n *InProcNetwork) {
+	n = new(InProcNetwork)
+	n.nodes = make(map[string]*InProcBus)
+	return
+}
+
+// A Bus for node nodeID, which joins n once it Listen()s
+func (n *InProcNetwork) Bus(nodeID string) (b *InProcBus) {
+	b = new(InProcBus)
+	b.network = n
+	b.nodeID = nodeID
+	b.queue = make(chan *BusEnvelope, INPROC_BUS_QUEUE_LEN)
+	b.done = make(chan bool)
+	return
+}
+
+type InProcBus struct {
+	network		*InProcNetwork
+	nodeID		string
+	queue		chan *BusEnvelope // drained by b.deliverLoop()
+	nodeDown	func(nodeID string) // set by Listen()
+	done		chan bool // closed by Close()
+	closeOnce	sync.Once
+}
+
+// BLOCKING: b.network.mutex
+func (b *InProcBus) Listen(handler func(env *BusEnvelope),
+	nodeDown func(nodeID string)) (err error) {
+	b.network.mutex.Lock()
+	defer b.network.mutex.Unlock()
+
+	if _, ok := b.network.nodes[b.nodeID]; ok {
+		return errors.New(fmt.Sprintf(
+			"Node %s is already on the bus", b.nodeID))
+	}
+	b.nodeDown = nodeDown
+	b.network.nodes[b.nodeID] = b
+
+	go b.deliverLoop(handler)
+	return
+}
+
+func (b *InProcBus) deliverLoop(handler func(env *BusEnvelope)) {
+	for {
+		select {
+		case <-b.done:
+			return
+		case env := <-b.queue:
+			handler(env)
+		}
+	}
+}
+
+// Waits up to BUS_SEND_TIMEOUT for room in the node's queue
+// BLOCKING: b.network.mutex (read)
+func (b *InProcBus) Send(nodeID string, env *BusEnvelope) (err error) {
+	b.network.mutex.RLock()
+	to, ok := b.network.nodes[nodeID]
+	b.network.mutex.RUnlock()
+	if !ok {
+		return errors.New(fmt.Sprintf("Node %s is not on the bus", nodeID))
+	}
+
+	sent := *env
+	sent.From = b.nodeID
+	select {
+	case to.queue <- &sent:
+		return nil
+	case <-to.done:
+		return errors.New(fmt.Sprintf("Node %s left the bus", nodeID))
+	case <-time.After(BUS_SEND_TIMEOUT):
+		return errors.New(fmt.Sprintf(
+			"Node %s not keeping up w/ the bus", nodeID))
+	}
+}
+
+// Leaves the network; the nodes still on it are told this one is down
+// BLOCKING: b.network.mutex
+func (b *InProcBus) Close() (err error) {
+	b.closeOnce.Do(func() {
+		close(b.done)
+
+		b.network.mutex.Lock()
+		if b.network.nodes[b.nodeID] == b {
+			delete(b.network.nodes, b.nodeID)
+		}
+		others := make([]*InProcBus, 0, len(b.network.nodes))
+		for _, other := range b.network.nodes {
+			others = append(others, other)
+		}
+		b.network.mutex.Unlock()
+
+		for _, other := range others {
+			go other.nodeDown(b.nodeID)
+		}
+	})
+	return
+}
+
+// TCPBus connects nodes over TCP: each node listens on its BusAddr & dials
+//    the others as it first sends to them. A node is reported down once
+//    its connection breaks; the next Send() dials it again.
+// Both ends of a connection prove they know the CLUSTER_SECRET by MACing
+//    the other's nonce, so it's never sent; envelopes are then sent in
+//    the clear & unsigned, so the bus belongs on a private network
+type TCPBus struct {
+	nodeID		string
+	addrs		map[string]string // bus address by node ID
+	secret		[]byte // every node's must match
+
+	listener	net.Listener // set by Listen()
+	handler		func(env *BusEnvelope)
+	nodeDown	func(nodeID string)
+
+	mutex		sync.Mutex
+	peers		map[string]*tcpBusPeer // by node ID; guarded by mutex
+	inbound		map[net.Conn]bool // guarded by mutex
+	closed		bool // guarded by mutex
+
+	wg			sync.WaitGroup // the goroutines reading conns
+}
+
+// The connection this node sends to another node on
+type tcpBusPeer struct {
+	nodeID		string
+	addr		string
+	mutex		sync.Mutex // serializes writes
+	conn		net.Conn // nil until dialed; guarded by mutex
+}
+
+// addrs must hold every node's bus address, nodeID's included
+func NewTCPBus(nodeID string, addrs map[string]string, secret []byte) (
+	b *TCPBus, err error) {
+	if addrs[nodeID] == "" {
+		return nil, errors.New(fmt.Sprintf(
+			"Node %s has no bus address", nodeID))
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("Cluster secret is empty")
+	}
+
+	b = new(TCPBus)
+	b.nodeID = nodeID
+	b.addrs = addrs
+	b.secret = secret
+	b.peers = make(map[string]*tcpBusPeer)
+	b.inbound = make(map[net.Conn]bool)
+	return
+}
+
+func (b *TCPBus) Listen(handler func(env *BusEnvelope),
+	nodeDown func(nodeID string)) (err error) {
+	b.listener, err = net.Listen("tcp", b.addrs[b.nodeID])
+	if err != nil {
+		return err
+	}
+	b.handler = handler
+	b.nodeDown = nodeDown
+	slog.Info("Bus listening", "node_id", b.nodeID,
+		"addr", b.listener.Addr().String())
+
+	b.wg.Add(1)
+	go b.acceptLoop()
+	return
+}
+
+func (b *TCPBus) acceptLoop() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.listener.Accept()
+		if errors.Is(err, net.ErrClosed) { // closed by b.Close()
+			return
+		} else if err != nil {
+			slog.Error("Unable to accept bus connection", "err", err)
+			time.Sleep(ACCEPT_RETRY_DELAY)
+			continue
+		}
+
+		b.mutex.Lock()
+		if b.closed {
+			b.mutex.Unlock()
+			conn.Close() // ignoring errors
+			return
+		}
+		b.inbound[conn] = true
+		b.wg.Add(1)
+		b.mutex.Unlock()
+
+		go b.readLoop(conn)
+	}
+}
+
+// Passes the envelopes arriving on an inbound conn to b.handler, once
+//    the sending node has identified itself (see b.acceptHello())
+func (b *TCPBus) readLoop(conn net.Conn) {
+	defer func() {
+		b.mutex.Lock()
+		delete(b.inbound, conn)
+		b.mutex.Unlock()
+		conn.Close() // ignoring errors
+		b.wg.Done()
+	}()
+
+	reader := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(BUS_DIAL_TIMEOUT))
+	hello, err := b.acceptHello(conn, reader)
+	if err != nil {
+		slog.Warn("Rejecting bus connection",
+			"remote_addr", conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	for {
+		env, err := decodeEnvelope(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Unable to read from bus", "from_node_id",
+					hello.From, "err", err)
+			}
+			return
+		}
+		env.From = hello.From // as verified
+		b.handler(env)
+	}
+}
+
+// Challenges the dialing node to MAC a nonce, then proves this node knows
+//    the secret too by MACing the nonce in its BUS_HELLO
+func (b *TCPBus) acceptHello(conn net.Conn, reader io.Reader) (
+	hello *BusEnvelope, err error) {
+	challenge, err := newBusNonce()
+	if err != nil {
+		return nil, err
+	}
+	err = writeEnvelope(conn, b.nodeID, &BusEnvelope{
+		Kind:		BUS_CHALLENGE,
+		Payload:	challenge,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hello, err = decodeEnvelope(reader)
+	if err != nil {
+		return nil, err
+	}
+	if hello.Kind != BUS_HELLO {
+		return nil, errors.New(fmt.Sprintf(
+			"Expected hello, got kind %v", hello.Kind))
+	}
+	if b.addrs[hello.From] == "" || hello.From == b.nodeID {
+		return nil, errors.New(fmt.Sprintf("Unknown node %q", hello.From))
+	}
+	if len(hello.Payload) != BUS_NONCE_LEN + sha256.Size {
+		return nil, errors.New("Malformed hello")
+	}
+	nonce, mac := hello.Payload[:BUS_NONCE_LEN], hello.Payload[BUS_NONCE_LEN:]
+	if !hmac.Equal(mac,
+		busMAC(b.secret, BUS_HELLO, hello.From, b.nodeID, challenge)) {
+		return nil, errors.New(fmt.Sprintf(
+			"Wrong CLUSTER_SECRET from node %q", hello.From))
+	}
+
+	err = writeEnvelope(conn, b.nodeID, &BusEnvelope{
+		Kind:		BUS_WELCOME,
+		Payload:	busMAC(b.secret, BUS_WELCOME, b.nodeID, hello.From, nonce),
+	})
+	return hello, err
+}
+
+// Answers the listening node's BUS_CHALLENGE w/ a BUS_HELLO & checks its
+//    BUS_WELCOME, so this node only sends to a node knowing the secret
+func (b *TCPBus) sendHello(p *tcpBusPeer, conn net.Conn) (err error) {
+	reader := bufio.NewReader(conn)
+
+	challenge, err := decodeEnvelope(reader)
+	if err != nil {
+		return err
+	}
+	if challenge.Kind != BUS_CHALLENGE || challenge.From != p.nodeID ||
+		len(challenge.Payload) != BUS_NONCE_LEN {
+		return errors.New(fmt.Sprintf(
+			"Expected a challenge from node %q", p.nodeID))
+	}
+
+	nonce, err := newBusNonce()
+	if err != nil {
+		return err
+	}
+	payload := append(nonce, busMAC(b.secret, BUS_HELLO, b.nodeID,
+		p.nodeID, challenge.Payload)...)
+	err = writeEnvelope(conn, b.nodeID, &BusEnvelope{
+		Kind:		BUS_HELLO,
+		Payload:	payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	welcome, err := decodeEnvelope(reader)
+	if err != nil {
+		return err
+	}
+	if welcome.Kind != BUS_WELCOME || !hmac.Equal(welcome.Payload,
+		busMAC(b.secret, BUS_WELCOME, p.nodeID, b.nodeID, nonce)) {
+		return errors.New(fmt.Sprintf(
+			"Wrong CLUSTER_SECRET from node %q", p.nodeID))
+	}
+	return
+}
+
+func newBusNonce() (nonce []byte, err error) {
+	nonce = make([]byte, BUS_NONCE_LEN)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// HMAC-SHA256 of nonce, sent by node from to node to in an envelope of
+//    kind; each field is length-prefixed, so no 2 inputs share a MAC
+func busMAC(secret []byte, kind uint8, from string, to string,
+	nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte{kind})
+	for _, field := range [][]byte{[]byte(from), []byte(to), nonce} {
+		mac.Write([]byte{uint8(len(field))})
+		mac.Write(field)
+	}
+	return mac.Sum(nil)
+}
+
+func writeEnvelope(w io.Writer, from string, env *BusEnvelope) (err error) {
+	bin, err := encodeEnvelope(from, env)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bin)
+	return
+}
+
+// BLOCKING: b.mutex
+func (b *TCPBus) peer(nodeID string) (p *tcpBusPeer, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, errors.New("Bus is closed")
+	}
+	p, ok := b.peers[nodeID]
+	if !ok {
+		addr, ok := b.addrs[nodeID]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown node %s", nodeID))
+		}
+		p = &tcpBusPeer{nodeID: nodeID, addr: addr}
+		b.peers[nodeID] = p
+	}
+	return p, nil
+}
+
+// Dials the node on the first send; a failed write drops the connection
+// BLOCKING: b.mutex, then the peer's mutex
+func (b *TCPBus) Send(nodeID string, env *BusEnvelope) (err error) {
+	bin, err := encodeEnvelope(b.nodeID, env)
+	if err != nil {
+		return err
+	}
+	p, err := b.peer(nodeID)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	conn, err := b.connect(p)
+	if err == nil {
+		err = conn.SetWriteDeadline(time.Now().Add(BUS_SEND_TIMEOUT))
+	}
+	if err == nil {
+		_, err = conn.Write(bin)
+	}
+	p.mutex.Unlock()
+
+	if err != nil && conn != nil {
+		b.dropPeerConn(p, conn)
+	}
+	return err
+}
+
+// requires p.mutex to be held
+func (b *TCPBus) connect(p *tcpBusPeer) (conn net.Conn, err error) {
+	if p.conn != nil {
+		return p.conn, nil
+	}
+
+	conn, err = net.DialTimeout("tcp", p.addr, BUS_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(BUS_DIAL_TIMEOUT))
+	if err = b.sendHello(p, conn); err != nil {
+		conn.Close() // ignoring errors
+		return nil, errors.New(fmt.Sprintf(
+			"Bus handshake w/ node %s failed: %v", p.nodeID, err))
+	}
+	conn.SetDeadline(time.Time{})
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		conn.Close() // ignoring errors
+		return nil, errors.New("Bus is closed")
+	}
+	b.wg.Add(1)
+	b.mutex.Unlock()
+
+	p.conn = conn
+	go b.watchPeer(p, conn)
+	return conn, nil
+}
+
+// Nodes only write the handshake to the conns they accept, so a read
+//    returns once the peer's side closes
+func (b *TCPBus) watchPeer(p *tcpBusPeer, conn net.Conn) {
+	defer b.wg.Done()
+
+	io.Copy(io.Discard, conn) // ignoring errors
+	b.dropPeerConn(p, conn)
+}
+
+// Closes conn & reports p's node down, unless conn was already dropped
+// BLOCKING: p.mutex, then b.mutex
+func (b *TCPBus) dropPeerConn(p *tcpBusPeer, conn net.Conn) {
+	p.mutex.Lock()
+	dropped := p.conn == conn
+	if dropped {
+		p.conn = nil
+	}
+	p.mutex.Unlock()
+	conn.Close() // ignoring errors
+
+	b.mutex.Lock()
+	closed := b.closed
+	b.mutex.Unlock()
+
+	if dropped && !closed {
+		slog.Warn("Lost bus connection", "node_id", p.nodeID)
+		go b.nodeDown(p.nodeID)
+	}
+}
+
+// BLOCKING: b.mutex, then each peer's mutex
+func (b *TCPBus) Close() (err error) {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return
+	}
+	b.closed = true
+	if b.listener != nil {
+		err = b.listener.Close()
+	}
+	for conn := range b.inbound {
+		conn.Close() // ignoring errors
+	}
+	peers := make([]*tcpBusPeer, 0, len(b.peers))
+	for _, p := range b.peers {
+		peers = append(peers, p)
+	}
+	b.mutex.Unlock()
+
+	for _, p := range peers {
+		p.mutex.Lock()
+		if p.conn != nil {
+			p.conn.Close() // ignoring errors
+			p.conn = nil
+		}
+		p.mutex.Unlock()
+	}
+
+	b.wg.Wait()
+	return
+}
+
+// bit pattern: 8, 8, len(from), 64, 32, len(payload)
+//    - 8: Kind (uint8)
+//    - 8: length of from (uint8)
+//    - len(from): from, the sending node's ID
+//    - 64: ConnID (uint64)
+//    - 32: length of payload (uint32)
+//    - len(payload): Msg's type (uint8) & binary data if Msg is set, or
+//      else Payload
+func encodeEnvelope(from string, env *BusEnvelope) (bin []byte, err error) {
+	payload := env.Payload
+	if env.Msg != nil {
+		data, err := env.Msg.ToBinary()
+		if err != nil {
+			return nil, err
+		}
+		payload = append([]byte{env.Msg.Type}, data...)
+	}
+
+	if len(from) > MAX_NODE_ID_LEN {
+		return nil, errors.New(fmt.Sprintf(
+			"Node ID of %v bytes is too long", len(from)))
+	}
+	if len(payload) > MAX_BUS_PAYLOAD {
+		return nil, errors.New(fmt.Sprintf(
+			"Bus payload of %v bytes is too long", len(payload)))
+	}
+
+	bin = append([]byte{env.Kind, uint8(len(from))}, from...)
+	bin = binary.BigEndian.AppendUint64(bin, env.ConnID)
+	bin = binary.BigEndian.AppendUint32(bin, uint32(len(payload)))
+	return append(bin, payload...), nil
+}
+
+// Reads a single envelope from r; the inverse of encodeEnvelope()
+func decodeEnvelope(r io.Reader) (env *BusEnvelope, err error) {
+	var header [2]uint8 // Kind, length of From
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	from := make([]byte, header[1])
+	if _, err = io.ReadFull(r, from); err != nil {
+		return nil, err
+	}
+	var fixed [12]byte // ConnID, length of payload
+	if _, err = io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+
+	payloadLen := binary.BigEndian.Uint32(fixed[8:])
+	if payloadLen > MAX_BUS_PAYLOAD {
+		return nil, errors.New(fmt.Sprintf(
+			"Bus payload of %v bytes is too long", payloadLen))
+	}
+	payload := make([]byte, payloadLen)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	env = &BusEnvelope{
+		Kind:	header[0],
+		From:	string(from),
+		ConnID:	binary.BigEndian.Uint64(fixed[:8]),
+	}
+	switch env.Kind {
+	case BUS_FROM_CLIENT, BUS_TO_CLIENT, BUS_DIRECT_ACK:
+		if len(payload) == 0 {
+			return nil, errors.New("Bus envelope is missing its Message")
+		}
+		env.Msg, err = MsgFromBinary(payload[0], payload[1:])
+		if err != nil {
+			return nil, err
+		}
+	default:
+		env.Payload = payload
+	}
+	return env, nil
+}
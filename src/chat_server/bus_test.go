@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A node's view of a Bus: the envelopes it was sent & the nodes it was
+//    told are down
+type testBusNode struct {
+	bus			Bus
+	received	chan *BusEnvelope
+	down		chan string
+}
+
+func listenTestBus(t *testing.T, bus Bus) *testBusNode {
+	t.Helper()
+
+	n := &testBusNode{
+		bus:		bus,
+		received:	make(chan *BusEnvelope, 256),
+		down:		make(chan string, 4),
+	}
+	err := bus.Listen(func(env *BusEnvelope) { n.received <- env },
+		func(nodeID string) { n.down <- nodeID })
+	if err != nil {
+		t.Fatalf("Listen() = %v", err)
+	}
+	t.Cleanup(func() { bus.Close() })
+	return n
+}
+
+// A free "127.0.0.1:port" address to listen on
+func freeTestAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// Nodes "a" & "b" on a bus of kind busKind (a CLUSTER_BUS value)
+func newTestBusPair(t *testing.T, busKind string) (a *testBusNode,
+	b *testBusNode) {
+	t.Helper()
+
+	if busKind == CLUSTER_BUS_INPROC {
+		network := NewInProcNetwork()
+		return listenTestBus(t, network.Bus("a")),
+			listenTestBus(t, network.Bus("b"))
+	}
+
+	addrs := map[string]string{"a": freeTestAddr(t), "b": freeTestAddr(t)}
+	var nodes []*testBusNode
+	for _, nodeID := range []string{"a", "b"} {
+		bus, err := NewTCPBus(nodeID, addrs, []byte("secret"))
+		if err != nil {
+			t.Fatalf("NewTCPBus() = %v", err)
+		}
+		nodes = append(nodes, listenTestBus(t, bus))
+	}
+	return nodes[0], nodes[1]
+}
+
+func (n *testBusNode) expectEnvelope(t *testing.T) *BusEnvelope {
+	t.Helper()
+
+	select {
+	case env := <-n.received:
+		return env
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No envelope received")
+		return nil
+	}
+}
+
+func TestBusDelivery(t *testing.T) {
+	for _, busKind := range []string{CLUSTER_BUS_INPROC, CLUSTER_BUS_TCP} {
+		t.Run(busKind, func(t *testing.T) {
+			a, b := newTestBusPair(t, busKind)
+
+			const sent = 100
+			for i := 0; i < sent; i++ {
+				err := a.bus.Send("b", &BusEnvelope{
+					Kind:	BUS_FROM_CLIENT,
+					ConnID:	uint64(i),
+					Msg:	&Message{MTypeClientText, MsgClientText{
+						7, []byte(fmt.Sprint(i))}},
+				})
+				if err != nil {
+					t.Fatalf("Send() = %v", err)
+				}
+			}
+			for i := 0; i < sent; i++ {
+				env := b.expectEnvelope(t)
+				if env.From != "a" || env.ConnID != uint64(i) {
+					t.Fatalf("Envelope %v from %q, want %v from %q",
+						env.ConnID, env.From, i, "a")
+				}
+				text := env.Msg.Data
+				if decoded, ok := text.(*MsgClientText); ok {
+					text = *decoded // TCPBus envelopes are decoded
+				}
+				want := MsgClientText{7, []byte(fmt.Sprint(i))}
+				if !reflect.DeepEqual(text, want) {
+					t.Errorf("Msg = %v, want %v", text, want)
+				}
+			}
+
+			// replies travel the other way on the same bus
+			err := b.bus.Send("a", &BusEnvelope{
+				Kind:		BUS_ATTACH,
+				ConnID:		1,
+				Payload:	[]byte("{}"),
+			})
+			if err != nil {
+				t.Fatalf("Send() = %v", err)
+			}
+			if env := a.expectEnvelope(t); env.From != "b" ||
+				string(env.Payload) != "{}" {
+				t.Errorf("Envelope from %q w/ payload %q", env.From,
+					env.Payload)
+			}
+
+			// a node leaving is reported to the other
+			b.bus.Close()
+			select {
+			case nodeID := <-a.down:
+				if nodeID != "b" {
+					t.Errorf("Node %q reported down, want %q", nodeID, "b")
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("Closed node not reported down")
+			}
+			if err := a.bus.Send("b", &BusEnvelope{Kind: BUS_DETACH});
+				err == nil {
+				t.Errorf("Send() to a closed node succeeded")
+			}
+		})
+	}
+}
+
+func TestTCPBusWrongSecret(t *testing.T) {
+	addrs := map[string]string{"a": freeTestAddr(t), "b": freeTestAddr(t)}
+	aBus, err := NewTCPBus("a", addrs, []byte("secret"))
+	if err != nil {
+		t.Fatalf("NewTCPBus() = %v", err)
+	}
+	bBus, err := NewTCPBus("b", addrs, []byte("guess"))
+	if err != nil {
+		t.Fatalf("NewTCPBus() = %v", err)
+	}
+	a, b := listenTestBus(t, aBus), listenTestBus(t, bBus)
+
+	err = a.bus.Send("b", &BusEnvelope{Kind: BUS_DETACH})
+	if err == nil || !strings.Contains(err.Error(), "handshake") {
+		t.Errorf("Send() = %v, want a handshake error", err)
+	}
+	select {
+	case env := <-b.received:
+		t.Errorf("Node w/ another secret received %+v", env)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err = NewTCPBus("a", addrs, nil); err == nil {
+		t.Errorf("NewTCPBus() accepted an empty secret")
+	}
+}
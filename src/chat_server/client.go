@@ -1,234 +1,655 @@
 package main
 
 import (
-	"io"
-	"bufio"
-	"bytes"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"net"
+	"io"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Global Client UserID value
+// Client.ID of a Client that hasn't completed auth
 const INVALID_CLIENT_USERID = 0 // id 0 is invalid
-var CLIENT_USERID_MUTEX sync.Mutex
-var CLIENT_USERID uint32 = INVALID_CLIENT_USERID
 
-// BLOCKING: CLIENT_USERID_MUTEX
-func NextClientID() (uint32) {
-	CLIENT_USERID_MUTEX.Lock()
-	defer CLIENT_USERID_MUTEX.Unlock()
+// Client auth handshake limits
+const (
+	AUTH_TIMEOUT = 10 * time.Second
+	MAX_CLIENT_NAME_LEN = 64 // bytes
+)
 
-	CLIENT_USERID++
-	if (CLIENT_USERID == INVALID_CLIENT_USERID) {
-		CLIENT_USERID++
-	}
+// Client.Disconnect() reasons, counted by /metrics
+const (
+	DISCONNECT_CLOSED = "closed" // the peer closed its conn
+	DISCONNECT_READ_ERROR = "read_error"
+	DISCONNECT_IDLE = "idle_timeout"
+	DISCONNECT_PROTOCOL_ERROR = "protocol_error"
+	DISCONNECT_AUTH_FAILED = "auth_failed"
+	DISCONNECT_SLOW_CONSUMER = "slow_consumer"
+	DISCONNECT_WRITE_ERROR = "write_error"
+	DISCONNECT_KICKED = "kicked"
+	DISCONNECT_RESUMED = "resumed" // on a new connection
+	// by the same verified user's newer connection
+	DISCONNECT_REPLACED = "replaced"
+	DISCONNECT_JOIN_FAILED = "join_failed" // placed in no Community
+	DISCONNECT_REDIRECTED = "redirected" // to the node owning its region
+	DISCONNECT_NODE_DOWN = "node_down" // its owner node is unreachable
+	DISCONNECT_RATE_LIMITED = "rate_limited"
+	DISCONNECT_SHUTDOWN = "shutdown"
+)
 
-	return CLIENT_USERID
-}
+// How long a ClientAction waits for the Client to be (re)placed in a
+// Server/Community before being dropped
+const CA_ROUTE_TIMEOUT = 5 * time.Second
 
 type Client struct {
-	ID			uint32 // TODO: use user deviceID hash instead
-	Name		string // FB first name
+	ID			uint32 // assigned by ids if verified (see auth.go)
+	UserID		string // verified by auth; empty if AUTH_MODE is none
+	Name		string // display name; the token's, if it has one
+	nameRWMutex	sync.RWMutex // guards Name once auth completes
 	ServerID	string // region name
 	CommID		string // current neighbourhood
 
-	conn 		net.Conn
-	connReader	*bufio.Reader
+	conn 		ClientConn // TCP/TLS or WebSocket
+
+	// Common Name of the verified mutual TLS client cert, if any
+	TrustedPeer	string
+
+	caps			uint32 // negotiated; access w/ sync/atomic
+
+	// region explicitly requested during auth, if any
+	requestedServerID	string
+	// verifies MsgClientToken; nil if MsgClientID is trusted instead
+	auth				Authenticator
+	ids					*IDTable // shared by all Clients
 
-	authComplete	chan bool
+	authComplete	chan bool // closed once ID & Name have been received
+	readLoopDone	chan bool // closed once readLoop exits
 
-	serverCAChan	chan *ClientAction
-	commCAChan 		chan *ClientAction
-	caChanRWMutex	sync.RWMutex
+	// where ClientActions are sent; see SetCAChans()
+	swRoute			caRoute // never changes
+	serverRoute		caRoute
+	commRoute		caRoute
+	caChansSet		chan bool // closed while the routes above are set
+	caChanRWMutex	sync.RWMutex // guards the 3 fields above
 
-	disconnected	bool
+	closed			chan bool // closed by Disconnect()
+
+	writeQueue		*writeQueue // drained by c.writeLoop()
+	logger			atomic.Pointer[slog.Logger] // see c.Log()
+	heartbeat		HeartbeatConfig
+	// limits MsgClientText; see c.allowText()
+	flood			*FloodGuard // shared by all Clients
+	textBucket		*tokenBucket // limit set by the Client's Community
+
+	sessions		*SessionStore // shared by all Clients
+	sessionToken	string // set by sessions.Issue()
+	resumed			*resumedSession // set by a MsgResume during auth
+	placement		atomic.Pointer[placement] // see c.Placement()
+
+	// closed once it's known which node handles the Client's Messages
+	routed			chan bool
+	// set if another node owns the Client's region (see sw.handOff())
+	forward			atomic.Pointer[forwardLink]
+	// the node that accepted the Client's conn, if it was forwarded here
+	forwardedFrom	string
+
+	disconnected	int32 // 1 once Disconnect()ed; access w/ sync/atomic
 }
 
 // will close conn if err != nil
-func NewClient(connPtr *net.Conn) (c *Client, err error) {
-	defer func(connPtr *net.Conn, err *error) {
+// Routes the Client w/ sw.resolver, verifies it w/ sw.auth, queues its
+//    writes per sw.writeQueue, checks it's alive per sw.heartbeat, limits
+//    its text w/ sw.flood & sends its direct messages to sw
+func NewClient(conn ClientConn, sw *ServerWrapper) (c *Client, err error) {
+	c = newClient(conn, sw)
+	c.setLogContext()
+
+	defer func(c *Client, err *error) {
 		if *err != nil {
-			log.Println("DEBUG: NewClient() failed; closing conn")
-            (*connPtr).Close() // ignoring errors
+			c.Log().Debug("NewClient() failed; closing conn", "err", *err)
+			c.markDisconnected() // stops c.writeLoop()
+			c.conn.Close() // ignoring errors
 		}
-	}(connPtr, &err)
+	}(c, &err)
 
-	c = new(Client)
-	c.conn = *connPtr
-	c.connReader = bufio.NewReader(c.conn)
-	c.disconnected = false
+	go c.writeLoop()
+	if c.heartbeat.Enabled() {
+		go c.heartbeatLoop()
+	}
 
-	c.authComplete = make(chan bool)
-	c.RemoveCAChans()
-	
+	if err = c.conn.Handshake(AUTH_TIMEOUT); err != nil {
+		return nil, err
+	}
+	c.TrustedPeer = c.conn.TrustedPeer()
 
+	// starts c.readLoop()
 	if err = c.requestAuth(); err != nil {
 		return nil, err
 	}
 
-	sID, err := ServerIDFromIP(c.conn.RemoteAddr().String())
+	if c.resumed != nil && c.resumed.serverID != "" {
+		c.ServerID = c.resumed.serverID
+		c.setLogContext("server_id", c.ServerID)
+		return
+	} else if c.requestedServerID != "" &&
+		sw.resolver.HasServerID(c.requestedServerID) {
+		c.ServerID = c.requestedServerID
+		c.setLogContext("server_id", c.ServerID)
+		return
+	} else if c.requestedServerID != "" {
+		c.Log().Warn("Requested unknown region; routing by IP",
+			"region", c.requestedServerID)
+	}
+
+	sID, err := ServerIDFromIP(sw.resolver, c.conn.RemoteAddr().String())
 	if err != nil {
 		return nil, err
 	}
 	c.ServerID = sID
+	c.setLogContext("server_id", c.ServerID)
 
+	return
+}
+
+// A Client forwarded by the node that accepted & authenticated its conn;
+//    that node also checks the conn is alive
+func newForwardedClient(conn *busConn, sw *ServerWrapper,
+	a forwardAttach) (c *Client) {
+	c = newClient(conn, sw)
+	c.heartbeat = HeartbeatConfig{}
+	c.ID = a.ID
+	c.UserID = a.UserID
+	c.Name = a.Name
+	c.caps = a.Caps
+	c.ServerID = a.ServerID
+	c.TrustedPeer = a.TrustedPeer
+	c.forwardedFrom = conn.nodeID
+	close(c.authComplete)
+	c.setRouted(nil)
+	c.setLogContext("server_id", c.ServerID, "from_node_id", conn.nodeID)
+
+	go c.writeLoop()
 	go c.readLoop()
+	c.Log().Info("Forwarded Client attached", "name", c.Name)
+	return
+}
 
+func newClient(conn ClientConn, sw *ServerWrapper) (c *Client) {
+	c = new(Client)
+	c.conn = conn
+	c.auth = sw.auth
+	c.ids = sw.ids
+	c.swRoute = sw.route()
+	c.caps = DEFAULT_CAPS // until negotiated
+	c.writeQueue = newWriteQueue(sw.writeQueue)
+	c.heartbeat = sw.heartbeat
+	c.flood = sw.flood
+	c.textBucket = newTokenBucket(sw.rateLimits.Text)
+	c.sessions = sw.sessions
+
+	c.authComplete = make(chan bool)
+	c.readLoopDone = make(chan bool)
+	c.closed = make(chan bool)
+	c.caChansSet = make(chan bool)
+	c.routed = make(chan bool)
 	return
 }
 
 func (c *Client) ToString() string {
-	return fmt.Sprintf("Client %s (%v)", c.Name, c.ID)
+	return fmt.Sprintf("Client %s (%v)", c.DisplayName(), c.ID)
+}
+
+// BLOCKING: c.nameRWMutex (read)
+func (c *Client) DisplayName() string {
+	c.nameRWMutex.RLock()
+	defer c.nameRWMutex.RUnlock()
+
+	return c.Name
+}
+
+// Renames the Client; after auth only by Community.CARename()
+// BLOCKING: c.nameRWMutex
+func (c *Client) SetName(name string) {
+	c.nameRWMutex.Lock()
+	defer c.nameRWMutex.Unlock()
+
+	c.Name = name
+}
+
+// Closed once the Client has been Disconnect()ed
+func (c *Client) Closed() <-chan bool {
+	return c.closed
 }
 
+// Called by a Server before moving the Client; until the next
+// SetCAChans(), ClientActions the Client sends wait for its new routes.
+// Blocks until any in-flight send to the Client's Community completes, so
+// the Community never receives a ClientAction after it removes the Client
+// BLOCKING: c.caChanRWMutex
 func (c *Client) RemoveCAChans() {
-	// TODO: import "https://github.com/matryer/resync"
-	/*
-	c.removeCAOnce.Do() {
-		c.caChanRWMutex.Lock()
-		c.serverCAChan = nil
-		c.commCAChan = nil
+	c.caChanRWMutex.Lock()
+	defer c.caChanRWMutex.Unlock()
+
+	c.serverRoute = caRoute{}
+	c.commRoute = caRoute{}
+
+	select {
+	case <-c.caChansSet: // was set; start waiting again
+		c.caChansSet = make(chan bool)
+	default:
+	}
+}
+
+// Called by a Server once the Client has been placed in a Community
+// BLOCKING: c.caChanRWMutex
+func (c *Client) SetCAChans(sRoute caRoute, commRoute caRoute) {
+	c.caChanRWMutex.Lock()
+	defer c.caChanRWMutex.Unlock()
+
+	c.serverRoute = sRoute
+	c.commRoute = commRoute
+
+	select {
+	case <-c.caChansSet: // already set
+	default:
+		close(c.caChansSet) // release waiting senders
 	}
-	*/
 }
 
-func (c *Client) SetCAChans(sCAChan chan *ClientAction,
-	commCAChan chan *ClientAction) {
-	// TODO: import "https://github.com/matryer/resync"
-	/*
-	c.removeCAOnce.Do() {
-		c.serverCAChan = sCAChan
-		c.commCAChan = commCAChan
-		c.caChanRWMutex.Unlock()
+// Waits for SetCAChans() to close caChansSet
+func (c *Client) waitCAChans(caChansSet chan bool) (err error) {
+	select {
+	case <-caChansSet:
+		return nil
+	case <-c.closed:
+		return errors.New("Client disconnected")
+	case <-time.After(CA_ROUTE_TIMEOUT):
+		return errors.New(fmt.Sprintf(
+			"Not placed in a Community within %v", CA_ROUTE_TIMEOUT))
 	}
-	*/
 }
 
-func (c *Client) Disconnect() {
-	// TODO: atomic boolean
-	if c.disconnected {
-		log.Printf("%s already disconnected.\n", c.ToString())
+func (c *Client) IsDisconnected() bool {
+	return atomic.LoadInt32(&c.disconnected) == 1
+}
+
+// Sets c.disconnected & closes c.closed; false if already done
+func (c *Client) markDisconnected() bool {
+	if !atomic.CompareAndSwapInt32(&c.disconnected, 0, 1) {
+		return false
+	}
+	close(c.closed)
+	return true
+}
+
+// Closes c.conn & has the Client's Server remove it from its Community;
+//    reason is a DISCONNECT_X value, counted only for the 1st call
+func (c *Client) Disconnect(reason string) {
+	if !c.markDisconnected() {
+		c.Log().Debug("Already disconnected", "reason", reason)
 		return
 	}
-	c.disconnected = true
-	log.Printf("Disconnecting %s (id: %v)\n", c.Name, c.ID)
+	c.Log().Info("Disconnecting", "name", c.DisplayName(), "reason", reason)
+	metrics.Disconnect(reason)
 	c.conn.Close() // ignoring errors
 
-	// TODO: tell Community/Server/ServerWrapper to remove Client
+	if c.forward.Load() != nil {
+		return // placed on its owner node, not here
+	}
+	if serverID, _ := c.Placement(); serverID == "" {
+		// never added to a Community, so there's nothing to leave; one
+		// being added sees c.disconnected (see Server.AddClient())
+		return
+	}
+
+	// c.disconnected is set before the chans are read; a Client w/o
+	// chans is removed by the Server that next calls c.SetCAChans()
+	// (see Server.AddClient())
+	err := c.SendServerCA(&ClientAction{
+		ClientID:	c.ID,
+		Action:		LeaveServer{c},
+	})
+	if err != nil {
+		c.Log().Warn("Unable to send LeaveServer", "err", err)
+	}
 }
 
 // Retreives values for c.ID & c.Name from c.conn
+// Sends a MsgClientAuth and starts c.readLoop(), which will close
+// c.authComplete once the MsgClientID & MsgClientName responses arrive
 func (c *Client) requestAuth() (err error) {
-	defer log.Println("Client.requestAuth() success.")
+	err = c.WriteMsg(&Message{MTypeClientAuth, MsgClientAuth{
+		Version:	PROTOCOL_VERSION,
+		Caps:		SERVER_CAPS,
+	}})
+	if err != nil {
+		return errors.New(fmt.Sprintf(
+			"Unable to send auth request: %v", err))
+	}
 
-	/* TODO:
-	c.WriteMsg(MsgClientAuth)
-	<-c.authComplete // close once auth has completed
-	*/
+	go c.readLoop()
 
-	// TODO: c.ID := c.ReadMsg() // MsgClientID
-	c.ID = NextClientID()
-	// TODO: c.Name := c.ReadMsg() // MsgClientName
-	c.Name = fmt.Sprintf("Client_%v", c.ID)
+	select {
+	case <-c.authComplete:
+	case <-c.readLoopDone:
+		return errors.New("Connection closed before auth completed")
+	case <-time.After(AUTH_TIMEOUT):
+		metrics.AuthFailure()
+		return errors.New(fmt.Sprintf(
+			"Auth not completed within %v", AUTH_TIMEOUT))
+	}
 
+	c.setLogContext()
+	c.Log().Info("Auth completed", "name", c.DisplayName())
 	return
 }
 
-func (c *Client) readLoop() {
-	for {
-		msg, err := c.readMsg()
-		if err != nil {
-			log.Printf("Failed to read message for %s.\n", c.ToString())
-			// if err == io.EOF {
-				c.Disconnect()
-				break
-			// } else {
-		}
+func (c *Client) isAuthComplete() bool {
+	select {
+	case <-c.authComplete:
+		return true
+	default:
+		return false
+	}
+}
 
-		log.Printf("Read message of type %s from %s.\n",
-			msg.TypeToString(), c.ToString())
+// Only MsgClientID (or MsgClientToken if c.auth is set), MsgClientName,
+// MsgClientRegion & MsgCapabilities are accepted until auth completes; a
+// MsgClientRegion must precede whichever completes auth. A MsgClientName
+// is only needed if the token carries no name
+func (c *Client) handleAuthMsg(msg *Message) (err error) {
+	switch msg.Type {
+	case MTypeClientToken:
+		if err = c.verifyToken(msg.Data.(*MsgClientToken).Token); err != nil {
+			return err
+		}
+	case MTypeClientID:
+		if c.auth != nil {
+			return errors.New("Server requires a ClientToken, not a ClientID")
+		}
+		id := msg.Data.(*MsgClientID).ID
+		if id == INVALID_CLIENT_USERID {
+			return errors.New("Client sent an invalid ID")
+		}
+		c.ID = id
+	case MTypeClientName:
+		name := msg.Data.(*MsgClientName).Name
+		if err = validateClientName(name); err != nil {
+			return err
+		}
+		if c.UserID == "" || c.Name == "" { // a token's name takes priority
+			c.SetName(name)
+		}
+	case MTypeClientRegion:
+		c.requestedServerID = msg.Data.(*MsgClientRegion).ServerID
+	case MTypeCapabilities:
+		return c.negotiateCaps(msg.Data.(*MsgCapabilities).Caps)
+	case MTypeResume:
+		r := msg.Data.(*MsgResume)
+		err = c.resumeSession(r.Token, r.LastSeq)
+		if err == errSessionExpired {
+			// the Client may still auth as usual
+			werr := c.WriteMsg(&Message{MTypeError, MsgError{
+				ECodeResume, err.Error()}})
+			if werr != nil {
+				c.Log().Warn("Unable to send error", "err", werr)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+	default:
+		return errors.New(fmt.Sprintf(
+			"Unexpected message of type %s during auth",
+			msg.TypeToString()))
+	}
 
-		// TODO: c.handleMsg(msg)
-		// ... close(c.authComplete) // indicate auth has completed
-		// c.caChanRWMutex.RLock()
-		// if msg.IsCA() { c.serverCAChan <- msg.ToCA() }
-		// c.caChanRWMutex.RUnlock()
+	if c.ID != INVALID_CLIENT_USERID && c.Name != "" {
+		close(c.authComplete) // indicate auth has completed
 	}
 
-	log.Printf("Exiting readLoop for %s.\n", c.ToString())
+	return
 }
 
-func (c *Client) readMsg() (msg *Message, err error) {
-	var (
-		msgType 	uint8
-		msgLen 		uint32
-	)
+func validateClientName(name string) (err error) {
+	if name == "" || len(name) > MAX_CLIENT_NAME_LEN {
+		return errors.New(fmt.Sprintf(
+			"Client sent an invalid name of length %v", len(name)))
+	}
+	return
+}
 
-	// Read 'headers' of the message
-	err = binary.Read(c.connReader, binary.BigEndian, &msgType)
-	if err != nil {
-		return nil, err
+// Sets c.ID, c.UserID & (if the token has a valid one) c.Name from the
+//    Identity c.auth verifies token for
+func (c *Client) verifyToken(token string) (err error) {
+	if c.auth == nil {
+		return errors.New("Server does not accept ClientTokens")
 	}
-	err = binary.Read(c.connReader, binary.BigEndian, &msgLen)
-	if err != nil {
-		return nil, err
+	if c.UserID != "" {
+		return errors.New("Client already sent a ClientToken")
 	}
 
-	msgData := make([]byte, msgLen)
-	// read from c.conn until msgData is full (read msgLen bytes)
-	_, err = io.ReadFull(c.connReader, msgData)
+	ctx, cancel := context.WithTimeout(context.Background(), AUTH_TIMEOUT)
+	defer cancel()
+
+	id, err := c.auth.Verify(ctx, token)
 	if err != nil {
-		return nil, err
+		return errors.New(fmt.Sprintf("Invalid token: %v", err))
 	}
 
-	msg, err = MsgFromBinary(msgType, msgData)
-	if err != nil {
-		return nil, err
+	if c.ID, err = c.ids.ID(id.UserID); err != nil {
+		return err
 	}
+	c.UserID = id.UserID
+	if validateClientName(id.Name) == nil {
+		c.SetName(id.Name)
+	}
+	c.Log().Info("Verified token", "user_id", c.UserID, "client_id", c.ID)
 
-	return // msg, err
+	return
 }
 
-/*func (c *Client) SendServerCA(caPtr *ClientAction) {
+// Capabilities supported by both this Client & the Server
+func (c *Client) Caps() uint32 {
+	return atomic.LoadUint32(&c.caps)
+}
 
+// Replies w/ the capabilities supported by both sides
+func (c *Client) negotiateCaps(clientCaps uint32) (err error) {
+	caps := clientCaps & SERVER_CAPS
+	atomic.StoreUint32(&c.caps, caps)
+
+	return c.WriteMsg(&Message{MTypeCapabilities, MsgCapabilities{caps}})
 }
 
-func (c *Client) SendCommCA(caPtr *ClientAction) {
+func (c *Client) readLoop() {
+	defer close(c.readLoopDone)
 
-}*/
+	for {
+		msg, err := c.readMsg()
+		if err != nil {
+			c.Log().Info("Unable to read message", "err", err)
+
+			// the stream can't be resynced after a bad frame
+			var pErr ProtocolError
+			if errors.As(err, &pErr) {
+				c.sendErrorAndDisconnect(pErr.ECode(), pErr,
+					DISCONNECT_PROTOCOL_ERROR)
+			} else if errors.Is(err, errIdleTimeout) {
+				c.Disconnect(DISCONNECT_IDLE)
+			} else if errors.Is(err, io.EOF) {
+				c.Disconnect(DISCONNECT_CLOSED)
+			} else {
+				c.Disconnect(DISCONNECT_READ_ERROR)
+			}
+			break
+		}
 
-func (c *Client) WriteMsg(msg *Message) (err error) {
-	dataBin, err := msg.ToBinary()
-	if err !=  nil {
-		return err
+		c.Log().Debug("Read message", "type", msg.TypeToString())
+		metrics.MsgIn(msg.Type)
+
+		if c.handleHeartbeat(msg) { // accepted before & after auth
+			continue
+		}
+
+		if !c.isAuthComplete() {
+			if err = c.handleAuthMsg(msg); err != nil {
+				c.Log().Warn("Auth failed", "err", err)
+				metrics.AuthFailure()
+				c.sendErrorAndDisconnect(ECodeAuth, err,
+					DISCONNECT_AUTH_FAILED)
+				break
+			}
+			continue
+		}
+
+		if link := c.forwardLink(); link != nil {
+			link.forwardMsg(c, msg)
+			continue
+		}
+		c.handleMsg(msg)
 	}
 
-	buf := new(bytes.Buffer)
+	c.Log().Debug("Exiting readLoop")
+}
 
-	// Write message 'headers'
-	err = binary.Write(buf, binary.BigEndian, msg.Type)
-	if err != nil {
-		return err
+// Called once it's known which node handles the Client's Messages; link
+//    is nil if it's this one
+func (c *Client) setRouted(link *forwardLink) {
+	if link != nil {
+		c.forward.Store(link)
 	}
-	err = binary.Write(buf, binary.BigEndian, uint32(len(dataBin)))
-	if err != nil {
-		return err
+	close(c.routed)
+}
+
+// The link to the node handling the Client's Messages, or nil if it's
+//    this one; waits for c.setRouted()
+func (c *Client) forwardLink() *forwardLink {
+	select {
+	case <-c.routed:
+		return c.forward.Load()
+	case <-c.closed:
+		return nil
 	}
+}
 
-	// attempt to write msg.Data's binary encoding
-	_, err = buf.Write(dataBin)
-	if err != nil {
-		return err
+// Reports err to the Client in a MsgError before disconnecting it for
+//    reason (a DISCONNECT_X value)
+func (c *Client) sendErrorAndDisconnect(code uint8, err error,
+	reason string) {
+	werr := c.WriteMsgAndWait(&Message{MTypeError, MsgError{code, err.Error()}})
+	if werr != nil {
+		c.Log().Warn("Unable to send error", "err", werr)
+	}
+	c.Disconnect(reason)
+}
+
+// Converts a post-auth Message into a ClientAction for the Client's
+// current Server or Community
+func (c *Client) handleMsg(msg *Message) {
+	var err error
+
+	switch msg.Type {
+	case MTypeClientText:
+		err = c.sendText(msg.Data.(*MsgClientText).TextBytes, 0, false)
+	case MTypeSendText:
+		st := msg.Data.(*MsgSendText)
+		err = c.sendText(st.TextBytes, st.Nonce, true)
+	case MTypeJoinComm:
+		jc := msg.Data.(*MsgJoinComm)
+		err = c.SendServerCA(&ClientAction{
+			ClientID:	c.ID,
+			Action:		JoinComm{jc.CommID, c},
+		})
+	case MTypeLeaveComm:
+		err = c.SendServerCA(&ClientAction{
+			ClientID:	c.ID,
+			Action:		LeaveComm{c},
+		})
+	case MTypeClientName:
+		name := msg.Data.(*MsgClientName).Name
+		err = c.SendCommCA(&ClientAction{
+			ClientID:	c.ID,
+			Action:		Rename{name, c},
+		})
+	case MTypeDirectText:
+		dt := msg.Data.(*MsgDirectText)
+		err = c.swRoute.Send(&ClientAction{
+			ClientID:	c.ID,
+			Action:		SendDirect{dt.ClientID, dt.TextBytes, c},
+		})
+	case MTypeHistoryRequest:
+		hr := msg.Data.(*MsgHistoryRequest)
+		err = c.SendCommCA(&ClientAction{
+			ClientID:	c.ID,
+			Action:		RequestHistory{hr.BeforeSeq, int(hr.Count), c},
+		})
+	case MTypeCapabilities:
+		err = c.negotiateCaps(msg.Data.(*MsgCapabilities).Caps)
+	default:
+		c.Log().Info("Ignoring message", "type", msg.TypeToString())
 	}
 
-	// attempt to write full message into c.conn
-	_, err = c.conn.Write(buf.Bytes())
 	if err != nil {
-		return err
+		c.Log().Warn("Unable to handle message",
+			"type", msg.TypeToString(), "err", err)
 	}
+}
 
-	return
-}
\ No newline at end of file
+// Sends text to the Client's Community if its rate limits allow; text
+//    from a MsgSendText (wantsAck) is acked once the Community accepts
+//    or rejects it, or here if the limits don't allow it
+func (c *Client) sendText(text []byte, nonce uint64, wantsAck bool) error {
+	if code := c.allowText(); code != 0 {
+		if wantsAck && !c.IsDisconnected() {
+			c.nackText(nonce, code)
+		}
+		return nil
+	}
+
+	return c.SendCommCA(&ClientAction{
+		ClientID:	c.ID,
+		Action:		SendText{text, nonce, wantsAck, c},
+	})
+}
+
+// The Server route is read under c.caChanRWMutex but sent on outside of
+// it, as the Server takes c.caChanRWMutex to move this Client
+// BLOCKING: c.caChanRWMutex (read)
+func (c *Client) SendServerCA(caPtr *ClientAction) (err error) {
+	for {
+		c.caChanRWMutex.RLock()
+		route, caChansSet := c.serverRoute, c.caChansSet
+		c.caChanRWMutex.RUnlock()
+
+		if route.IsSet() {
+			return route.Send(caPtr)
+		}
+		if err = c.waitCAChans(caChansSet); err != nil {
+			return err
+		}
+	}
+}
+
+// The Community route is sent on while holding c.caChanRWMutex, so
+// RemoveCAChans() can't complete mid-send (Communities never take it)
+// BLOCKING: c.caChanRWMutex (read)
+func (c *Client) SendCommCA(caPtr *ClientAction) (err error) {
+	for {
+		c.caChanRWMutex.RLock()
+		route, caChansSet := c.commRoute, c.caChansSet
+		if route.IsSet() {
+			err = route.Send(caPtr)
+			c.caChanRWMutex.RUnlock()
+			return err
+		}
+		c.caChanRWMutex.RUnlock()
+
+		if err = c.waitCAChans(caChansSet); err != nil {
+			return err
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"time"
 )
 
 // Client action (eg: server-join, community-leave, etc.) wrapper
@@ -10,6 +12,27 @@ type ClientAction struct {
 	Action     	interface{}
 }
 
+// A Server or Community's ClientAction chan, along w/ its done chan
+type caRoute struct {
+	caChan		chan *ClientAction
+	done		chan bool // closed once caChan is no longer received on
+}
+
+func (r caRoute) IsSet() bool {
+	return r.caChan != nil
+}
+
+// Never blocks past the receiver shutting down
+func (r caRoute) Send(caPtr *ClientAction) (err error) {
+	select {
+	case r.caChan <- caPtr:
+		return nil
+	case <-r.done:
+		return errors.New("ClientAction receiver was shut down")
+	}
+}
+
+// ServerID is the Client's ServerID, set before the JoinServer is sent
 type JoinServer struct {
 	ServerID	string
 	ClientPtr	*Client
@@ -20,35 +43,419 @@ type JoinComm struct {
 	ClientPtr	*Client
 }
 
+type LeaveComm struct {
+	ClientPtr	*Client
+}
+
+// Sent by a Client once it has disconnected
+type LeaveServer struct {
+	ClientPtr	*Client
+}
+
+// Sent by a Server to add the Client to a Community (see Community.Join());
+// Result receives the outcome
+type ClientJoined struct {
+	ClientPtr	*Client
+	Result		chan error // buffered
+}
+
+// Sent by a Server to remove the Client from a Community (see
+// Community.Leave()); Result receives the outcome
+type ClientLeft struct {
+	ClientPtr	*Client
+	Result		chan error // buffered
+}
+
+// Sent by a Client to change its name
+type Rename struct {
+	Name		string
+	ClientPtr	*Client
+}
+
+// Sent by a Client to its Community; Nonce is acked if WantsAck (the
+// text came in a MsgSendText)
+type SendText struct {
+	TextBytes	[]byte
+	Nonce		uint64
+	WantsAck	bool
+	ClientPtr	*Client
+}
+
+// Sent by a Client straight to the ServerWrapper, as the recipient may
+// be in any Server
+type SendDirect struct {
+	TargetID	uint32
+	TextBytes	[]byte
+	ClientPtr	*Client
+}
+
+// Sent by a Client to page back through its Community's history
+type RequestHistory struct {
+	BeforeSeq	uint64
+	Count		int
+	ClientPtr	*Client
+}
+
 // requires caPtr.Action points to a JoinServer
 func (sw *ServerWrapper) CAJoinServer(caPtr *ClientAction) {
 	js := caPtr.Action.(JoinServer)
 	sID := js.ServerID
-	log.Printf("(sw) Moving Client %v (%v) to Server %v\n",
-		js.ClientPtr.Name, js.ClientPtr.ID, sID)
+	js.ClientPtr.Log().Info("Moving Client to Server", "to_server_id", sID)
 
 	toServer, ok := sw.Servers[sID]
 	if !ok {
-		toServer = NewServer(sID)
+		toServer = NewServer(sID, sw.history, sw.rateLimits,
+			sw.moderation)
+		sw.serversRWMutex.Lock()
 		sw.Servers[sID] = toServer
+		sw.serversRWMutex.Unlock()
 	}
 
+	// only a Server's own loop moves its Clients between Communities, so
+	//    the Server the Client is leaving removes it
 	cPtr := js.ClientPtr
-	cServerID := cPtr.ServerID
-	if fromServer, ok := sw.Servers[cServerID]; ok {
-		fromServer.RemoveClient(cPtr) // ignore errors
+	fromServerID, _ := cPtr.Placement()
+	if fromServer, ok := sw.Servers[fromServerID];
+		ok && fromServerID != sID {
+		fromServer.route().Send(&ClientAction{ // ignore errors
+			ClientID:	cPtr.ID,
+			Action:		LeaveServer{cPtr},
+		})
+	}
+
+	// a Server shut down since the lookup above would never receive it
+	if err := toServer.route().Send(caPtr); err != nil {
+		cPtr.Log().Warn("Unable to move Client to Server",
+			"to_server_id", sID, "err", err)
+		// rather than leave it connected in no Server; the write may
+		//    block this loop
+		go cPtr.sendErrorAndDisconnect(ECodeJoinComm, err,
+			DISCONNECT_JOIN_FAILED)
+	}
+}
+
+// Relays the text to the target & acks the sender w/ whether it was
+//    delivered; a target not in this node's directory may be in another's
+// requires caPtr.Action points to a SendDirect
+func (sw *ServerWrapper) CASendDirect(caPtr *ClientAction) {
+	sd := caPtr.Action.(SendDirect)
+	sender := sd.ClientPtr
+
+	status := sw.deliverDirect(sender.ID, sd.TargetID, sd.TextBytes)
+	if status == DirectOffline &&
+		sw.cluster.relayDirect(sender, sd.TargetID, sd.TextBytes) {
+		return // acked once the other nodes answer
+	}
+	sender.ackDirect(sd.TargetID, status)
+}
+
+// Writes the text to the Client in this node's directory w/ ID targetID;
+//    returns a DirectX status
+func (sw *ServerWrapper) deliverDirect(senderID uint32, targetID uint32,
+	text []byte) (status uint8) {
+	target, ok := sw.lookupDirectory(targetID)
+	if !ok || target.IsDisconnected() {
+		return DirectOffline
 	}
 
-	toServer.caChan <- caPtr
+	err := target.WriteMsg(&Message{MTypeDirectText, MsgDirectText{
+		ClientID:	senderID,
+		TextBytes:	text,
+	}})
+	if err != nil {
+		target.Log().Warn("Unable to send direct text",
+			"from_client_id", senderID, "err", err)
+		return DirectOffline
+	}
+	return DirectDelivered
+}
+
+// Tells the Client whether its direct text to targetID was delivered
+func (c *Client) ackDirect(targetID uint32, status uint8) {
+	err := c.WriteMsg(&Message{MTypeDirectAck, MsgDirectAck{
+		ClientID:	targetID,
+		Status:		status,
+	}})
+	if err != nil {
+		c.Log().Warn("Unable to ack direct text", "err", err)
+	}
 }
 
+// Places the Client in the root Community, or the one its resumed
+//    session was in
 // requires caPtr.Action points to a JoinServer
 func (s *Server) CAJoinServer(caPtr *ClientAction) {
 	js := caPtr.Action.(JoinServer)
 	cPtr := js.ClientPtr
 
+	if r := cPtr.resumed; r != nil && r.commID != "" &&
+		r.commID != ROOT_COMM_ID {
+		cPtr.CommID = r.commID
+		err := s.AddClient(cPtr)
+		if err == nil {
+			return
+		}
+		s.logger.Info("Unable to return resumed Client to its Comm",
+			"client_id", cPtr.ID, "comm_id", r.commID, "err", err)
+	}
 	if err := s.AddClientToRootComm(cPtr); err != nil {
-		log.Printf("Unable to add %s to Server %s:\n%v\n",
-			cPtr.ToString(), s.ID, err)
+		s.logger.Warn("Unable to add Client", "client_id", cPtr.ID,
+			"err", err)
+		// rather than leave it connected in no Community; the write may
+		//    block this loop
+		go cPtr.sendErrorAndDisconnect(ECodeJoinComm, err,
+			DISCONNECT_JOIN_FAILED)
+	}
+}
+
+// requires caPtr.Action points to a LeaveServer
+func (s *Server) CALeaveServer(caPtr *ClientAction) {
+	ls := caPtr.Action.(LeaveServer)
+	cPtr := ls.ClientPtr
+
+	// may already have been removed by s.AddClient()
+	if err := s.RemoveClient(cPtr); err != nil {
+		s.logger.Debug("Unable to remove Client", "client_id", cPtr.ID,
+			"err", err)
+		return
+	}
+	s.logger.Info("Removed Client", "client_id", cPtr.ID)
+}
+
+// requires caPtr.Action points to a JoinComm
+func (s *Server) CAJoinComm(caPtr *ClientAction) {
+	jc := caPtr.Action.(JoinComm)
+	s.moveClientAndReply(jc.ClientPtr, jc.CommID)
+}
+
+// requires caPtr.Action points to a LeaveComm
+func (s *Server) CALeaveComm(caPtr *ClientAction) {
+	lc := caPtr.Action.(LeaveComm)
+	s.moveClientAndReply(lc.ClientPtr, ROOT_COMM_ID)
+}
+
+// Replies w/ a MsgCommJoined on success, otherwise a MsgError
+func (s *Server) moveClientAndReply(cPtr *Client, commID string) {
+	var reply *Message
+	if err := s.MoveClient(cPtr, commID); err != nil {
+		s.logger.Info("Unable to move Client", "client_id", cPtr.ID,
+			"to_comm_id", commID, "err", err)
+		reply = &Message{MTypeError, MsgError{
+			Code:	ECodeJoinComm,
+			Text:	fmt.Sprintf("Unable to join %s", commID),
+		}}
+	} else {
+		reply = &Message{MTypeCommJoined, MsgCommJoined{commID}}
+	}
+
+	if err := cPtr.WriteMsg(reply); err != nil {
+		s.logger.Warn("Unable to reply", "client_id", cPtr.ID, "err", err)
+	}
+}
+
+// Stamps the text w/ a message ID & relays it to the other members if
+//    comm.Moderation allows it, redacted as needed; rejections are
+//    reported to the sender
+// requires caPtr.Action points to a SendText
+func (comm *Community) CASendText(caPtr *ClientAction) {
+	st := caPtr.Action.(SendText)
+
+	comm.clientsRWMutex.RLock()
+	defer comm.clientsRWMutex.RUnlock()
+
+	if _, ok := comm.Clients[caPtr.ClientID]; !ok {
+		comm.logger.Debug("Dropping text from non-member",
+			"client_id", caPtr.ClientID)
+		if st.WantsAck {
+			st.ClientPtr.nackText(st.Nonce, ECodeJoinComm)
+		}
+		return
 	}
-}
\ No newline at end of file
+
+	verdict, text, reason, rule := comm.Moderation.Moderate(st.TextBytes)
+	if verdict != MOD_ALLOW {
+		metrics.Moderated(rule, verdict)
+	}
+	if verdict == MOD_REJECT {
+		comm.logger.Info("Rejected text", "client_id", caPtr.ClientID,
+			"rule", rule, "reason", reason)
+		werr := st.ClientPtr.WriteMsg(&Message{MTypeError, MsgError{
+			Code:	ECodeModeration,
+			Text:	reason,
+		}})
+		if werr != nil {
+			comm.logger.Warn("Unable to reply", "client_id", caPtr.ClientID,
+				"err", werr)
+		}
+		if st.WantsAck {
+			st.ClientPtr.nackText(st.Nonce, ECodeModeration)
+		}
+		return
+	} else if verdict == MOD_REDACT {
+		comm.logger.Debug("Redacted text", "client_id", caPtr.ClientID,
+			"rule", rule)
+	}
+
+	now := time.Now()
+	entry := &HistoryEntry{
+		MsgID:		msgIDs.Next(now),
+		ClientID:	caPtr.ClientID,
+		Time:		now,
+		TextBytes:	text,
+	}
+	// relayed regardless, history is best-effort
+	if err := comm.history.Store.Append(comm.logID, entry); err != nil {
+		comm.logger.Error("Unable to record text in history", "err", err)
+		entry.Seq = 0
+	}
+
+	if st.WantsAck {
+		err := st.ClientPtr.WriteMsg(&Message{MTypeSendAck, MsgSendAck{
+			Nonce:	st.Nonce,
+			MsgID:	entry.MsgID,
+			Seq:	entry.Seq,
+			Time:	entry.Time,
+		}})
+		if err != nil {
+			comm.logger.Warn("Unable to ack text", "client_id", caPtr.ClientID,
+				"err", err)
+		}
+	}
+
+	legacy := &Message{MTypeClientText, MsgClientText{
+		ClientID:	entry.ClientID,
+		TextBytes:	entry.TextBytes,
+	}}
+	stamped := &Message{MTypeCommText, MsgCommText{
+		ClientID:	entry.ClientID,
+		MsgID:		entry.MsgID,
+		Seq:		entry.Seq,
+		Time:		entry.Time,
+		TextBytes:	entry.TextBytes,
+	}}
+	// don't echo back to the sender
+	comm.broadcastFunc(func(c *Client) *Message {
+		if c.Caps() & CapMessageIDs != 0 {
+			return stamped
+		}
+		return legacy
+	}, caPtr.ClientID)
+}
+
+// Catches the Client up on history & the roster, then announces it
+// requires caPtr.Action points to a ClientJoined
+func (comm *Community) CAClientJoined(caPtr *ClientAction) {
+	cj := caPtr.Action.(ClientJoined)
+	cPtr := cj.ClientPtr
+
+	if err := comm.AddClient(cPtr); err != nil {
+		cj.Result <- err
+		return
+	}
+	cj.Result <- nil // the Server may go on to set cPtr's routes
+
+	if cPtr.Caps() & CapHistory != 0 {
+		if lastSeq, ok := cPtr.missedAfter(comm.ID); ok {
+			comm.replayMissed(cPtr, lastSeq)
+		} else {
+			comm.replayHistory(cPtr)
+		}
+	}
+	if err := comm.writeRoster(cPtr, comm.Roster()); err != nil {
+		comm.logger.Warn("Unable to send roster", "client_id", cPtr.ID,
+			"err", err)
+	}
+
+	comm.clientsRWMutex.RLock()
+	defer comm.clientsRWMutex.RUnlock()
+
+	comm.broadcast(&Message{MTypeUserJoined, MsgUserJoined{
+		ClientID:	cPtr.ID,
+		Name:		cPtr.DisplayName(),
+	}}, cPtr.ID)
+}
+
+// requires caPtr.Action points to a ClientLeft
+func (comm *Community) CAClientLeft(caPtr *ClientAction) {
+	cl := caPtr.Action.(ClientLeft)
+	cPtr := cl.ClientPtr
+
+	if err := comm.RemoveClient(cPtr); err != nil {
+		cl.Result <- err
+		return
+	}
+	cl.Result <- nil
+
+	comm.clientsRWMutex.RLock()
+	defer comm.clientsRWMutex.RUnlock()
+
+	comm.broadcast(&Message{MTypeUserLeft, MsgUserLeft{
+		ClientID:	cPtr.ID,
+		Name:		cPtr.DisplayName(),
+	}}, INVALID_CLIENT_USERID)
+}
+
+// Announces the new name to every member, including the renamed Client
+// requires caPtr.Action points to a Rename
+func (comm *Community) CARename(caPtr *ClientAction) {
+	rn := caPtr.Action.(Rename)
+	cPtr := rn.ClientPtr
+
+	if !comm.HasClient(cPtr) {
+		comm.logger.Debug("Dropping rename from non-member",
+			"client_id", cPtr.ID)
+		return
+	}
+
+	if err := validateClientName(rn.Name); err != nil {
+		werr := cPtr.WriteMsg(&Message{MTypeError, MsgError{
+			Code:	ECodeRename,
+			Text:	err.Error(),
+		}})
+		if werr != nil {
+			comm.logger.Warn("Unable to reply", "client_id", cPtr.ID,
+				"err", werr)
+		}
+		return
+	}
+
+	comm.logger.Info("Renaming Client", "client_id", cPtr.ID,
+		"from", cPtr.DisplayName(), "to", rn.Name)
+	cPtr.SetName(rn.Name)
+
+	comm.clientsRWMutex.RLock()
+	defer comm.clientsRWMutex.RUnlock()
+
+	comm.broadcast(&Message{MTypeUserRenamed, MsgUserRenamed{
+		ClientID:	cPtr.ID,
+		Name:		rn.Name,
+	}}, INVALID_CLIENT_USERID)
+}
+
+// requires caPtr.Action points to a RequestHistory
+func (comm *Community) CARequestHistory(caPtr *ClientAction) {
+	rh := caPtr.Action.(RequestHistory)
+	cPtr := rh.ClientPtr
+
+	if !comm.HasClient(cPtr) {
+		comm.logger.Debug("Dropping history request from non-member",
+			"client_id", cPtr.ID)
+		return
+	}
+
+	count := rh.Count
+	if count > MAX_HISTORY_PAGE_LEN {
+		count = MAX_HISTORY_PAGE_LEN
+	}
+	entries, err := comm.history.Store.Before(
+		comm.logID, rh.BeforeSeq, count)
+	if err != nil {
+		comm.logger.Error("Unable to read history", "err", err)
+		entries = nil // reply w/ an empty page
+	}
+
+	if err = comm.writeHistory(cPtr, entries); err != nil {
+		comm.logger.Warn("Unable to send history", "client_id", cPtr.ID,
+			"err", err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A Community route that stops being received on once fence is closed,
+//    like a Community that has removed the Client & shut down
+type testCommRoute struct {
+	route		caRoute
+	fence		chan bool // closed once RemoveCAChans() has returned
+	received	int64
+}
+
+func newTestCommRoute() *testCommRoute {
+	return &testCommRoute{
+		route:	caRoute{make(chan *ClientAction), make(chan bool)},
+		fence:	make(chan bool),
+	}
+}
+
+func (r *testCommRoute) receive(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-r.fence:
+			return
+		case <-r.route.caChan:
+			atomic.AddInt64(&r.received, 1)
+		}
+	}
+}
+
+// Moves a Client between Community routes while senders send on it the
+//    way c.readLoop() does; run w/ -race. After RemoveCAChans() returns,
+//    a send on the removed route has no receiver & fails once its done
+//    chan closes, so every send must reach a current route
+func TestClientCommRouteMoves(t *testing.T) {
+	const (
+		moves = 200
+		senders = 8
+	)
+
+	c := &Client{
+		closed:		make(chan bool),
+		caChansSet:	make(chan bool),
+	}
+	serverRoute := caRoute{make(chan *ClientAction), make(chan bool)}
+
+	var routes []*testCommRoute
+	var recvWG sync.WaitGroup
+	move := func() {
+		r := newTestCommRoute()
+		routes = append(routes, r)
+		recvWG.Add(1)
+		go r.receive(&recvWG)
+		c.SetCAChans(serverRoute, r.route)
+	}
+	remove := func(r *testCommRoute) {
+		c.RemoveCAChans()
+		close(r.fence)
+		close(r.route.done)
+	}
+
+	var sent int64
+	var sendWG sync.WaitGroup
+	stop := make(chan bool)
+	for i := 0; i < senders; i++ {
+		sendWG.Add(1)
+		go func() {
+			defer sendWG.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := c.SendCommCA(&ClientAction{Action: SendText{}})
+				if err != nil {
+					t.Errorf("SendCommCA() = %v", err)
+					return
+				}
+				atomic.AddInt64(&sent, 1)
+			}
+		}()
+	}
+
+	move()
+	for i := 0; i < moves; i++ {
+		time.Sleep(10 * time.Microsecond) // let the senders send
+		remove(routes[len(routes) - 1])
+		move()
+	}
+	close(stop)
+	sendWG.Wait()
+	remove(routes[len(routes) - 1])
+	recvWG.Wait()
+
+	var received int64
+	for _, r := range routes {
+		received += atomic.LoadInt64(&r.received)
+	}
+	if sent == 0 || received != sent {
+		t.Errorf("Sent %v & received %v ClientActions", sent, received)
+	}
+}
+
+// A Client moved to a Server that has shut down is told why & disconnected,
+//    rather than blocking sw.controlLoop() on a send nothing receives
+func TestJoinServerShutDown(t *testing.T) {
+	c, peer := newTestQueueClient(t, 4, SLOW_CONSUMER_DISCONNECT)
+	before := disconnectCount(DISCONNECT_JOIN_FAILED)
+
+	shutDown := &Server{
+		ID:		"gone",
+		caChan:	make(chan *ClientAction),
+		done:	make(chan bool),
+	}
+	close(shutDown.done)
+	sw := &ServerWrapper{Servers: map[string]*Server{"gone": shutDown}}
+
+	moved := make(chan bool)
+	go func() {
+		sw.CAJoinServer(&ClientAction{
+			ClientID:	c.ID,
+			Action:		JoinServer{"gone", c},
+		})
+		close(moved)
+	}()
+	select {
+	case <-moved:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("CAJoinServer() blocked on a shut down Server")
+	}
+
+	if e := peer.expect(MTypeError).Data.(*MsgError); e.Code != ECodeJoinComm {
+		t.Errorf("Client got %+v, want ECodeJoinComm", e)
+	}
+	peer.expectClosed()
+	if n := disconnectCount(DISCONNECT_JOIN_FAILED); n != before + 1 {
+		t.Errorf("%v join_failed disconnects, want %v", n, before + 1)
+	}
+}
@@ -0,0 +1,838 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CLUSTER_BUS values
+const (
+	CLUSTER_BUS_TCP = "tcp"
+	CLUSTER_BUS_INPROC = "inproc" // every node in 1 process, for testing
+)
+
+const (
+	// this node's ID when CLUSTER_CONFIG is unset
+	DEFAULT_NODE_ID = "local"
+	// Messages from a forwarded Client waiting for its owner to read them
+	FORWARD_INBOX_LEN = 256
+	// longest a direct text relayed to the other nodes waits for them to
+	//    answer before it's acked as offline
+	DIRECT_RELAY_TIMEOUT = BUS_DIAL_TIMEOUT + BUS_SEND_TIMEOUT
+)
+
+// metrics.Handoff() actions
+const (
+	HANDOFF_REDIRECTED = "redirected"
+	HANDOFF_FORWARDED = "forwarded"
+)
+
+// A node of the cluster, as listed in CLUSTER_CONFIG
+type ClusterNode struct {
+	ID			string	`json:"id"`
+	// where its Clients connect, "host:port"; sent in MsgRedirect
+	ClientAddr	string	`json:"client_addr"`
+	// where its TCPBus listens, "host:port"; unused by InProcBus
+	BusAddr		string	`json:"bus_addr,omitempty"`
+}
+
+// Cluster tracks which node owns each region Server & the Clients
+//    forwarded between this node & the others over its Bus. Only a
+//    region's owner runs its Server, so a Client that connects to
+//    another node is redirected or forwarded to the owner
+type Cluster struct {
+	NodeID		string
+	Nodes		[]ClusterNode // in CLUSTER_CONFIG order
+
+	owners		map[string]string // node ID by ServerID
+	bus			Bus // nil for a single node
+
+	lastConnID	uint64 // sync/atomic
+	mutex		sync.Mutex
+	// Clients this node accepted & forwarded, by conn ID; guarded by mutex
+	forwarded	map[uint64]*Client
+	// conns of the Clients other nodes forwarded here; guarded by mutex
+	attached	map[attachKey]*busConn
+
+	lastDirectID	uint64 // sync/atomic
+	// direct texts relayed to the other nodes, by request ID; guarded by
+	//    mutex
+	directs		map[uint64]*relayedDirect
+}
+
+type attachKey struct {
+	nodeID		string // the node that accepted the Client
+	connID		uint64
+}
+
+// Identifies a forwarded Client to its owner, which trusts the accepting
+//    node to have authenticated it
+type forwardAttach struct {
+	ID			uint32	`json:"id"`
+	UserID		string	`json:"user_id,omitempty"`
+	Name		string	`json:"name"`
+	Caps		uint32	`json:"caps"`
+	ServerID	string	`json:"server_id"`
+	RemoteAddr	string	`json:"remote_addr"`
+	TrustedPeer	string	`json:"trusted_peer,omitempty"`
+}
+
+// A direct text relayed to the other nodes, as the sending node's
+//    directory had no target for it; sent as binary, since a text near
+//    MAX_FRAME_LEN wouldn't fit a bus payload once base64'd into JSON
+type forwardDirect struct {
+	SenderID	uint32
+	TargetID	uint32
+	TextBytes	[]byte
+}
+
+// bit pattern: 32, 32, len(data.TextBytes)
+//    - 32: SenderID (uint32)
+//    - 32: TargetID (uint32)
+//    - len(data.TextBytes): TextBytes
+func (data forwardDirect) MarshalBinary() (bin []byte, err error) {
+	bin = binary.BigEndian.AppendUint32(nil, data.SenderID)
+	bin = binary.BigEndian.AppendUint32(bin, data.TargetID)
+	return append(bin, data.TextBytes...), nil
+}
+
+func (data *forwardDirect) UnmarshalBinary(bin []byte) (err error) {
+	data.TextBytes, err = readPrefix(bin, &data.SenderID, &data.TargetID)
+	return
+}
+
+// A forwardDirect waiting for the other nodes to answer; acked as
+//    delivered by the 1st node that delivers it, or as offline once
+//    none can
+type relayedDirect struct {
+	sender		*Client
+	targetID	uint32
+	waiting		map[string]bool // IDs of nodes yet to answer
+	timer		*time.Timer // acks as offline after DIRECT_RELAY_TIMEOUT
+}
+
+// How a forwarded Client's Messages reach its owner
+type forwardLink struct {
+	cluster		*Cluster
+	nodeID		string // the owner
+	connID		uint64
+}
+
+// A cluster of just this node, which owns every region
+func NewCluster(nodeID string) (cl *Cluster) {
+	cl = new(Cluster)
+	cl.NodeID = nodeID
+	cl.owners = make(map[string]string)
+	cl.forwarded = make(map[uint64]*Client)
+	cl.attached = make(map[attachKey]*busConn)
+	cl.directs = make(map[uint64]*relayedDirect)
+	return
+}
+
+// Loads the cluster's nodes & region owners from path, as seen by node
+//    nodeID; each non-empty line not starting w/ '#' is one of
+//    node <NodeID> <client host:port> [<bus host:port>]
+//    region <ServerID> <NodeID>
+//    Regions w/o a region line are owned by the 1st node, i.e:
+//    node      east        10.0.0.1:3333    10.0.0.1:7777
+//    region    waterloo    east
+func LoadCluster(path string, nodeID string) (cl *Cluster, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cl = NewCluster(nodeID)
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err = cl.parseLine(strings.Fields(line)); err != nil {
+			return nil, errors.New(fmt.Sprintf(
+				"%s:%v: %v", path, lineNum, err))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(cl.Nodes) == 0 {
+		return nil, errors.New(fmt.Sprintf("%s: no nodes", path))
+	}
+	if _, ok := cl.Node(nodeID); !ok {
+		return nil, errors.New(fmt.Sprintf(
+			"%s: no node %q (NODE_ID)", path, nodeID))
+	}
+	for serverID, owner := range cl.owners {
+		if _, ok := cl.Node(owner); !ok {
+			return nil, errors.New(fmt.Sprintf(
+				"%s: region %s owned by unknown node %q",
+				path, serverID, owner))
+		}
+	}
+
+	return // cl, nil
+}
+
+func (cl *Cluster) parseLine(fields []string) (err error) {
+	switch fields[0] {
+	case "node":
+		if len(fields) != 3 && len(fields) != 4 {
+			return errors.New(
+				"expected \"node <NodeID> <client addr> [<bus addr>]\"")
+		}
+		node := ClusterNode{ID: fields[1], ClientAddr: fields[2]}
+		if len(fields) == 4 {
+			node.BusAddr = fields[3]
+		}
+		if len(node.ID) > MAX_NODE_ID_LEN {
+			return errors.New(fmt.Sprintf("Node ID %q is too long", node.ID))
+		}
+		if _, ok := cl.Node(node.ID); ok {
+			return errors.New(fmt.Sprintf("Duplicate node %q", node.ID))
+		}
+		if len(cl.Nodes) == MAX_CLUSTER_NODES {
+			return errors.New(fmt.Sprintf(
+				"More than %v nodes", MAX_CLUSTER_NODES))
+		}
+		cl.Nodes = append(cl.Nodes, node)
+	case "region":
+		if len(fields) != 3 {
+			return errors.New("expected \"region <ServerID> <NodeID>\"")
+		}
+		if _, ok := cl.owners[fields[1]]; ok {
+			return errors.New(fmt.Sprintf(
+				"Duplicate region %q", fields[1]))
+		}
+		cl.owners[fields[1]] = fields[2]
+	default:
+		return errors.New(fmt.Sprintf("Unknown entry %q", fields[0]))
+	}
+	return
+}
+
+func (cl *Cluster) Node(nodeID string) (node ClusterNode, ok bool) {
+	for _, node = range cl.Nodes {
+		if node.ID == nodeID {
+			return node, true
+		}
+	}
+	return ClusterNode{}, false
+}
+
+// This node's index in CLUSTER_CONFIG; 0 for a single node
+func (cl *Cluster) NodeIndex() int {
+	for i, node := range cl.Nodes {
+		if node.ID == cl.NodeID {
+			return i
+		}
+	}
+	return 0
+}
+
+// The node owning region serverID; local is true if it's this one
+func (cl *Cluster) Owner(serverID string) (node ClusterNode, local bool) {
+	if cl.bus == nil {
+		return ClusterNode{ID: cl.NodeID}, true
+	}
+
+	nodeID, ok := cl.owners[serverID]
+	if !ok {
+		nodeID = cl.Nodes[0].ID
+	}
+	node, _ = cl.Node(nodeID)
+	return node, nodeID == cl.NodeID
+}
+
+// Every region listed in CLUSTER_CONFIG, by owner node ID
+func (cl *Cluster) Regions() map[string][]string {
+	regions := make(map[string][]string)
+	for serverID, nodeID := range cl.owners {
+		regions[nodeID] = append(regions[nodeID], serverID)
+	}
+	for _, serverIDs := range regions {
+		sort.Strings(serverIDs)
+	}
+	return regions
+}
+
+// Bus addresses by node ID, for NewTCPBus()
+func (cl *Cluster) busAddrs() map[string]string {
+	addrs := make(map[string]string)
+	for _, node := range cl.Nodes {
+		addrs[node.ID] = node.BusAddr
+	}
+	return addrs
+}
+
+// Numbers of Clients this node forwarded to others & that others
+//    forwarded to it
+// BLOCKING: cl.mutex
+func (cl *Cluster) ForwardedCounts() (out int, in int) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	return len(cl.forwarded), len(cl.attached)
+}
+
+// The Clients this node accepted & forwarded to others
+// BLOCKING: cl.mutex
+func (cl *Cluster) forwardedClients() (clients []*Client) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	for _, cPtr := range cl.forwarded {
+		clients = append(clients, cPtr)
+	}
+	return
+}
+
+func (cl *Cluster) Close() (err error) {
+	if cl.bus == nil {
+		return
+	}
+	return cl.bus.Close()
+}
+
+// Hands c off to the node owning its region: a Client w/ CapRedirect is
+//    told to reconnect there, others are forwarded to it over the Bus
+func (sw *ServerWrapper) handOff(c *Client, owner ClusterNode) {
+	if c.Caps() & CapRedirect != 0 && owner.ClientAddr != "" {
+		c.Log().Info("Redirecting Client", "node_id", owner.ID,
+			"addr", owner.ClientAddr)
+		metrics.Handoff(HANDOFF_REDIRECTED)
+		err := c.WriteMsgAndWait(&Message{MTypeRedirect, MsgRedirect{
+			ServerID:	c.ServerID,
+			Addr:		owner.ClientAddr,
+		}})
+		if err != nil {
+			c.Log().Warn("Unable to send redirect", "err", err)
+		}
+		c.Disconnect(DISCONNECT_REDIRECTED)
+		return
+	}
+
+	if err := sw.cluster.forward(c, owner.ID); err != nil {
+		c.Log().Warn("Unable to forward Client", "node_id", owner.ID,
+			"err", err)
+		c.Disconnect(DISCONNECT_NODE_DOWN)
+		return
+	}
+	metrics.Handoff(HANDOFF_FORWARDED)
+
+	go func() {
+		<-c.Closed()
+		sw.cluster.detach(c)
+	}()
+}
+
+// Attaches c to node nodeID, then starts passing it c's Messages
+// BLOCKING: cl.mutex
+func (cl *Cluster) forward(c *Client, nodeID string) (err error) {
+	payload, err := json.Marshal(forwardAttach{
+		ID:				c.ID,
+		UserID:			c.UserID,
+		Name:			c.DisplayName(),
+		Caps:			c.Caps(),
+		ServerID:		c.ServerID,
+		RemoteAddr:		c.conn.RemoteAddr().String(),
+		TrustedPeer:	c.TrustedPeer,
+	})
+	if err != nil {
+		return err
+	}
+
+	link := &forwardLink{cl, nodeID, atomic.AddUint64(&cl.lastConnID, 1)}
+	// the owner may write to c before the Send below returns
+	c.forward.Store(link)
+	cl.mutex.Lock()
+	cl.forwarded[link.connID] = c
+	cl.mutex.Unlock()
+
+	err = cl.bus.Send(nodeID, &BusEnvelope{
+		Kind:		BUS_ATTACH,
+		ConnID:		link.connID,
+		Payload:	payload,
+	})
+	if err != nil {
+		cl.takeForwarded(nodeID, link.connID)
+		return err
+	}
+
+	c.setLogContext("server_id", c.ServerID, "owner_node_id", nodeID)
+	c.Log().Info("Forwarding Client", "conn_id", link.connID)
+	c.setRouted(link)
+	return
+}
+
+// Tells the owner c's connection closed; a no-op if the owner closed it
+// BLOCKING: cl.mutex
+func (cl *Cluster) detach(c *Client) {
+	link := c.forward.Load()
+	if _, ok := cl.takeForwarded(link.nodeID, link.connID); !ok {
+		return
+	}
+
+	err := cl.bus.Send(link.nodeID, &BusEnvelope{
+		Kind:	BUS_DETACH,
+		ConnID:	link.connID,
+	})
+	if err != nil {
+		c.Log().Debug("Unable to detach from owner", "err", err)
+	}
+}
+
+// Removes the forwarded Client w/ connID from cl.forwarded, if forwarded
+//    to node nodeID
+// BLOCKING: cl.mutex
+func (cl *Cluster) takeForwarded(nodeID string, connID uint64) (
+	c *Client, ok bool) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	c, ok = cl.forwarded[connID]
+	if !ok || c.forward.Load().nodeID != nodeID {
+		return nil, false
+	}
+	delete(cl.forwarded, connID)
+	return c, true
+}
+
+// BLOCKING: cl.mutex
+func (cl *Cluster) forwardedClient(nodeID string, connID uint64) (
+	c *Client, ok bool) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	c, ok = cl.forwarded[connID]
+	if !ok || c.forward.Load().nodeID != nodeID {
+		return nil, false
+	}
+	return c, true
+}
+
+// Passes a Message the Client sent on to its owner; the Client is
+//    disconnected if the owner can't be reached
+func (f *forwardLink) forwardMsg(c *Client, msg *Message) {
+	// mirrors the owner's negotiateCaps(), for c.heartbeatLoop()
+	if msg.Type == MTypeCapabilities {
+		caps := msg.Data.(*MsgCapabilities).Caps & SERVER_CAPS
+		atomic.StoreUint32(&c.caps, caps)
+	}
+
+	err := f.cluster.bus.Send(f.nodeID, &BusEnvelope{
+		Kind:	BUS_FROM_CLIENT,
+		ConnID:	f.connID,
+		Msg:	msg,
+	})
+	if err != nil {
+		c.Log().Warn("Unable to forward message", "err", err)
+		c.Disconnect(DISCONNECT_NODE_DOWN)
+	}
+}
+
+// Handles an envelope from another node; called by sw.cluster's Bus
+func (sw *ServerWrapper) handleBusEnvelope(env *BusEnvelope) {
+	cl := sw.cluster
+
+	switch env.Kind {
+	case BUS_ATTACH:
+		sw.attachClient(env)
+	case BUS_FROM_CLIENT:
+		if bc, ok := cl.attachedConn(env.From, env.ConnID); ok {
+			bc.deliver(env.Msg)
+		}
+	case BUS_DETACH:
+		if bc, ok := cl.attachedConn(env.From, env.ConnID); ok {
+			bc.close(false)
+		}
+	case BUS_TO_CLIENT:
+		if c, ok := cl.forwardedClient(env.From, env.ConnID); ok {
+			if err := c.WriteMsg(env.Msg); err != nil {
+				c.Log().Debug("Unable to write forwarded message",
+					"err", err)
+			}
+		}
+	case BUS_DIRECT:
+		sw.deliverRelayedDirect(env)
+	case BUS_DIRECT_ACK:
+		if ack, ok := env.Msg.Data.(*MsgDirectAck); ok {
+			cl.directAnswered(env.ConnID, env.From, ack.Status)
+		}
+	case BUS_CLOSE:
+		if c, ok := cl.takeForwarded(env.From, env.ConnID); ok {
+			go func() {
+				// the owner's last Messages may explain why
+				if err := c.Flush(); err != nil {
+					c.Log().Debug("Unable to flush", "err", err)
+				}
+				c.Disconnect(DISCONNECT_CLOSED)
+			}()
+		}
+	default:
+		slog.Warn("Ignoring bus envelope of unknown kind",
+			"kind", env.Kind, "from_node_id", env.From)
+	}
+}
+
+// Places a Client forwarded by another node, as if it had connected here
+func (sw *ServerWrapper) attachClient(env *BusEnvelope) {
+	cl := sw.cluster
+	logger := slog.With("from_node_id", env.From, "conn_id", env.ConnID)
+
+	var a forwardAttach
+	err := json.Unmarshal(env.Payload, &a)
+	if err == nil {
+		if _, local := cl.Owner(a.ServerID); !local {
+			err = errors.New(fmt.Sprintf(
+				"Region %s is not owned by this node", a.ServerID))
+		}
+	}
+	if err != nil {
+		logger.Warn("Refusing forwarded Client", "err", err)
+		err = cl.bus.Send(env.From, &BusEnvelope{
+			Kind:	BUS_CLOSE,
+			ConnID:	env.ConnID,
+		})
+		if err != nil {
+			logger.Debug("Unable to close forwarded Client", "err", err)
+		}
+		return
+	}
+
+	bc := newBusConn(cl, env.From, env.ConnID, a)
+	cl.mutex.Lock()
+	cl.attached[attachKey{env.From, env.ConnID}] = bc
+	cl.mutex.Unlock()
+
+	// placing the Client waits on sw.controlLoop(); don't block the Bus
+	go sw.placeClient(newForwardedClient(bc, sw, a))
+}
+
+// BLOCKING: cl.mutex
+func (cl *Cluster) attachedConn(nodeID string, connID uint64) (
+	bc *busConn, ok bool) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	bc, ok = cl.attached[attachKey{nodeID, connID}]
+	return
+}
+
+// Disconnects the Clients forwarded to or from node nodeID, which the Bus
+//    lost touch w/
+// BLOCKING: sw.cluster.mutex
+func (sw *ServerWrapper) nodeDown(nodeID string) {
+	cl := sw.cluster
+
+	var clients []*Client
+	var conns []*busConn
+	cl.mutex.Lock()
+	for connID, cPtr := range cl.forwarded {
+		if link := cPtr.forward.Load(); link != nil && link.nodeID == nodeID {
+			clients = append(clients, cPtr)
+			delete(cl.forwarded, connID)
+		}
+	}
+	for key, bc := range cl.attached {
+		if key.nodeID == nodeID {
+			conns = append(conns, bc)
+		}
+	}
+	cl.mutex.Unlock()
+
+	cl.directsAnsweredBy(nodeID, DirectOffline)
+
+	slog.Warn("Node down; disconnecting its forwarded Clients",
+		"node_id", nodeID, "forwarded_to", len(clients),
+		"forwarded_from", len(conns))
+	for _, cPtr := range clients {
+		cPtr.Disconnect(DISCONNECT_NODE_DOWN)
+	}
+	for _, bc := range conns {
+		bc.close(false)
+	}
+}
+
+// Relays a direct text from sender to every other node, any of which may
+//    hold targetID in its directory; sender is acked once they answer.
+//    False if this node has no others to ask
+// BLOCKING: cl.mutex
+func (cl *Cluster) relayDirect(sender *Client, targetID uint32,
+	text []byte) bool {
+	if cl.bus == nil || len(cl.Nodes) < 2 {
+		return false
+	}
+	payload, err := forwardDirect{
+		SenderID:	sender.ID,
+		TargetID:	targetID,
+		TextBytes:	text,
+	}.MarshalBinary()
+	if err != nil {
+		sender.Log().Warn("Unable to relay direct text", "err", err)
+		return false
+	}
+
+	reqID := atomic.AddUint64(&cl.lastDirectID, 1)
+	rd := &relayedDirect{
+		sender:		sender,
+		targetID:	targetID,
+		waiting:	make(map[string]bool),
+	}
+	// rd.waiting shrinks as the nodes answer
+	var nodeIDs []string
+	for _, node := range cl.Nodes {
+		if node.ID != cl.NodeID {
+			rd.waiting[node.ID] = true
+			nodeIDs = append(nodeIDs, node.ID)
+		}
+	}
+	cl.mutex.Lock()
+	cl.directs[reqID] = rd
+	rd.timer = time.AfterFunc(DIRECT_RELAY_TIMEOUT, func() {
+		cl.finishDirect(reqID, DirectOffline)
+	})
+	cl.mutex.Unlock()
+
+	// a node that's slow to dial mustn't hold up the caller
+	for _, nodeID := range nodeIDs {
+		go func(nodeID string) {
+			err := cl.bus.Send(nodeID, &BusEnvelope{
+				Kind:		BUS_DIRECT,
+				ConnID:		reqID,
+				Payload:	payload,
+			})
+			if err != nil {
+				sender.Log().Debug("Unable to relay direct text",
+					"node_id", nodeID, "err", err)
+				cl.directAnswered(reqID, nodeID, DirectOffline)
+			}
+		}(nodeID)
+	}
+	return true
+}
+
+// Records node nodeID's answer to the relayed direct text w/ reqID
+// BLOCKING: cl.mutex
+func (cl *Cluster) directAnswered(reqID uint64, nodeID string,
+	status uint8) {
+	cl.mutex.Lock()
+	rd, ok := cl.directs[reqID]
+	if !ok || !rd.waiting[nodeID] {
+		cl.mutex.Unlock()
+		return
+	}
+	delete(rd.waiting, nodeID)
+	done := status == DirectDelivered || len(rd.waiting) == 0
+	cl.mutex.Unlock()
+
+	if done {
+		cl.finishDirect(reqID, status)
+	}
+}
+
+// Records node nodeID's answer to every relayed direct text it hasn't
+//    answered, e.g. as it's down
+// BLOCKING: cl.mutex
+func (cl *Cluster) directsAnsweredBy(nodeID string, status uint8) {
+	cl.mutex.Lock()
+	var reqIDs []uint64
+	for reqID, rd := range cl.directs {
+		if rd.waiting[nodeID] {
+			reqIDs = append(reqIDs, reqID)
+		}
+	}
+	cl.mutex.Unlock()
+
+	for _, reqID := range reqIDs {
+		cl.directAnswered(reqID, nodeID, status)
+	}
+}
+
+// Acks the relayed direct text w/ reqID w/ status; a no-op if it was
+//    already acked
+// BLOCKING: cl.mutex
+func (cl *Cluster) finishDirect(reqID uint64, status uint8) {
+	cl.mutex.Lock()
+	rd, ok := cl.directs[reqID]
+	if ok {
+		delete(cl.directs, reqID)
+		rd.timer.Stop()
+	}
+	cl.mutex.Unlock()
+
+	if ok {
+		rd.sender.ackDirect(rd.targetID, status)
+	}
+}
+
+// Delivers a direct text another node relayed, if the target is in this
+//    node's directory, & answers w/ whether it was
+func (sw *ServerWrapper) deliverRelayedDirect(env *BusEnvelope) {
+	var fd forwardDirect
+	if err := fd.UnmarshalBinary(env.Payload); err != nil {
+		slog.Warn("Ignoring malformed direct text", "from_node_id", env.From,
+			"err", err)
+		return
+	}
+
+	status := sw.deliverDirect(fd.SenderID, fd.TargetID, fd.TextBytes)
+	// a pointer, like a decoded Message's Data, so the ack arrives the
+	//    same over an InProcBus as over a TCPBus
+	err := sw.cluster.bus.Send(env.From, &BusEnvelope{
+		Kind:	BUS_DIRECT_ACK,
+		ConnID:	env.ConnID,
+		Msg:	&Message{MTypeDirectAck, &MsgDirectAck{fd.TargetID, status}},
+	})
+	if err != nil {
+		slog.Debug("Unable to answer direct text", "from_node_id", env.From,
+			"err", err)
+	}
+}
+
+// The ClientConn of a Client forwarded here by the node that accepted
+//    its connection, which reads & writes the connection itself & passes
+//    its Messages over the Bus
+type busConn struct {
+	cluster		*Cluster
+	nodeID		string // the accepting node
+	connID		uint64
+	remoteAddr	busAddr
+	trustedPeer	string
+
+	inbox		chan *Message // filled by bc.deliver()
+	closed		chan bool // closed by bc.close()
+	closeOnce	sync.Once
+}
+
+// A forwarded Client's address, as seen by the node that accepted it
+type busAddr string
+
+func (a busAddr) Network() string {
+	return "bus"
+}
+
+func (a busAddr) String() string {
+	return string(a)
+}
+
+func newBusConn(cl *Cluster, nodeID string, connID uint64,
+	a forwardAttach) (bc *busConn) {
+	bc = new(busConn)
+	bc.cluster = cl
+	bc.nodeID = nodeID
+	bc.connID = connID
+	bc.remoteAddr = busAddr(a.RemoteAddr)
+	bc.trustedPeer = a.TrustedPeer
+	bc.inbox = make(chan *Message, FORWARD_INBOX_LEN)
+	bc.closed = make(chan bool)
+	return
+}
+
+// The accepting node completed any transport handshake
+func (bc *busConn) Handshake(timeout time.Duration) (err error) {
+	return
+}
+
+func (bc *busConn) ReadMsg() (msg *Message, err error) {
+	select {
+	case msg = <-bc.inbox:
+		return msg, nil
+	case <-bc.closed:
+		return nil, io.EOF
+	}
+}
+
+// The accepting node enforces the idle timeout
+func (bc *busConn) SetReadDeadline(t time.Time) (err error) {
+	return
+}
+
+func (bc *busConn) WriteMsg(msg *Message) (err error) {
+	select {
+	case <-bc.closed:
+		return errors.New("Forwarded connection closed")
+	default:
+	}
+
+	return bc.cluster.bus.Send(bc.nodeID, &BusEnvelope{
+		Kind:	BUS_TO_CLIENT,
+		ConnID:	bc.connID,
+		Msg:	msg,
+	})
+}
+
+// Bus sends time out on their own (see BUS_SEND_TIMEOUT)
+func (bc *busConn) SetWriteDeadline(t time.Time) (err error) {
+	return
+}
+
+func (bc *busConn) RemoteAddr() net.Addr {
+	return bc.remoteAddr
+}
+
+func (bc *busConn) TrustedPeer() string {
+	return bc.trustedPeer
+}
+
+// Tells the accepting node to close the Client's connection
+func (bc *busConn) Close() (err error) {
+	bc.close(true)
+	return
+}
+
+// Stops bc.ReadMsg() & forgets bc; notify is false if the accepting node
+//    closed the connection itself (or is down)
+// BLOCKING: bc.cluster.mutex
+func (bc *busConn) close(notify bool) {
+	bc.closeOnce.Do(func() {
+		close(bc.closed)
+
+		cl := bc.cluster
+		cl.mutex.Lock()
+		delete(cl.attached, attachKey{bc.nodeID, bc.connID})
+		cl.mutex.Unlock()
+
+		if !notify {
+			return
+		}
+		err := cl.bus.Send(bc.nodeID, &BusEnvelope{
+			Kind:	BUS_CLOSE,
+			ConnID:	bc.connID,
+		})
+		if err != nil {
+			slog.Debug("Unable to close forwarded Client",
+				"from_node_id", bc.nodeID, "conn_id", bc.connID, "err", err)
+		}
+	})
+}
+
+// Queues a Message from the accepting node for bc.ReadMsg(); a Client
+//    that falls FORWARD_INBOX_LEN Messages behind is closed
+func (bc *busConn) deliver(msg *Message) {
+	select {
+	case bc.inbox <- msg:
+	case <-bc.closed:
+	default:
+		slog.Warn("Forwarded Client not keeping up; closing it",
+			"from_node_id", bc.nodeID, "conn_id", bc.connID)
+		bc.close(true)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A Client's end of a connection to a node, speaking the wire protocol
+type testClient struct {
+	t		*testing.T
+	conn	net.Conn
+	id		uint32
+}
+
+// Connects to addr & reads the node's MsgClientAuth, leaving the rest of
+//    the handshake to the caller
+func connectTestClient(t *testing.T, addr string, id uint32) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial(%s) = %v", addr, err)
+	}
+	tc := &testClient{t, conn, id}
+	t.Cleanup(func() { conn.Close() })
+
+	tc.expect(MTypeClientAuth)
+	return tc
+}
+
+// Connects to addr & completes the handshake for region serverID; caps
+//    are negotiated unless 0
+func dialTestClient(t *testing.T, addr string, id uint32, serverID string,
+	caps uint32) *testClient {
+	t.Helper()
+
+	tc := connectTestClient(t, addr, id)
+	if caps != 0 {
+		tc.send(&Message{MTypeCapabilities, MsgCapabilities{caps}})
+		tc.expect(MTypeCapabilities)
+	}
+	tc.send(&Message{MTypeClientRegion, MsgClientRegion{serverID}})
+	tc.send(&Message{MTypeClientID, MsgClientID{id}})
+	tc.send(&Message{MTypeClientName, MsgClientName{
+		fmt.Sprint("user-", id)}})
+	return tc
+}
+
+func (tc *testClient) send(msg *Message) {
+	tc.t.Helper()
+
+	if err := EncodeMsg(tc.conn, msg); err != nil {
+		tc.t.Fatalf("EncodeMsg() = %v", err)
+	}
+}
+
+// Reads the next Message
+func (tc *testClient) read() *Message {
+	tc.t.Helper()
+
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := DecodeMsg(tc.conn)
+	if err != nil {
+		tc.t.Fatalf("Client %v reading: %v", tc.id, err)
+	}
+	return msg
+}
+
+// Reads until a Message of type msgType, skipping others
+func (tc *testClient) expect(msgType uint8) *Message {
+	tc.t.Helper()
+
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := DecodeMsg(tc.conn)
+		if err != nil {
+			tc.t.Fatalf("Client %v waiting for %v: %v", tc.id,
+				Message{Type: msgType}.TypeToString(), err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// Reads until the roster of Community commID, i.e. the Client joined it
+func (tc *testClient) expectRoster(commID string) *MsgRoster {
+	tc.t.Helper()
+
+	for {
+		roster := tc.expect(MTypeRoster).Data.(*MsgRoster)
+		if roster.CommID == commID {
+			return roster
+		}
+	}
+}
+
+// Reads until the node closes the connection
+func (tc *testClient) expectClosed() {
+	tc.t.Helper()
+
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := DecodeMsg(tc.conn); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				tc.t.Fatalf("Client %v not disconnected", tc.id)
+			}
+			return
+		}
+	}
+}
+
+// Starts nodes "a", owning region east, & "b", owning west, on a bus of
+//    kind busKind (a CLUSTER_BUS value), as newInProcPeers() does
+func startTestCluster(t *testing.T, busKind string) (a *ServerWrapper,
+	b *ServerWrapper) {
+	dir := t.TempDir()
+	clusterConfig := filepath.Join(dir, "cluster.conf")
+	regionConfig := filepath.Join(dir, "regions.conf")
+
+	config := fmt.Sprintf("node a %s %s\nnode b %s %s\n"+
+		"region east a\nregion west b\n",
+		freeTestAddr(t), freeTestAddr(t), freeTestAddr(t), freeTestAddr(t))
+	if err := os.WriteFile(clusterConfig, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(regionConfig, []byte("10.2.0.0/16 west\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HOST_IP", "127.0.0.1")
+	t.Setenv("TCP_PORT", "0") // each node listens on its ClientAddr
+	t.Setenv("DEFAULT_REGION", "east")
+	t.Setenv("REGION_CONFIG", regionConfig)
+	t.Setenv("CLUSTER_CONFIG", clusterConfig)
+	t.Setenv("NODE_ID", "a")
+	t.Setenv("CLUSTER_BUS", busKind)
+	t.Setenv("CLUSTER_SECRET", "secret")
+	t.Setenv("SHUTDOWN_TIMEOUT", "1s")
+
+	var nodes []*ServerWrapper
+	for _, nodeID := range []string{"a", "b"} {
+		sw, err := newServerWrapper(nodeID)
+		if err != nil {
+			t.Fatalf("newServerWrapper(%q) = %v", nodeID, err)
+		}
+		if err = sw.Start(); err != nil {
+			t.Fatalf("Start() = %v", err)
+		}
+		t.Cleanup(func() { sw.Shutdown() })
+		nodes = append(nodes, sw)
+	}
+	return nodes[0], nodes[1]
+}
+
+// Starts a node w/o CLUSTER_CONFIG, serving every Client in region
+//    DEFAULT_SERVER_ID; set any other env variables it needs beforehand
+func startTestNode(t *testing.T) *ServerWrapper {
+	_, port, err := net.SplitHostPort(freeTestAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOST_IP", "127.0.0.1")
+	t.Setenv("TCP_PORT", port)
+	t.Setenv("CLUSTER_CONFIG", "")
+	t.Setenv("REGION_CONFIG", "")
+	t.Setenv("DEFAULT_REGION", "")
+	t.Setenv("SHUTDOWN_TIMEOUT", "1s")
+
+	sw, err := newServerWrapper("")
+	if err != nil {
+		t.Fatalf("newServerWrapper() = %v", err)
+	}
+	if err = sw.Start(); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	t.Cleanup(func() { sw.Shutdown() })
+	return sw
+}
+
+func clientAddr(sw *ServerWrapper) string {
+	if sw.cluster.bus == nil {
+		return sw.tcpl.Addr().String()
+	}
+	node, _ := sw.cluster.Node(sw.cluster.NodeID)
+	return node.ClientAddr
+}
+
+func TestClusterTwoNodes(t *testing.T) {
+	for _, busKind := range []string{CLUSTER_BUS_INPROC, CLUSTER_BUS_TCP} {
+		t.Run(busKind, func(t *testing.T) {
+			a, b := startTestCluster(t, busKind)
+
+			// local to b
+			local := dialTestClient(t, clientAddr(b), 1, "west", 0)
+			local.expect(MTypeRoster)
+
+			// forwarded from a to b, the owner of its region
+			forwarded := dialTestClient(t, clientAddr(a), 2, "west", 0)
+			roster := forwarded.expect(MTypeRoster).Data.(*MsgRoster)
+			if len(roster.Members) != 2 {
+				t.Errorf("Forwarded Client got roster %+v, want both "+
+					"Clients in west's root Community", roster)
+			}
+			if out, _ := a.cluster.ForwardedCounts(); out != 1 {
+				t.Errorf("Node a forwarded %v Clients, want 1", out)
+			}
+			if _, in := b.cluster.ForwardedCounts(); in != 1 {
+				t.Errorf("Node b attached %v Clients, want 1", in)
+			}
+
+			// the Community broadcasts across the bus, both ways
+			local.send(&Message{MTypeClientText, MsgClientText{
+				1, []byte("from b")}})
+			text := forwarded.expect(MTypeClientText).Data.(*MsgClientText)
+			if text.ClientID != 1 || !bytes.Equal(text.TextBytes,
+				[]byte("from b")) {
+				t.Errorf("Forwarded Client got %+v", text)
+			}
+			forwarded.send(&Message{MTypeClientText, MsgClientText{
+				2, []byte("from a")}})
+			text = local.expect(MTypeClientText).Data.(*MsgClientText)
+			if text.ClientID != 2 || !bytes.Equal(text.TextBytes,
+				[]byte("from a")) {
+				t.Errorf("Local Client got %+v", text)
+			}
+
+			// direct texts are relayed to the node holding the target
+			east := dialTestClient(t, clientAddr(a), 3, "east", 0)
+			east.expect(MTypeRoster)
+			local.send(&Message{MTypeDirectText, MsgDirectText{
+				3, []byte("psst")}})
+			direct := east.expect(MTypeDirectText).Data.(*MsgDirectText)
+			if direct.ClientID != 1 || string(direct.TextBytes) != "psst" {
+				t.Errorf("Relayed direct text = %+v", direct)
+			}
+			ack := local.expect(MTypeDirectAck).Data.(*MsgDirectAck)
+			if ack.ClientID != 3 || ack.Status != DirectDelivered {
+				t.Errorf("Relayed direct text acked w/ %+v", ack)
+			}
+
+			// a Client w/ CapRedirect is sent to the owner instead
+			redirected := dialTestClient(t, clientAddr(a), 4, "west",
+				SERVER_CAPS)
+			redirect := redirected.expect(MTypeRedirect).Data.(*MsgRedirect)
+			if redirect.ServerID != "west" ||
+				redirect.Addr != clientAddr(b) {
+				t.Errorf("Redirect = %+v, want west at %s", redirect,
+					clientAddr(b))
+			}
+			redirected.expectClosed()
+
+			// losing b disconnects the Clients a forwarded to it
+			if err := b.cluster.Close(); err != nil {
+				t.Fatalf("Close() = %v", err)
+			}
+			forwarded.expectClosed()
+			if out, _ := a.cluster.ForwardedCounts(); out != 0 {
+				t.Errorf("Node a still forwards %v Clients", out)
+			}
+		})
+	}
+}
+
+// The largest direct text a Client can send fits a relayed bus envelope
+func TestClusterRelaysLargestDirectText(t *testing.T) {
+	for _, busKind := range []string{CLUSTER_BUS_INPROC, CLUSTER_BUS_TCP} {
+		t.Run(busKind, func(t *testing.T) {
+			a, b := startTestCluster(t, busKind)
+
+			sender := dialTestClient(t, clientAddr(b), 1, "west", 0)
+			sender.expect(MTypeRoster)
+			target := dialTestClient(t, clientAddr(a), 2, "east", 0)
+			target.expect(MTypeRoster)
+
+			text := bytes.Repeat([]byte("a"), MAX_FRAME_LEN - 4) // - ClientID
+			sender.send(&Message{MTypeDirectText, MsgDirectText{2, text}})
+
+			direct := target.expect(MTypeDirectText).Data.(*MsgDirectText)
+			if direct.ClientID != 1 || !bytes.Equal(direct.TextBytes, text) {
+				t.Errorf("Relayed direct text of %v bytes from %v, want %v "+
+					"bytes from 1", len(direct.TextBytes), direct.ClientID,
+					len(text))
+			}
+			ack := sender.expect(MTypeDirectAck).Data.(*MsgDirectAck)
+			if ack.Status != DirectDelivered {
+				t.Errorf("Relayed direct text acked w/ %+v", ack)
+			}
+		})
+	}
+}
@@ -3,24 +3,42 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sort"
 	"sync"
+	"time"
 )
 
 type Community struct {
 	// public fields
     ID          string     // corresponds to neighbourhood (i.e: uWaterloo)
     Clients 	map[uint32]*Client
+    TextLimit	RateLimit // per member; see Client.allowText()
+    Moderation	ModerationChain // run on all text before it's relayed
 
+    clientsRWMutex	sync.RWMutex // guards Clients
+    history		HistoryConfig
+    logID		string // this Community's log in history.Store
+    logger		*slog.Logger // w/ server_id & comm_id
     caChan 		chan *ClientAction
     done 		chan bool
     loopWG		sync.WaitGroup
+    // ShutdownComm() & Server.Shutdown() can both reach Shutdown()
+    shutdownOnce	sync.Once
 }
 
-func NewComm(id string) (comm *Community) {
+// logger is the Server's, which the Community adds its comm_id to
+func NewComm(id string, history HistoryConfig, logID string,
+	textLimit RateLimit, moderation ModerationChain, logger *slog.Logger) (
+	comm *Community) {
 	comm = new(Community)
 	comm.ID = id
+	comm.TextLimit = textLimit
+	comm.Moderation = moderation
+	comm.logger = logger.With("comm_id", id)
 	comm.Clients = make(map[uint32]*Client)
+	comm.history = history
+	comm.logID = logID
 	comm.caChan = make(chan *ClientAction)
 	comm.done = make(chan bool)
 
@@ -30,22 +48,33 @@ func NewComm(id string) (comm *Community) {
 	return
 }
 
-// Will disconnect all Clients in this Community
+// Will disconnect all Clients in this Community; later calls are no-ops
+//    that return once the first has finished
 func (comm *Community) Shutdown() (err error) {
+    comm.shutdownOnce.Do(comm.shutdown)
+    return
+}
+
+func (comm *Community) shutdown() {
     // stop comm loops from processing
     close(comm.done) // sends on channel to all receivers
     comm.loopWG.Wait()
 
     // closes all client connections in comm.Clients
+    comm.clientsRWMutex.RLock()
+    defer comm.clientsRWMutex.RUnlock()
+
     var wg sync.WaitGroup
     for _, cPtr := range comm.Clients {
         wg.Add(1)
         go func(wg *sync.WaitGroup, c *Client) {
             defer wg.Done()
-            c.Disconnect()
+            // no Server is left to handle the Client's LeaveServer
+            c.RemoveCAChans()
+            c.Disconnect(DISCONNECT_SHUTDOWN)
         }(&wg, cPtr)
     }
-    log.Printf("Community %v disconnecting all clients...\n", comm.ID)
+    comm.logger.Info("Disconnecting all Clients")
     wg.Wait()
 
     return
@@ -54,7 +83,7 @@ func (comm *Community) Shutdown() (err error) {
 
 func (comm *Community) controlLoop() {
     defer func() {
-        log.Printf("Community %s exiting controlLoop()\n", comm.ID)
+        comm.logger.Debug("Exiting controlLoop()")
         comm.loopWG.Done()
     }()
 
@@ -64,7 +93,9 @@ ControlLoop:
         case <-comm.done:
             break ControlLoop
         case caPtr := <-comm.caChan:
-        	log.Println("comm.controlLoop(): Received a Client Action")
+        	comm.logger.Debug("Received a ClientAction",
+        		"client_id", caPtr.ClientID,
+        		"action", fmt.Sprintf("%T", caPtr.Action))
             comm.handleCA(caPtr)
         }
     }
@@ -74,10 +105,57 @@ ControlLoop:
 
 // method implementations in client_actions.go
 func (comm *Community) handleCA(caPtr *ClientAction) {
-	// TODO: impl
+	switch caPtr.Action.(type) {
+	case SendText:
+		comm.CASendText(caPtr)
+	case ClientJoined:
+		comm.CAClientJoined(caPtr)
+	case ClientLeft:
+		comm.CAClientLeft(caPtr)
+	case Rename:
+		comm.CARename(caPtr)
+	case RequestHistory:
+		comm.CARequestHistory(caPtr)
+	default: // should never happen
+		fatal(comm.logger, "Encountered invalid ClientAction",
+			"action", fmt.Sprintf("%#v", *caPtr))
+	}
 }
 
+// Adds c via comm.controlLoop() (see comm.CAClientJoined()), so c's
+//    history, roster & UserJoined are ordered w/ the Community's text
+func (comm *Community) Join(c *Client) error {
+	result := make(chan error, 1)
+	err := comm.route().Send(&ClientAction{
+		ClientID:	c.ID,
+		Action:		ClientJoined{c, result},
+	})
+	if err != nil {
+		return err
+	}
+	return <-result
+}
+
+// Removes c via comm.controlLoop() (see comm.CAClientLeft()), or
+//    directly if the loop has stopped
+func (comm *Community) Leave(c *Client) error {
+	result := make(chan error, 1)
+	err := comm.route().Send(&ClientAction{
+		ClientID:	c.ID,
+		Action:		ClientLeft{c, result},
+	})
+	if err != nil {
+		return comm.RemoveClient(c)
+	}
+	return <-result
+}
+
+// Only called by comm.controlLoop(), unless it has stopped
+// BLOCKING: comm.clientsRWMutex
 func (comm *Community) AddClient(c *Client) error {
+	comm.clientsRWMutex.Lock()
+	defer comm.clientsRWMutex.Unlock()
+
 	if _, ok := comm.Clients[c.ID]; ok {
 		return errors.New(fmt.Sprintf(
 			"Client ID %v already exists in community %s\n",
@@ -89,8 +167,164 @@ func (comm *Community) AddClient(c *Client) error {
 	return nil
 }
 
+// Writes msg to every member but skipID (may be INVALID_CLIENT_USERID)
+// requires comm.clientsRWMutex to be held
+func (comm *Community) broadcast(msg *Message, skipID uint32) {
+	comm.broadcastFunc(func(*Client) *Message { return msg }, skipID)
+}
+
+// Writes every member but skipID the Message msgFor() picks for it
+// requires comm.clientsRWMutex to be held
+func (comm *Community) broadcastFunc(msgFor func(c *Client) *Message,
+	skipID uint32) {
+	start := time.Now()
+	defer func() { metrics.Broadcast(time.Since(start)) }()
+
+	for id, cPtr := range comm.Clients {
+		if id == skipID {
+			continue
+		}
+		msg := msgFor(cPtr)
+		if err := cPtr.WriteMsg(msg); err != nil {
+			comm.logger.Info("Unable to send message", "client_id", id,
+				"type", msg.TypeToString(), "err", err)
+		}
+	}
+}
+
+// Members sorted by ID
+// BLOCKING: comm.clientsRWMutex (read)
+func (comm *Community) Roster() (roster []RosterEntry) {
+	comm.clientsRWMutex.RLock()
+	defer comm.clientsRWMutex.RUnlock()
+
+	roster = make([]RosterEntry, 0, len(comm.Clients))
+	for _, cPtr := range comm.Clients {
+		roster = append(roster, RosterEntry{cPtr.ID, cPtr.DisplayName()})
+	}
+	sort.Slice(roster, func(i, j int) bool {
+		return roster[i].ClientID < roster[j].ClientID
+	})
+
+	return
+}
+
+// Writes roster to c in as few MsgRoster as fit within MAX_FRAME_LEN
+func (comm *Community) writeRoster(c *Client, roster []RosterEntry) (
+	err error) {
+	for {
+		// 1 byte CommID length, 1 byte More & 2 byte entry count
+		frameLen := 4 + len(comm.ID)
+		n := 0
+		for ; n < len(roster); n++ {
+			entryLen := ROSTER_ENTRY_HEADER_LEN + len(roster[n].Name)
+			if frameLen + entryLen > MAX_FRAME_LEN {
+				break
+			}
+			frameLen += entryLen
+		}
+
+		err = c.WriteMsg(&Message{MTypeRoster, MsgRoster{
+			CommID:		comm.ID,
+			More:		n < len(roster),
+			Members:	roster[:n],
+		}})
+		if err != nil {
+			return err
+		}
+
+		roster = roster[n:]
+		if len(roster) == 0 {
+			return nil
+		}
+	}
+}
+
+// Sends c the newest comm.history.ReplayLen entries, if any
+func (comm *Community) replayHistory(c *Client) {
+	entries, err := comm.history.Store.Before(
+		comm.logID, 0, comm.history.ReplayLen)
+	if err != nil {
+		comm.logger.Error("Unable to read history", "err", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	if err = comm.writeHistory(c, entries); err != nil {
+		comm.logger.Warn("Unable to replay history", "client_id", c.ID,
+			"err", err)
+	}
+}
+
+// Writes entries to c in as few MsgHistory as fit within MAX_FRAME_LEN;
+//    always writes at least one, even if entries is empty
+func (comm *Community) writeHistory(c *Client, entries []HistoryEntry) (
+	err error) {
+	for {
+		// 1 byte CommID length & 2 byte entry count
+		frameLen := 3 + len(comm.ID)
+		n := 0
+		for ; n < len(entries); n++ {
+			entryLen := HISTORY_ENTRY_HEADER_LEN + len(entries[n].TextBytes)
+			if frameLen + entryLen > MAX_FRAME_LEN {
+				break
+			}
+			frameLen += entryLen
+		}
+		if n == 0 && len(entries) > 0 {
+			// can't fit in any frame; shouldn't happen as text frames
+			// are held to MAX_FRAME_LEN too
+			comm.logger.Warn("Skipping oversized history entry",
+				"seq", entries[0].Seq)
+			entries = entries[1:]
+			continue
+		}
+
+		err = c.WriteMsg(&Message{MTypeHistory, MsgHistory{
+			CommID:		comm.ID,
+			Entries:	entries[:n],
+		}})
+		if err != nil {
+			return err
+		}
+
+		entries = entries[n:]
+		if len(entries) == 0 {
+			return nil
+		}
+	}
+}
+
+func (comm *Community) route() caRoute {
+	return caRoute{comm.caChan, comm.done}
+}
+
+// BLOCKING: comm.clientsRWMutex (read)
+func (comm *Community) HasClient(c *Client) bool {
+	comm.clientsRWMutex.RLock()
+	defer comm.clientsRWMutex.RUnlock()
+
+	member, ok := comm.Clients[c.ID]
+	return ok && member == c
+}
+
+// BLOCKING: comm.clientsRWMutex (read)
+func (comm *Community) Len() int {
+	comm.clientsRWMutex.RLock()
+	defer comm.clientsRWMutex.RUnlock()
+
+	return len(comm.Clients)
+}
+
+// BLOCKING: comm.clientsRWMutex
 func (comm *Community) RemoveClient(c *Client) error {
-	if _, ok := comm.Clients[c.ID]; ok {
+	comm.clientsRWMutex.Lock()
+	defer comm.clientsRWMutex.Unlock()
+
+	// a different Client w/ the same ID may have since joined
+	if member, ok := comm.Clients[c.ID]; !ok || member != c {
 		return errors.New(fmt.Sprintf(
 			"Client ID %v DNE in community %s\n",
 			c.ID, comm.ID))
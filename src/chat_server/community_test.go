@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// ShutdownComm() & Server.Shutdown() may race to shut the same Community
+func TestCommunityShutdownTwice(t *testing.T) {
+	comm := NewComm("test", HistoryConfig{}, HistoryLogID("main", "test"),
+		RateLimit{}, nil, slog.Default())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := comm.Shutdown(); err != nil {
+				t.Errorf("Shutdown() = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := comm.Shutdown(); err != nil {
+		t.Errorf("Shutdown() after shutdown = %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+const (
+	DEFAULT_IDLE_TIMEOUT = 90 * time.Second
+	DEFAULT_PING_INTERVAL = 30 * time.Second
+)
+
+var errIdleTimeout = errors.New("Idle timeout exceeded")
+
+// How long a Client may go w/o sending anything; a Client that negotiated
+//    CapHeartbeat is sent a MsgPing every PingInterval, which its MsgPong
+//    answers. An IdleTimeout of 0 disables both
+type HeartbeatConfig struct {
+	IdleTimeout		time.Duration
+	PingInterval	time.Duration
+}
+
+func DefaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{
+		IdleTimeout:	DEFAULT_IDLE_TIMEOUT,
+		PingInterval:	DEFAULT_PING_INTERVAL,
+	}
+}
+
+func (h HeartbeatConfig) Enabled() bool {
+	return h.IdleTimeout > 0
+}
+
+// Reads the next Message from c.conn, failing if none arrives within the
+//    idle timeout
+func (c *Client) readMsg() (msg *Message, err error) {
+	if c.heartbeat.Enabled() {
+		err = c.conn.SetReadDeadline(time.Now().Add(c.heartbeat.IdleTimeout))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	msg, err = c.conn.ReadMsg()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, errIdleTimeout
+	}
+	return msg, err
+}
+
+// Answers a MsgPing; any Message, a MsgPong included, has already reset
+//    the idle timeout by arriving. Returns false for other Messages
+func (c *Client) handleHeartbeat(msg *Message) bool {
+	switch msg.Type {
+	case MTypePing:
+		nonce := msg.Data.(*MsgPing).Nonce
+		if err := c.WriteMsg(&Message{MTypePong, MsgPong{nonce}}); err != nil {
+			c.Log().Warn("Unable to send pong", "err", err)
+		}
+		return true
+	case MTypePong:
+		return true
+	}
+	return false
+}
+
+// Pings the Client every c.heartbeat.PingInterval (if it negotiated
+//    CapHeartbeat) until it is disconnected
+func (c *Client) heartbeatLoop() {
+	ticker := time.NewTicker(c.heartbeat.PingInterval)
+	defer ticker.Stop()
+
+	var nonce uint64
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if c.Caps() & CapHeartbeat == 0 {
+			continue
+		}
+		nonce++
+		if err := c.WriteMsg(&Message{MTypePing, MsgPing{nonce}}); err != nil {
+			c.Log().Warn("Unable to send ping", "err", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	TEST_IDLE_TIMEOUT = 150 * time.Millisecond
+	TEST_PING_INTERVAL = 30 * time.Millisecond
+)
+
+// A Client awaiting auth over a net.Pipe(), w/ caps negotiated & its
+//    heartbeat & read loops running on short intervals
+func newTestHeartbeatClient(t *testing.T, caps uint32) (c *Client,
+	peer *testClient) {
+	c, peer = newTestQueueClient(t, 16, SLOW_CONSUMER_DISCONNECT)
+	c.caps = caps
+	c.heartbeat = HeartbeatConfig{
+		IdleTimeout:	TEST_IDLE_TIMEOUT,
+		PingInterval:	TEST_PING_INTERVAL,
+	}
+	c.authComplete = make(chan bool)
+	c.readLoopDone = make(chan bool)
+
+	go c.heartbeatLoop()
+	go c.readLoop()
+	return c, peer
+}
+
+// A Client w/ CapHeartbeat is pinged, & stays connected past the idle
+//    timeout by answering
+func TestHeartbeatPingPong(t *testing.T) {
+	c, peer := newTestHeartbeatClient(t, SERVER_CAPS)
+
+	var nonce uint64
+	for start := time.Now(); time.Since(start) < 2 * TEST_IDLE_TIMEOUT; {
+		ping := peer.expect(MTypePing).Data.(*MsgPing)
+		if ping.Nonce != nonce + 1 {
+			t.Fatalf("Ping nonce %v, want %v", ping.Nonce, nonce + 1)
+		}
+		nonce = ping.Nonce
+		peer.send(&Message{MTypePong, MsgPong{nonce}})
+	}
+	if c.IsDisconnected() {
+		t.Fatalf("Client answering pings was disconnected")
+	}
+
+	// the Client's own pings are answered
+	peer.send(&Message{MTypePing, MsgPing{42}})
+	if pong := peer.expect(MTypePong).Data.(*MsgPong); pong.Nonce != 42 {
+		t.Errorf("Pong nonce %v, want 42", pong.Nonce)
+	}
+}
+
+// A Client w/o CapHeartbeat, as one that never negotiated caps, isn't
+//    pinged, & is disconnected once idle
+func TestHeartbeatIdleTimeout(t *testing.T) {
+	before := disconnectCount(DISCONNECT_IDLE)
+	c, peer := newTestHeartbeatClient(t, DEFAULT_CAPS)
+
+	// answered, & resets the idle timeout
+	peer.send(&Message{MTypePing, MsgPing{1}})
+	peer.expect(MTypePong)
+	idleFrom := time.Now()
+
+	peer.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := DecodeMsg(peer.conn)
+		if err != nil {
+			break
+		}
+		t.Errorf("Idle Client w/o CapHeartbeat got %v", msg.TypeToString())
+	}
+	if idle := time.Since(idleFrom); idle < TEST_IDLE_TIMEOUT {
+		t.Errorf("Disconnected after %v idle, want %v", idle,
+			TEST_IDLE_TIMEOUT)
+	}
+	if !c.IsDisconnected() {
+		t.Fatalf("Connection closed w/o disconnecting the Client")
+	}
+	if n := disconnectCount(DISCONNECT_IDLE); n != before + 1 {
+		t.Errorf("%v idle_timeout disconnects, want %v", n, before + 1)
+	}
+}
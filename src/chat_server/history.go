@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Max entries a MemoryStore keeps per log; older entries are dropped
+	MAX_MEMORY_HISTORY = 1000
+	// Default number of entries sent to a Client joining a Community
+	DEFAULT_HISTORY_REPLAY_LEN = 50
+	// Max entries returned for a single MsgHistoryRequest
+	MAX_HISTORY_PAGE_LEN = 100
+)
+
+// A text message recorded in a Community's history
+type HistoryEntry struct {
+	Seq			uint64		`json:"seq"` // per-log, starting at 1
+	MsgID		uint64		`json:"msg_id,omitempty"` // see MsgIDGenerator
+	ClientID	uint32		`json:"client_id"`
+	Time		time.Time	`json:"time"`
+	TextBytes	[]byte		`json:"text"`
+}
+
+// MessageStore is an append-only log of each Community's messages, keyed
+//    by a log ID unique to the Community (see HistoryLogID())
+type MessageStore interface {
+	// Assigns entry.Seq (1 + the log's last Seq) & appends entry
+	Append(logID string, entry *HistoryEntry) (err error)
+	// Returns up to n of the newest entries w/ Seq < beforeSeq, oldest
+	// first; a beforeSeq of 0 returns the newest n entries
+	Before(logID string, beforeSeq uint64, n int) (
+		entries []HistoryEntry, err error)
+	Close() (err error)
+}
+
+// Where a Server's Communities record their messages
+type HistoryConfig struct {
+	Store		MessageStore
+	ReplayLen	int // entries sent to Clients joining a Community
+}
+
+// Community IDs are only unique within a Server
+func HistoryLogID(serverID string, commID string) string {
+	return serverID + "/" + commID
+}
+
+// Returns the slice bounds [lo, hi) into a log whose entries are Seqs
+//    firstSeq, firstSeq+1, ... firstSeq+length-1 for Before()
+func beforeBounds(firstSeq uint64, length int, beforeSeq uint64, n int) (
+	lo int, hi int) {
+	hi = length
+	if beforeSeq != 0 {
+		if beforeSeq <= firstSeq {
+			return 0, 0
+		}
+		if idx := int(beforeSeq - firstSeq); idx < hi {
+			hi = idx
+		}
+	}
+
+	lo = hi - n
+	if lo < 0 {
+		lo = 0
+	}
+	return
+}
+
+// MemoryStore keeps the last MAX_MEMORY_HISTORY entries of each log
+type MemoryStore struct {
+	mutex		sync.Mutex
+	logs		map[string][]HistoryEntry
+	lastSeqs	map[string]uint64
+}
+
+func NewMemoryStore() (ms *MemoryStore) {
+	ms = new(MemoryStore)
+	ms.logs = make(map[string][]HistoryEntry)
+	ms.lastSeqs = make(map[string]uint64)
+	return
+}
+
+// BLOCKING: ms.mutex
+func (ms *MemoryStore) Append(logID string, entry *HistoryEntry) (
+	err error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.lastSeqs[logID]++
+	entry.Seq = ms.lastSeqs[logID]
+
+	hist := append(ms.logs[logID], *entry)
+	if len(hist) > MAX_MEMORY_HISTORY {
+		hist = hist[len(hist)-MAX_MEMORY_HISTORY:]
+	}
+	ms.logs[logID] = hist
+
+	return
+}
+
+// BLOCKING: ms.mutex
+func (ms *MemoryStore) Before(logID string, beforeSeq uint64, n int) (
+	entries []HistoryEntry, err error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	hist := ms.logs[logID]
+	if len(hist) == 0 {
+		return nil, nil
+	}
+
+	lo, hi := beforeBounds(hist[0].Seq, len(hist), beforeSeq, n)
+	entries = make([]HistoryEntry, hi-lo)
+	copy(entries, hist[lo:hi])
+
+	return
+}
+
+func (ms *MemoryStore) Close() (err error) {
+	return
+}
+
+// FileStore keeps each log as a file of newline-delimited JSON entries
+//    in Dir, indexing the offset of every entry in memory
+type FileStore struct {
+	Dir			string
+
+	mutex		sync.Mutex
+	logs		map[string]*fileLog
+}
+
+type fileLog struct {
+	f			*os.File
+	offsets		[]int64 // offsets[i] is where entry w/ Seq i+1 starts
+	size		int64
+}
+
+func NewFileStore(dir string) (fs *FileStore, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	fs = new(FileStore)
+	fs.Dir = dir
+	fs.logs = make(map[string]*fileLog)
+	return
+}
+
+// requires fs.mutex to be held
+func (fs *FileStore) getLog(logID string) (fl *fileLog, err error) {
+	if fl, ok := fs.logs[logID]; ok {
+		return fl, nil
+	}
+
+	path := filepath.Join(fs.Dir, url.PathEscape(logID) + ".log")
+	fl, err = openFileLog(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf(
+			"Unable to open history log %s: %v", path, err))
+	}
+
+	fs.logs[logID] = fl
+	return
+}
+
+// Indexes an existing log, dropping a partially written last entry
+func openFileLog(path string) (fl *fileLog, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fl = &fileLog{f: f}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break // any partial line is truncated below
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		fl.offsets = append(fl.offsets, fl.size)
+		fl.size += int64(len(line))
+	}
+
+	if err = f.Truncate(fl.size); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return fl, nil
+}
+
+// BLOCKING: fs.mutex
+func (fs *FileStore) Append(logID string, entry *HistoryEntry) (
+	err error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fl, err := fs.getLog(logID)
+	if err != nil {
+		return err
+	}
+
+	entry.Seq = uint64(len(fl.offsets)) + 1
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err = fl.f.WriteAt(line, fl.size); err != nil {
+		return err
+	}
+	fl.offsets = append(fl.offsets, fl.size)
+	fl.size += int64(len(line))
+
+	return
+}
+
+// BLOCKING: fs.mutex
+func (fs *FileStore) Before(logID string, beforeSeq uint64, n int) (
+	entries []HistoryEntry, err error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fl, err := fs.getLog(logID)
+	if err != nil {
+		return nil, err
+	}
+
+	lo, hi := beforeBounds(1, len(fl.offsets), beforeSeq, n)
+	if lo == hi {
+		return nil, nil
+	}
+
+	end := fl.size
+	if hi < len(fl.offsets) {
+		end = fl.offsets[hi]
+	}
+	bin := make([]byte, end - fl.offsets[lo])
+	if _, err = fl.f.ReadAt(bin, fl.offsets[lo]); err != nil {
+		return nil, err
+	}
+
+	entries = make([]HistoryEntry, 0, hi-lo)
+	for _, line := range bytes.SplitAfter(bin, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry HistoryEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return
+}
+
+// BLOCKING: fs.mutex
+func (fs *FileStore) Close() (err error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for logID, fl := range fs.logs {
+		if closeErr := fl.f.Close(); closeErr != nil {
+			err = closeErr
+		}
+		delete(fs.logs, logID)
+	}
+
+	return
+}
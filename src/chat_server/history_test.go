@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBeforeBounds(t *testing.T) {
+	cases := []struct {
+		firstSeq	uint64
+		length		int
+		beforeSeq	uint64
+		n			int
+		lo, hi		int
+	}{
+		{1, 0, 0, 10, 0, 0},
+		{1, 10, 0, 3, 7, 10}, // the newest n
+		{1, 10, 0, 20, 0, 10}, // n clamped to the log
+		{1, 10, 6, 3, 2, 5}, // Seqs 3-5
+		{1, 10, 3, 10, 0, 2},
+		{1, 10, 1, 10, 0, 0}, // nothing before the 1st
+		{1, 10, 50, 3, 7, 10}, // past the end
+		{101, 10, 105, 2, 2, 4}, // Seqs 103-104 of a trimmed log
+		{101, 10, 100, 5, 0, 0}, // already trimmed
+		{101, 10, 101, 5, 0, 0},
+		{1, 10, 0, 0, 10, 10},
+	}
+	for _, tc := range cases {
+		lo, hi := beforeBounds(tc.firstSeq, tc.length, tc.beforeSeq, tc.n)
+		if lo != tc.lo || hi != tc.hi {
+			t.Errorf("beforeBounds(%v, %v, %v, %v) = [%v, %v), want "+
+				"[%v, %v)", tc.firstSeq, tc.length, tc.beforeSeq, tc.n, lo,
+				hi, tc.lo, tc.hi)
+		}
+	}
+}
+
+// Appends n entries to logID, w/ texts "0", "1", ...
+func appendTestHistory(t *testing.T, store MessageStore, logID string,
+	n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		entry := &HistoryEntry{ClientID: 7, TextBytes: []byte(fmt.Sprint(i))}
+		if err := store.Append(logID, entry); err != nil {
+			t.Fatalf("Append() = %v", err)
+		}
+		if entry.Seq != uint64(i + 1) {
+			t.Fatalf("Append() assigned Seq %v, want %v", entry.Seq, i + 1)
+		}
+	}
+}
+
+// Checks entries are Seqs first, first+1, ... last
+func checkTestHistory(t *testing.T, entries []HistoryEntry, first uint64,
+	last uint64) {
+	t.Helper()
+
+	if uint64(len(entries)) != last - first + 1 {
+		t.Fatalf("Got %v entries, want Seqs %v-%v", len(entries), first, last)
+	}
+	for i, entry := range entries {
+		seq := first + uint64(i)
+		if entry.Seq != seq || string(entry.TextBytes) != fmt.Sprint(seq - 1) {
+			t.Fatalf("Entry %v has Seq %v & text %q, want Seq %v", i,
+				entry.Seq, entry.TextBytes, seq)
+		}
+	}
+}
+
+func TestMessageStoreBefore(t *testing.T) {
+	stores := map[string]func(t *testing.T) MessageStore{
+		"memory": func(t *testing.T) MessageStore {
+			return NewMemoryStore()
+		},
+		"file": func(t *testing.T) MessageStore {
+			fs, err := NewFileStore(t.TempDir())
+			if err != nil {
+				t.Fatalf("NewFileStore() = %v", err)
+			}
+			t.Cleanup(func() { fs.Close() })
+			return fs
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			entries, err := store.Before("main/c1", 0, 10)
+			if err != nil || len(entries) != 0 {
+				t.Fatalf("Before() on an empty log = %v, %v", entries, err)
+			}
+
+			appendTestHistory(t, store, "main/c1", 20)
+			appendTestHistory(t, store, "main/c2", 3) // Seqs are per-log
+
+			entries, err = store.Before("main/c1", 0, 5)
+			if err != nil {
+				t.Fatalf("Before() = %v", err)
+			}
+			checkTestHistory(t, entries, 16, 20)
+
+			entries, _ = store.Before("main/c1", 11, 5)
+			checkTestHistory(t, entries, 6, 10)
+			entries, _ = store.Before("main/c1", 4, 5) // clamped
+			checkTestHistory(t, entries, 1, 3)
+			entries, _ = store.Before("main/c1", 0, 100)
+			checkTestHistory(t, entries, 1, 20)
+			entries, _ = store.Before("main/c2", 0, 100)
+			checkTestHistory(t, entries, 1, 3)
+
+			if entries, _ = store.Before("main/c1", 1, 5); len(entries) != 0 {
+				t.Errorf("Before(1) = %v entries, want none", len(entries))
+			}
+		})
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	ms := NewMemoryStore()
+	appendTestHistory(t, ms, "main/c1", MAX_MEMORY_HISTORY + 10)
+
+	entries, _ := ms.Before("main/c1", 0, MAX_MEMORY_HISTORY + 10)
+	checkTestHistory(t, entries, 11, MAX_MEMORY_HISTORY + 10)
+
+	// Seqs of evicted entries return nothing, the rest as before
+	if entries, _ = ms.Before("main/c1", 11, 5); len(entries) != 0 {
+		t.Errorf("Before() of evicted Seqs = %v entries", len(entries))
+	}
+	entries, _ = ms.Before("main/c1", 20, 100)
+	checkTestHistory(t, entries, 11, 19)
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore() = %v", err)
+	}
+	appendTestHistory(t, fs, "main/c1", 5)
+	fs.Close()
+
+	fs, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore() = %v", err)
+	}
+	defer fs.Close()
+
+	// Seqs carry on from the log on disk
+	entry := &HistoryEntry{TextBytes: []byte("5")}
+	if err = fs.Append("main/c1", entry); err != nil || entry.Seq != 6 {
+		t.Fatalf("Append() after reopening = Seq %v, %v; want 6", entry.Seq,
+			err)
+	}
+	entries, _ := fs.Before("main/c1", 0, 10)
+	checkTestHistory(t, entries, 1, 6)
+}
+
+// A last entry only partly written before a crash is dropped, & the next
+//    Append() takes its Seq & place
+func TestFileStoreTruncatedEntry(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore() = %v", err)
+	}
+	appendTestHistory(t, fs, "main/c1", 3)
+	fs.Close()
+
+	path := filepath.Join(dir, url.PathEscape("main/c1") + ".log")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":4,"client_id":7,"te`)
+	f.Close()
+
+	fs, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore() = %v", err)
+	}
+	defer fs.Close()
+
+	entries, err := fs.Before("main/c1", 0, 10)
+	if err != nil {
+		t.Fatalf("Before() = %v", err)
+	}
+	checkTestHistory(t, entries, 1, 3)
+
+	entry := &HistoryEntry{TextBytes: []byte("3")}
+	if err = fs.Append("main/c1", entry); err != nil || entry.Seq != 4 {
+		t.Fatalf("Append() = Seq %v, %v; want 4", entry.Seq, err)
+	}
+	entries, err = fs.Before("main/c1", 0, 10)
+	if err != nil {
+		t.Fatalf("Before() after overwriting the partial entry = %v", err)
+	}
+	checkTestHistory(t, entries, 1, 4)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// LOG_FORMAT values
+const (
+	LOG_FORMAT_TEXT = "text" // logfmt-style key=value pairs
+	LOG_FORMAT_JSON = "json" // 1 JSON object per line
+)
+
+// Builds the logger every other logger is derived from; level is one of
+//    debug, info, warn or error
+func NewLogger(w io.Writer, level string, format string) (
+	logger *slog.Logger, err error) {
+	var lvl slog.Level
+	if err = lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, errors.New(fmt.Sprintf("Unknown log level %q", level))
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case LOG_FORMAT_TEXT:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LOG_FORMAT_JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown log format %q", format))
+	}
+}
+
+// Logs msg at error level & exits; for states that should never happen
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// The Client's logger, w/ its remote_addr, client_id & user_id (once
+//    known) and the server_id & comm_id it was last placed in
+func (c *Client) Log() *slog.Logger {
+	return c.logger.Load()
+}
+
+// Replaces the Client's logger w/ one carrying its identity & attrs
+func (c *Client) setLogContext(attrs ...any) {
+	fields := []any{"remote_addr", c.conn.RemoteAddr().String()}
+	if c.ID != INVALID_CLIENT_USERID {
+		fields = append(fields, "client_id", c.ID)
+	}
+	if c.UserID != "" {
+		fields = append(fields, "user_id", c.UserID)
+	}
+	c.logger.Store(slog.With(append(fields, attrs...)...))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collects log output written from any goroutine
+type testLogBuffer struct {
+	mutex	sync.Mutex
+	buf		bytes.Buffer
+}
+
+func (b *testLogBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buf.Write(p)
+}
+
+// The JSON records logged so far
+func (b *testLogBuffer) records(t *testing.T) (records []map[string]any) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()),
+		"\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Log line %q isn't JSON: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+// Routes the default logger to a buffer, in JSON at debug level, until
+//    the test ends
+func captureTestLogs(t *testing.T) *testLogBuffer {
+	b := new(testLogBuffer)
+	logger, err := NewLogger(b, "debug", LOG_FORMAT_JSON)
+	if err != nil {
+		t.Fatalf("NewLogger() = %v", err)
+	}
+	prev := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return b
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "WARN", "Text")
+	if err != nil {
+		t.Fatalf("NewLogger() = %v", err)
+	}
+	logger.Info("dropped")
+	logger.Warn("kept", "client_id", 7)
+	if out := buf.String(); strings.Contains(out, "dropped") ||
+		!strings.Contains(out, "level=WARN msg=kept client_id=7") {
+		t.Errorf("Logged %q", out)
+	}
+
+	if _, err = NewLogger(&buf, "loud", LOG_FORMAT_TEXT); err == nil {
+		t.Errorf("NewLogger() accepted level \"loud\"")
+	}
+	if _, err = NewLogger(&buf, "info", "xml"); err == nil {
+		t.Errorf("NewLogger() accepted format \"xml\"")
+	}
+}
+
+// What a Client & its Community log carries the IDs of the Client,
+//    Server & Community
+func TestLogContext(t *testing.T) {
+	t.Setenv("HISTORY_DIR", "")
+	logs := captureTestLogs(t)
+	sw := startTestNode(t)
+
+	tc, _ := dialTestSessionClient(t, sw, 7, "c1")
+	tc.sendAckedText(1, []byte("a\x00b")) // redacted
+	tc.conn.Close()
+
+	want := map[string]map[string]any{
+		"Redacted text":	{"server_id": DEFAULT_SERVER_ID,
+			"comm_id": "c1", "client_id": float64(7)},
+		"Disconnecting":	{"server_id": DEFAULT_SERVER_ID,
+			"comm_id": "c1", "client_id": float64(7), "reason": "closed"},
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(want) > 0; {
+		for _, record := range logs.records(t) {
+			fields, ok := want[fmt.Sprint(record["msg"])]
+			if !ok {
+				continue
+			}
+			matched := true
+			for key, value := range fields {
+				matched = matched && record[key] == value
+			}
+			if matched {
+				delete(want, fmt.Sprint(record["msg"]))
+			}
+		}
+		if len(want) > 0 && time.Now().After(deadline) {
+			t.Fatalf("No records logged w/ %v", want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
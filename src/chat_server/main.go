@@ -2,12 +2,20 @@ package main
 
 import (
     "bufio"
+    "crypto/tls"
     "errors"
     "fmt"
-    "log"
+    "log/slog"
+    "math"
     "net"
+    "net/http"
     "os"
+    "os/signal"
+    "path/filepath"
+    "strconv"
     "strings"
+    "syscall"
+    "time"
 )
 
 // OS Env variable fetching functions
@@ -41,18 +49,533 @@ func getAPIPort() (string, error) {
     return apiPort, nil
 }
 
-func ServerIDFromIP(ipAddr string) (serverID string, err error) {
-    // TODO: determine ServerID based on c.conn IP addr
+// Return the deployed service's API_TOKEN, the bearer token the HTTP API
+//    requires; ok is false if unset (API bound to loopback instead)
+func getAPIToken() (token string, ok bool) {
+    token, ok = os.LookupEnv("API_TOKEN")
+    return token, ok && token != ""
+}
 
-    return "main", nil
+// Return the deployed service's DEFAULT_REGION, the ServerID for
+//    Clients whose IP matches no region; defaults to "main"
+func getDefaultRegion() string {
+    region, ok := os.LookupEnv("DEFAULT_REGION")
+    if !ok || region == "" {
+        return DEFAULT_SERVER_ID
+    }
+    return region
 }
 
-// ctor private, accessible to main only
-func newServerWrapper() (sw *ServerWrapper, err error) {
+// Return the deployed service's REGION_CONFIG, the path to a CIDR
+//    table for region routing; ok is false if unset
+func getRegionConfig() (path string, ok bool) {
+    path, ok = os.LookupEnv("REGION_CONFIG")
+    return path, ok && path != ""
+}
+
+// Return the deployed service's WS_PORT, serving WebSocket Clients; ok is
+//    false if unset (WebSocket disabled)
+func getWSPort() (wsPort string, ok bool) {
+    wsPort, ok = os.LookupEnv("WS_PORT")
+    return wsPort, ok && wsPort != ""
+}
+
+// Return the deployed service's HISTORY_DIR, where Community message
+//    history is persisted; ok is false if unset (history kept in memory)
+func getHistoryDir() (dir string, ok bool) {
+    dir, ok = os.LookupEnv("HISTORY_DIR")
+    return dir, ok && dir != ""
+}
+
+// Return the deployed service's HISTORY_REPLAY_LEN, the number of
+//    messages replayed to Clients joining a Community
+func getHistoryReplayLen() (int, error) {
+    replayLen, ok := os.LookupEnv("HISTORY_REPLAY_LEN")
+    if !ok || replayLen == "" {
+        return DEFAULT_HISTORY_REPLAY_LEN, nil
+    }
+    n, err := strconv.Atoi(replayLen)
+    if err != nil || n < 0 {
+        return 0, errors.New(fmt.Sprintf(
+            "Invalid HISTORY_REPLAY_LEN %q", replayLen))
+    }
+    return n, nil
+}
+
+// Return the deployed service's LOG_LEVEL (default info) & LOG_FORMAT
+//    (default text)
+func getLogConfig() (level string, format string) {
+    level, format = os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT")
+    if level == "" {
+        level = "info"
+    }
+    if format == "" {
+        format = LOG_FORMAT_TEXT
+    }
+    return level, format
+}
+
+// Return the deployed service's WRITE_QUEUE_LEN, WRITE_TIMEOUT &
+//    SLOW_CONSUMER_POLICY, limiting each Client's outbound Messages
+func getWriteQueueConfig() (config WriteQueueConfig, err error) {
+    config = DefaultWriteQueueConfig()
+
+    if queueLen := os.Getenv("WRITE_QUEUE_LEN"); queueLen != "" {
+        config.Len, err = strconv.Atoi(queueLen)
+        if err != nil || config.Len < 1 {
+            return config, errors.New(fmt.Sprintf(
+                "Invalid WRITE_QUEUE_LEN %q", queueLen))
+        }
+    }
+
+    if timeout := os.Getenv("WRITE_TIMEOUT"); timeout != "" {
+        config.Timeout, err = time.ParseDuration(timeout)
+        if err != nil || config.Timeout <= 0 {
+            return config, errors.New(fmt.Sprintf(
+                "Invalid WRITE_TIMEOUT %q", timeout))
+        }
+    }
+
+    switch policy := os.Getenv("SLOW_CONSUMER_POLICY"); policy {
+    case "":
+    case SLOW_CONSUMER_DISCONNECT, SLOW_CONSUMER_DROP_OLDEST:
+        config.Policy = policy
+    default:
+        return config, errors.New(fmt.Sprintf(
+            "Unknown SLOW_CONSUMER_POLICY %q", policy))
+    }
+
+    return config, nil
+}
+
+// Return the deployed service's IDLE_TIMEOUT & PING_INTERVAL; an
+//    IDLE_TIMEOUT of 0 disables heartbeats
+func getHeartbeatConfig() (config HeartbeatConfig, err error) {
+    config = DefaultHeartbeatConfig()
+
+    if idleTimeout := os.Getenv("IDLE_TIMEOUT"); idleTimeout != "" {
+        config.IdleTimeout, err = time.ParseDuration(idleTimeout)
+        if err != nil || config.IdleTimeout < 0 {
+            return config, errors.New(fmt.Sprintf(
+                "Invalid IDLE_TIMEOUT %q", idleTimeout))
+        }
+        config.PingInterval = config.IdleTimeout / 3
+    }
+
+    if pingInterval := os.Getenv("PING_INTERVAL"); pingInterval != "" {
+        config.PingInterval, err = time.ParseDuration(pingInterval)
+        if err != nil || config.PingInterval <= 0 {
+            return config, errors.New(fmt.Sprintf(
+                "Invalid PING_INTERVAL %q", pingInterval))
+        }
+    }
+
+    if config.Enabled() && config.PingInterval >= config.IdleTimeout {
+        return config, errors.New(fmt.Sprintf(
+            "PING_INTERVAL (%v) must be shorter than IDLE_TIMEOUT (%v)",
+            config.PingInterval, config.IdleTimeout))
+    }
+    return config, nil
+}
+
+// Return the deployed service's TEXT_RATE & TEXT_BURST (per Client),
+//    USER_TEXT_RATE & USER_TEXT_BURST (per user), MUTE_DURATION &
+//    RATE_LIMIT_CONFIG, a path to per-Server & per-Community overrides
+func getRateLimitConfig() (config RateLimitConfig, err error) {
+    config = DefaultRateLimitConfig()
+
+    config.Text, err = getRateLimit("TEXT_RATE", "TEXT_BURST", config.Text)
+    if err != nil {
+        return config, err
+    }
+    config.UserText, err = getRateLimit("USER_TEXT_RATE", "USER_TEXT_BURST",
+        config.UserText)
+    if err != nil {
+        return config, err
+    }
+
+    if mute := os.Getenv("MUTE_DURATION"); mute != "" {
+        config.MuteDuration, err = time.ParseDuration(mute)
+        if err != nil || config.MuteDuration < 0 {
+            return config, errors.New(fmt.Sprintf(
+                "Invalid MUTE_DURATION %q", mute))
+        }
+    }
+
+    if path := os.Getenv("RATE_LIMIT_CONFIG"); path != "" {
+        if err = config.LoadOverrides(path); err != nil {
+            return config, err
+        }
+    }
+    return config, nil
+}
+
+// Return the RateLimit in env variables rateVar & burstVar; either falls
+//    back to limit's if unset
+func getRateLimit(rateVar string, burstVar string, limit RateLimit) (
+    RateLimit, error) {
+    rate, burst := os.Getenv(rateVar), os.Getenv(burstVar)
+    if rate == "" {
+        rate = strconv.FormatFloat(limit.Rate, 'g', -1, 64)
+    }
+    if burst == "" {
+        burst = strconv.Itoa(limit.Burst)
+    }
+
+    limit, err := ParseRateLimit(rate, burst)
+    if err != nil {
+        return limit, errors.New(fmt.Sprintf(
+            "Invalid %s/%s: %v", rateVar, burstVar, err))
+    }
+    return limit, nil
+}
+
+// Return the deployed service's MAX_TEXT_LEN (in characters; 0 is
+//    unlimited) & MODERATION_CONFIG, a path to word & regex filters
+func getModerationConfig() (config ModerationConfig, err error) {
+    config = DefaultModerationConfig()
+
+    if maxLen := os.Getenv("MAX_TEXT_LEN"); maxLen != "" {
+        config.MaxLen, err = strconv.Atoi(maxLen)
+        if err != nil || config.MaxLen < 0 {
+            return config, errors.New(fmt.Sprintf(
+                "Invalid MAX_TEXT_LEN %q", maxLen))
+        }
+    }
+
+    if path := os.Getenv("MODERATION_CONFIG"); path != "" {
+        if err = config.LoadRules(path); err != nil {
+            return config, err
+        }
+    }
+    return config, nil
+}
+
+// Return the deployed service's SESSION_GRACE, how long a disconnected
+//    Client's session may be resumed for; 0 disables sessions
+func getSessionGrace() (time.Duration, error) {
+    grace, ok := os.LookupEnv("SESSION_GRACE")
+    if !ok || grace == "" {
+        return DEFAULT_SESSION_GRACE, nil
+    }
+    d, err := time.ParseDuration(grace)
+    if err != nil || d < 0 || d / time.Millisecond > math.MaxUint32 {
+        return 0, errors.New(fmt.Sprintf(
+            "Invalid SESSION_GRACE %q", grace))
+    }
+    return d, nil
+}
+
+// Return the deployed service's CLUSTER_CONFIG, the path to its cluster's
+//    node & region owner table; ok is false if unset (a single node)
+func getClusterConfig() (path string, ok bool) {
+    path, ok = os.LookupEnv("CLUSTER_CONFIG")
+    return path, ok && path != ""
+}
+
+// Return the deployed service's NODE_ID, its node in CLUSTER_CONFIG
+func getNodeID() (string, error) {
+    nodeID, ok := os.LookupEnv("NODE_ID")
+    if !ok || nodeID == "" {
+        return "", errors.New("Missing/empty NODE_ID")
+    }
+    return nodeID, nil
+}
+
+// Return the deployed service's CLUSTER_BUS, how its nodes are connected;
+//    defaults to tcp
+func getClusterBus() (string, error) {
+    switch bus := os.Getenv("CLUSTER_BUS"); bus {
+    case "", CLUSTER_BUS_TCP:
+        return CLUSTER_BUS_TCP, nil
+    case CLUSTER_BUS_INPROC:
+        return bus, nil
+    default:
+        return "", errors.New(fmt.Sprintf("Invalid CLUSTER_BUS %q", bus))
+    }
+}
+
+// Return the deployed service's CLUSTER_SECRET, which the nodes of a
+//    CLUSTER_BUS=tcp cluster authenticate each other w/
+func getClusterSecret() ([]byte, error) {
+    secret, ok := os.LookupEnv("CLUSTER_SECRET")
+    if !ok || secret == "" {
+        return nil, errors.New("Missing/empty CLUSTER_SECRET")
+    }
+    return []byte(secret), nil
+}
+
+// Return the deployed service's SHUTDOWN_TIMEOUT, the longest Clients
+//    are given to drain before being force-closed
+func getShutdownTimeout() (time.Duration, error) {
+    timeout, ok := os.LookupEnv("SHUTDOWN_TIMEOUT")
+    if !ok || timeout == "" {
+        return DEFAULT_SHUTDOWN_TIMEOUT, nil
+    }
+    d, err := time.ParseDuration(timeout)
+    if err != nil || d < 0 {
+        return 0, errors.New(fmt.Sprintf(
+            "Invalid SHUTDOWN_TIMEOUT %q", timeout))
+    }
+    return d, nil
+}
+
+// Return the deployed service's TLS_CERT_FILE & TLS_KEY_FILE; ok is
+//    false if neither is set (plaintext TCP)
+func getTLSFiles() (certFile string, keyFile string, ok bool, err error) {
+    certFile = os.Getenv("TLS_CERT_FILE")
+    keyFile = os.Getenv("TLS_KEY_FILE")
+    if certFile == "" && keyFile == "" {
+        return "", "", false, nil
+    }
+    if certFile == "" || keyFile == "" {
+        return "", "", false, errors.New(
+            "TLS_CERT_FILE & TLS_KEY_FILE must be set together")
+    }
+    return certFile, keyFile, true, nil
+}
+
+// Return the deployed service's TLS_CLIENT_CA_FILE & TLS_CLIENT_AUTH,
+//    which enable mutual TLS; either may be empty
+func getTLSClientAuth() (clientCAFile string, clientAuth string) {
+    return os.Getenv("TLS_CLIENT_CA_FILE"), os.Getenv("TLS_CLIENT_AUTH")
+}
+
+// Return the deployed service's AUTH_MODE; defaults to "none"
+func getAuthMode() string {
+    mode, ok := os.LookupEnv("AUTH_MODE")
+    if !ok || mode == "" {
+        return AUTH_MODE_NONE
+    }
+    return mode
+}
+
+// Builds the Authenticator described by AUTH_MODE & its AUTH_X env
+//    variables; nil if AUTH_MODE is none
+func newAuthenticator() (auth Authenticator, err error) {
+    switch mode := getAuthMode(); mode {
+    case AUTH_MODE_NONE:
+        slog.Warn("AUTH_MODE is none; trusting Client-sent IDs")
+        return nil, nil
+    case AUTH_MODE_JWT:
+        a, err := NewHMACJWTAuthenticator(
+            []byte(os.Getenv("AUTH_JWT_SECRET")),
+            os.Getenv("AUTH_JWT_ISSUER"),
+            os.Getenv("AUTH_JWT_AUDIENCE"))
+        if err != nil {
+            return nil, err
+        }
+        return a, nil
+    case AUTH_MODE_REMOTE:
+        url := os.Getenv("AUTH_VERIFY_URL")
+        if url == "" {
+            return nil, errors.New("Missing/empty AUTH_VERIFY_URL")
+        }
+        return NewRemoteAuthenticator(url), nil
+    default:
+        return nil, errors.New(fmt.Sprintf("Unknown AUTH_MODE %q", mode))
+    }
+}
+
+// Builds the stderr logger described by LOG_LEVEL & LOG_FORMAT
+func newRootLogger() (*slog.Logger, error) {
+    level, format := getLogConfig()
+    return NewLogger(os.Stderr, level, format)
+}
+
+// Builds the HistoryConfig described by HISTORY_DIR & HISTORY_REPLAY_LEN
+func newHistoryConfig(subdir string) (history HistoryConfig, err error) {
+    history.ReplayLen, err = getHistoryReplayLen()
+    if err != nil {
+        return history, err
+    }
+
+    dir, ok := getHistoryDir()
+    if !ok {
+        slog.Info("No HISTORY_DIR; keeping Community history in memory")
+        history.Store = NewMemoryStore()
+        return history, nil
+    }
+
+    history.Store, err = NewFileStore(filepath.Join(dir, subdir))
+    return history, err
+}
+
+// Builds the TLSReloader described by the TLS_X env variables; nil if
+//    TLS is disabled
+func newTLSReloader() (r *TLSReloader, err error) {
+    certFile, keyFile, ok, err := getTLSFiles()
+    if err != nil {
+        return nil, err
+    } else if !ok {
+        slog.Info("No TLS_CERT_FILE; serving plaintext TCP")
+        return nil, nil
+    }
+
+    clientCAFile, clientAuth := getTLSClientAuth()
+    r, err = NewTLSReloader(certFile, keyFile, clientCAFile, clientAuth)
+    if err != nil {
+        return nil, err
+    }
+
+    if clientCAFile != "" {
+        slog.Info("Serving TLS w/ client certs",
+            "client_auth", r.ClientAuth, "client_ca_file", clientCAFile)
+    } else {
+        slog.Info("Serving TLS")
+    }
+    return r, nil
+}
+
+// Builds the RegionResolver described by REGION_CONFIG & DEFAULT_REGION
+func newRegionResolver() (r RegionResolver, err error) {
+    defaultRegion := getDefaultRegion()
+
+    path, ok := getRegionConfig()
+    if !ok {
+        slog.Info("No REGION_CONFIG; routing all Clients to 1 region",
+            "region", defaultRegion)
+        return NewCIDRResolver(defaultRegion), nil
+    }
+
+    cr, err := LoadCIDRResolver(path, defaultRegion)
+    if err != nil {
+        return nil, err
+    }
+    return cr, nil
+}
+
+// Builds the Cluster described by CLUSTER_CONFIG, CLUSTER_BUS &
+//    CLUSTER_SECRET, as seen by this process's NODE_ID or, if set, by
+//    in-process peer node peerID
+func newCluster(peerID string) (cl *Cluster, err error) {
+    path, ok := getClusterConfig()
+    if !ok {
+        return NewCluster(DEFAULT_NODE_ID), nil
+    }
+
+    nodeID := peerID
+    if nodeID == "" {
+        if nodeID, err = getNodeID(); err != nil {
+            return nil, err
+        }
+    }
+    busKind, err := getClusterBus()
+    if err != nil {
+        return nil, err
+    }
+
+    cl, err = LoadCluster(path, nodeID)
+    if err != nil {
+        return nil, err
+    }
+
+    switch busKind {
+    case CLUSTER_BUS_INPROC:
+        cl.bus = inProcNetwork.Bus(nodeID)
+    case CLUSTER_BUS_TCP:
+        var secret []byte
+        if secret, err = getClusterSecret(); err != nil {
+            return nil, err
+        }
+        cl.bus, err = NewTCPBus(nodeID, cl.busAddrs(), secret)
+    }
+    return cl, err
+}
+
+// ctor private, accessible to main only; peerID is empty for this
+//    process's own node, or another node of a CLUSTER_BUS=inproc cluster,
+//    which listens on its ClientAddr & serves no WebSocket Clients
+func newServerWrapper(peerID string) (sw *ServerWrapper, err error) {
     sw = new(ServerWrapper)
     sw.Servers = make(map[string]*Server)
+    sw.directory = make(map[uint32]*Client)
     sw.done = make(chan bool)
 
+    sw.cluster, err = newCluster(peerID)
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to load cluster config: %v", err))
+    }
+    if sw.cluster.bus != nil {
+        slog.Info("Joining cluster", "node_id", sw.cluster.NodeID,
+            "nodes", len(sw.cluster.Nodes))
+    }
+
+    sw.ids = NewIDTable(sw.cluster.NodeIndex())
+
+    sw.resolver, err = newRegionResolver()
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to load region config: %v", err))
+    }
+
+    sw.auth, err = newAuthenticator()
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to set up auth: %v", err))
+    }
+
+    // in-process peers keep their history apart
+    sw.history, err = newHistoryConfig(peerID)
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to set up message history: %v", err))
+    }
+
+    sw.writeQueue, err = getWriteQueueConfig()
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to set up write queues: %v", err))
+    }
+    slog.Info("Write queues configured", "len", sw.writeQueue.Len,
+        "timeout", sw.writeQueue.Timeout, "policy", sw.writeQueue.Policy)
+
+    sw.heartbeat, err = getHeartbeatConfig()
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to set up heartbeats: %v", err))
+    }
+    if sw.heartbeat.Enabled() {
+        slog.Info("Heartbeats configured",
+            "idle_timeout", sw.heartbeat.IdleTimeout,
+            "ping_interval", sw.heartbeat.PingInterval)
+    } else {
+        slog.Warn("IDLE_TIMEOUT is 0; idle Clients are never disconnected")
+    }
+
+    sw.rateLimits, err = getRateLimitConfig()
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to set up rate limits: %v", err))
+    }
+    sw.flood = NewFloodGuard(sw.rateLimits)
+    slog.Info("Text rate limits configured",
+        "rate", sw.rateLimits.Text.Rate, "burst", sw.rateLimits.Text.Burst,
+        "user_rate", sw.rateLimits.UserText.Rate,
+        "user_burst", sw.rateLimits.UserText.Burst,
+        "mute_duration", sw.rateLimits.MuteDuration)
+
+    sw.moderation, err = getModerationConfig()
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to set up moderation: %v", err))
+    }
+
+    sessionGrace, err := getSessionGrace()
+    if (err != nil) {
+        return nil, err
+    }
+    sw.sessions = NewSessionStore(sessionGrace)
+    if !sw.sessions.Enabled() {
+        slog.Info("SESSION_GRACE is 0; sessions can't be resumed")
+    }
+
+    sw.shutdownTimeout, err = getShutdownTimeout()
+    if (err != nil) {
+        return nil, err
+    }
+
     hostName, err := getHostIP()
     if (err != nil) {
         return nil, errors.New(fmt.Sprintf(
@@ -63,22 +586,55 @@ func newServerWrapper() (sw *ServerWrapper, err error) {
         return nil, errors.New(fmt.Sprintf(
             "Unable to fetch server's tcp port: %v", err))
     }
-    serverAddr, err := net.ResolveTCPAddr("tcp", hostName + ":" + tcpPort)
+    listenAddr := hostName + ":" + tcpPort
+    if peerID != "" {
+        node, _ := sw.cluster.Node(peerID)
+        listenAddr = node.ClientAddr
+    }
+    serverAddr, err := net.ResolveTCPAddr("tcp", listenAddr)
     if (err != nil) {
         return nil, errors.New(fmt.Sprintf(
             "Unable to resolve server's tcp address: %v", err))
     }
 
+    tlsReloader, err := newTLSReloader()
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to load TLS config: %v", err))
+    }
+
     // setup listener for incoming TCP connections
-    // net.ListenTCP("tcp", )
     sw.tcpl, err = net.ListenTCP("tcp", serverAddr)
     if err != nil {
         return nil, errors.New(fmt.Sprintf(
             "Unable to listen on TCP addr %s: %v",
             serverAddr, err))
     }
+    if tlsReloader != nil {
+        sw.tcpl = tls.NewListener(sw.tcpl, tlsReloader.ListenerConfig())
+    }
+
+    // setup listener for incoming WebSocket connections, w/ the same TLS
+    if wsPort, ok := getWSPort(); ok && peerID == "" {
+        sw.wsl, err = net.Listen("tcp", hostName + ":" + wsPort)
+        if err != nil {
+            sw.tcpl.Close()
+            return nil, errors.New(fmt.Sprintf(
+                "Unable to listen on WebSocket addr %s:%s: %v",
+                hostName, wsPort, err))
+        }
+        if tlsReloader != nil {
+            sw.wsl = tls.NewListener(sw.wsl, tlsReloader.ListenerConfig())
+        }
+        // an upgrade request gets as long as a TCP Client's TLS handshake,
+        //    so slow headers can't hold conns open indefinitely
+        sw.wsServer = &http.Server{
+            Handler:            sw.wsRoutes(),
+            ReadHeaderTimeout:  AUTH_TIMEOUT,
+        }
+    }
     // err = server.tcpl.SetTimeout(1e9) ...
-    sw.connChan = make(chan *net.Conn)
+    sw.connChan = make(chan ClientConn)
     sw.caChan = make(chan *ClientAction)
 
     sw.running = true
@@ -86,22 +642,125 @@ func newServerWrapper() (sw *ServerWrapper, err error) {
     return // sw, nil
 }
 
+// The ServerWrappers of the other nodes of a CLUSTER_BUS=inproc cluster,
+//    run in this process next to sw; none for any other cluster
+func newInProcPeers(sw *ServerWrapper) (peers []*ServerWrapper, err error) {
+    if _, ok := sw.cluster.bus.(*InProcBus); !ok {
+        return nil, nil
+    }
+
+    for _, node := range sw.cluster.Nodes {
+        if node.ID == sw.cluster.NodeID {
+            continue
+        }
+        peer, err := newServerWrapper(node.ID)
+        if err != nil {
+            for _, p := range peers {
+                p.Shutdown() // ignoring errors
+            }
+            return nil, errors.New(fmt.Sprintf(
+                "Unable to create node %s: %v", node.ID, err))
+        }
+        peers = append(peers, peer)
+    }
+    return peers, nil
+}
+
+// ctor private, accessible to main only
+func newAPIServer(sw *ServerWrapper) (api *APIServer, err error) {
+    api = new(APIServer)
+    api.sw = sw
+    api.ShutdownChan = make(chan bool)
+
+    hostName, err := getHostIP()
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to fetch server's public ip: %v", err))
+    }
+    apiPort, err := getAPIPort()
+    if (err != nil) {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to fetch server's api port: %v", err))
+    }
+
+    if token, ok := getAPIToken(); ok {
+        api.token = []byte(token)
+    } else {
+        // the API can kick Clients & shut the server down, so w/o a token
+        //    it's only reachable from this host
+        slog.Warn("API_TOKEN unset, binding the API to loopback only",
+            "addr", API_LOOPBACK_HOST)
+        hostName = API_LOOPBACK_HOST
+    }
+
+    api.listener, err = net.Listen("tcp", hostName + ":" + apiPort)
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf(
+            "Unable to listen on API addr %s:%s: %v",
+            hostName, apiPort, err))
+    }
+    api.httpServer = &http.Server{Handler: api.routes()}
+
+    return // api, nil
+}
+
 func main() {
-    sw, err := newServerWrapper()
+    logger, err := newRootLogger()
     if err != nil {
-        log.Fatalf("Failed to create ServerWrapper: %v\n", err)
+        fatal(slog.Default(), "Failed to set up logging", "err", err)
+    }
+    slog.SetDefault(logger) // also routes the log package through logger
+
+    sw, err := newServerWrapper("")
+    if err != nil {
+        fatal(slog.Default(), "Failed to create ServerWrapper", "err", err)
     }
     defer func() {
         err := sw.Shutdown()
         if err != nil {
-            log.Printf("Error shutting down servers: %v\n", err)
+            slog.Error("Error shutting down servers", "err", err)
+        }
+    }()
+
+    peers, err := newInProcPeers(sw)
+    if err != nil {
+        fatal(slog.Default(), "Failed to create cluster peers", "err", err)
+    }
+    for _, peer := range peers {
+        defer func(peer *ServerWrapper) {
+            err := peer.Shutdown()
+            if err != nil {
+                slog.Error("Error shutting down peer", "node_id",
+                    peer.cluster.NodeID, "err", err)
+            }
+        }(peer)
+    }
+
+    api, err := newAPIServer(sw)
+    if err != nil {
+        fatal(slog.Default(), "Failed to create APIServer", "err", err)
+    }
+    defer func() {
+        err := api.Shutdown()
+        if err != nil {
+            slog.Error("Error shutting down API server", "err", err)
         }
     }()
+    go api.Serve()
+
+    if err = sw.Start(); err != nil {
+        fatal(slog.Default(), "Failed to start ServerWrapper", "err", err)
+    }
+    for _, peer := range peers {
+        if err = peer.Start(); err != nil {
+            fatal(slog.Default(), "Failed to start cluster peer",
+                "node_id", peer.cluster.NodeID, "err", err)
+        }
+    }
 
-    sw.loopWG.Add(3)
-    go sw.acceptLoop()
-    go sw.clientBuilderLoop()
-    go sw.controlLoop()
+    // SIGTERM is sent by `docker stop`
+    sigChan := make(chan os.Signal, 1)
+    signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
 
     stdinChan := make(chan string)
     go func(stdinChan chan string) {
@@ -118,7 +777,12 @@ func main() {
     }(stdinChan)
     select {
     case <-stdinChan:
-        log.Println("MANUAL SERVER TERMINATION INPUTTED")
+        slog.Info("Manual termination entered on stdin")
         // TODO: listen for manual shutdown (keystroke?)
+    case <-api.ShutdownChan:
+        slog.Info("Termination requested through the API")
+    case sig := <-sigChan:
+        slog.Info("Received signal; shutting down", "signal", sig.String())
     }
+    signal.Stop(sigChan) // a 2nd signal kills the process w/o draining
 }
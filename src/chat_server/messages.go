@@ -3,9 +3,16 @@ package main
 import(
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
 )
 
 // Message types
+// NOTE: values are part of the wire protocol (see PROTOCOL.md); only
+//       ever append new types
 const (
 	// Server client auth request
 	MTypeClientAuth uint8 = iota
@@ -14,6 +21,73 @@ const (
 	MTypeClientName
 	// Client TCP text message
 	MTypeClientText
+	// Client Community requests
+	MTypeJoinComm
+	MTypeLeaveComm
+	// Server responses to Client requests
+	MTypeCommJoined
+	MTypeError
+	// Optional Client auth response requesting a region Server
+	MTypeClientRegion
+	// Capability negotiation (both directions)
+	MTypeCapabilities
+	// Community membership notifications
+	MTypeUserLeft
+	// Community message history
+	MTypeHistoryRequest
+	MTypeHistory
+	// Client auth response carrying a bearer token
+	MTypeClientToken
+	// Direct (private) text between 2 Clients
+	MTypeDirectText
+	MTypeDirectAck
+	// Community presence (see also MTypeUserLeft)
+	MTypeRoster
+	MTypeUserJoined
+	MTypeUserRenamed
+	// Heartbeats (both directions); a MsgPing is answered w/ a MsgPong
+	MTypePing
+	MTypePong
+	// Sent to every Client before the Server shuts down
+	MTypeServerShutdown
+	// Community text w/ a Client nonce, acked w/ the message ID it's
+	// assigned; relayed as MsgCommText to CapMessageIDs members
+	MTypeSendText
+	MTypeSendAck
+	MTypeCommText
+	// Session resumption; MsgSession is sent after auth & MsgResume
+	// takes the place of the auth responses on a new connection
+	MTypeSession
+	MTypeResume
+	// Sent to a CapRedirect Client whose region is owned by another node
+	MTypeRedirect
+)
+
+// MsgDirectAck statuses
+const (
+	DirectDelivered uint8 = iota
+	DirectOffline
+)
+
+// MsgError codes
+const (
+	ECodeJoinComm uint8 = iota + 1
+	// protocol violations; the Client is disconnected after these
+	ECodeUnsupportedVersion
+	ECodeUnknownMsgType
+	ECodeMalformedMsg
+	ECodeFrameTooLarge
+	ECodeAuth
+	// a post-auth MsgClientName had an invalid name
+	ECodeRename
+	// a MsgClientText was dropped for exceeding a rate limit
+	ECodeRateLimited
+	// the Client's user was muted (or disconnected) for flooding
+	ECodeMuted
+	// a MsgClientText was rejected by its Community's ModerationChain
+	ECodeModeration
+	// a MsgResume's session is unknown or expired; auth continues as usual
+	ECodeResume
 )
 
 type Message struct {
@@ -21,11 +95,190 @@ type Message struct {
 	Data 		interface{}
 }
 
+// Every Message.Data type encodes its payload w/ MarshalBinary() (value
+// receiver) & decodes it w/ UnmarshalBinary() (pointer receiver), such
+// that decoding an encoded payload yields an identical value
+type MsgData interface {
+	MarshalBinary() (bin []byte, err error)
+}
+
+// Sent by the Server to request the Client's identity, advertising the
+// Server's protocol version & capabilities
+type MsgClientAuth struct {
+	Version		uint8
+	Caps		uint32
+}
+
+// Client auth responses to a MsgClientAuth
+type MsgClientID struct {
+	ID			uint32
+}
+
+type MsgClientName struct {
+	Name		string
+}
+
+// Sent instead of a MsgClientID when the Server verifies tokens
+type MsgClientToken struct {
+	Token		string
+}
+
+type MsgClientRegion struct {
+	ServerID	string
+}
+
 type MsgClientText struct {
+	ClientID	uint32
+	TextBytes	[]byte // checked by the Community's ModerationChain
+}
+
+// Sent by a Client to the Client w/ ID ClientID; relayed w/ ClientID set
+// to the sender's ID
+type MsgDirectText struct {
 	ClientID	uint32
 	TextBytes	[]byte
-	// TODO: actually parse TextBytes into a string
-	//       in order to perform word checks, etc.
+}
+
+// Tells the sender of a MsgDirectText to ClientID whether it was
+// delivered (one of the DirectX statuses)
+type MsgDirectAck struct {
+	ClientID	uint32
+	Status		uint8
+}
+
+// Request to move into the Community w/ ID CommID
+type MsgJoinComm struct {
+	CommID		string
+}
+
+// Request to move back into the root Community; carries no data
+type MsgLeaveComm struct {}
+
+// Confirms the Client is now in the Community w/ ID CommID
+type MsgCommJoined struct {
+	CommID		string
+}
+
+// Reports a failed Client request
+type MsgError struct {
+	Code		uint8
+	Text		string
+}
+
+// Sent by a Client w/ the capabilities it supports; the Server replies
+// w/ the capabilities both sides support
+type MsgCapabilities struct {
+	Caps		uint32
+}
+
+// Notifies Community members that a Client has left it
+type MsgUserLeft struct {
+	ClientID	uint32
+	Name		string
+}
+
+// A member of a Community in a MsgRoster
+type RosterEntry struct {
+	ClientID	uint32	`json:"id"`
+	Name		string	`json:"name"`
+}
+
+// A snapshot of the Community w/ ID CommID's members, sent on joining it;
+// More is set on all but the last MsgRoster of a snapshot
+type MsgRoster struct {
+	CommID		string
+	More		bool
+	Members		[]RosterEntry
+}
+
+// Notifies Community members that a Client has joined it
+type MsgUserJoined struct {
+	ClientID	uint32
+	Name		string
+}
+
+// Notifies Community members that a member has changed its name
+type MsgUserRenamed struct {
+	ClientID	uint32
+	Name		string
+}
+
+// Heartbeat checking that the peer is still reachable; the receiver
+// echoes Nonce back in a MsgPong
+type MsgPing struct {
+	Nonce		uint64
+}
+
+type MsgPong struct {
+	Nonce		uint64
+}
+
+// Tells a Client the Server is going away; it should reconnect after
+// ReconnectAfter milliseconds, which is spread across Clients
+type MsgServerShutdown struct {
+	ReconnectAfter	uint32
+	Reason			string
+}
+
+// A MsgClientText the sender wants acked w/ Nonce (chosen by the Client)
+type MsgSendText struct {
+	Nonce		uint64
+	TextBytes	[]byte // checked by the Community's ModerationChain
+}
+
+// Answers a MsgSendText; a Code of 0 means the text was accepted &
+// relayed as MsgID, otherwise Code is the ECodeX it was dropped w/ & the
+// other fields are 0
+type MsgSendAck struct {
+	Nonce		uint64
+	Code		uint8
+	MsgID		uint64
+	Seq			uint64 // in the Community's history; 0 if unrecorded
+	Time		time.Time // when the Server accepted the text
+}
+
+// A Community member's text, relayed w/ the fields of its MsgSendAck
+type MsgCommText struct {
+	ClientID	uint32
+	MsgID		uint64
+	Seq			uint64
+	Time		time.Time
+	TextBytes	[]byte
+}
+
+// Token resumes the Client's session on a new connection w/in Grace
+// milliseconds of this one dropping
+type MsgSession struct {
+	Token		string
+	Grace		uint32
+}
+
+// Sent during auth instead of the auth responses to resume the session
+// w/ Token; LastSeq is the highest Seq received in the Client's Community
+// (0 to replay history as for a fresh join)
+type MsgResume struct {
+	LastSeq		uint64
+	Token		string
+}
+
+// Tells the Client to reconnect to Addr (host:port), the node owning
+// region ServerID; the connection is then closed
+type MsgRedirect struct {
+	ServerID	string
+	Addr		string
+}
+
+// Requests up to Count of the newest history entries w/ Seq < BeforeSeq
+// from the Client's Community; a BeforeSeq of 0 requests the newest
+type MsgHistoryRequest struct {
+	BeforeSeq	uint64
+	Count		uint16
+}
+
+// History entries of the Community w/ ID CommID, oldest first
+type MsgHistory struct {
+	CommID		string
+	Entries		[]HistoryEntry
 }
 
 func (msg Message) TypeToString() string {
@@ -38,119 +291,825 @@ func (msg Message) TypeToString() string {
 		return "MTypeClientName"
 	case MTypeClientText:
 		return "MTypeClientText"
+	case MTypeJoinComm:
+		return "MTypeJoinComm"
+	case MTypeLeaveComm:
+		return "MTypeLeaveComm"
+	case MTypeCommJoined:
+		return "MTypeCommJoined"
+	case MTypeError:
+		return "MTypeError"
+	case MTypeClientRegion:
+		return "MTypeClientRegion"
+	case MTypeCapabilities:
+		return "MTypeCapabilities"
+	case MTypeUserLeft:
+		return "MTypeUserLeft"
+	case MTypeHistoryRequest:
+		return "MTypeHistoryRequest"
+	case MTypeHistory:
+		return "MTypeHistory"
+	case MTypeClientToken:
+		return "MTypeClientToken"
+	case MTypeDirectText:
+		return "MTypeDirectText"
+	case MTypeDirectAck:
+		return "MTypeDirectAck"
+	case MTypeRoster:
+		return "MTypeRoster"
+	case MTypeUserJoined:
+		return "MTypeUserJoined"
+	case MTypeUserRenamed:
+		return "MTypeUserRenamed"
+	case MTypePing:
+		return "MTypePing"
+	case MTypePong:
+		return "MTypePong"
+	case MTypeServerShutdown:
+		return "MTypeServerShutdown"
+	case MTypeSendText:
+		return "MTypeSendText"
+	case MTypeSendAck:
+		return "MTypeSendAck"
+	case MTypeCommText:
+		return "MTypeCommText"
+	case MTypeSession:
+		return "MTypeSession"
+	case MTypeResume:
+		return "MTypeResume"
+	case MTypeRedirect:
+		return "MTypeRedirect"
 	}
-	panic("TypeToString(): unknown Message type.")
+	return fmt.Sprintf("MTypeUnknown(%v)", msg.Type)
 }
 
 // WRITING
-// returns the raw binary bit data of msg.Data
+// returns the raw binary bit data of msg.Data (the frame payload)
 func (msg *Message) ToBinary() (msgBytes []byte, err error) {
+	data, ok := msg.Data.(MsgData)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf(
+			"No binary encoding for %s data %T",
+			msg.TypeToString(), msg.Data))
+	}
+
+	return data.MarshalBinary()
+}
+
+// bit pattern: 8, 32
+//    - 8: Version (uint8)
+//    - 32: Caps (uint32)
+func (data MsgClientAuth) MarshalBinary() (bin []byte, err error) {
 	buf := new(bytes.Buffer)
 
-	// 1st: write message type to buf
-	err = binary.Write(buf, binary.BigEndian, msg.Type)
+	err = binary.Write(buf, binary.BigEndian, data.Version)
 	if err != nil {
 		return nil, err
 	}
+	err = binary.Write(buf, binary.BigEndian, data.Caps)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bit pattern: 32
+//    - 32: ID (uint32)
+func (data MsgClientID) MarshalBinary() (bin []byte, err error) {
+	buf := new(bytes.Buffer)
 
-	// 2nd: write message data w/ specific format to buf
-	// note: first 32 bits (uint32) should be length of remaining msg
-	bin, err := msg.handleDataToBinary()
+	err = binary.Write(buf, binary.BigEndian, data.ID)
 	if err != nil {
 		return nil, err
 	}
-	_, err = buf.Write(bin)
+
+	return buf.Bytes(), nil
+}
+
+// bit pattern: len(data.Name)
+//    - len(data.Name): UTF-8 encoded Name
+func (data MsgClientName) MarshalBinary() (bin []byte, err error) {
+	return []byte(data.Name), nil
+}
+
+// bit pattern: len(data.Token)
+//    - len(data.Token): UTF-8 encoded Token
+func (data MsgClientToken) MarshalBinary() (bin []byte, err error) {
+	return []byte(data.Token), nil
+}
+
+// bit pattern: len(data.ServerID)
+//    - len(data.ServerID): UTF-8 encoded ServerID
+func (data MsgClientRegion) MarshalBinary() (bin []byte, err error) {
+	return []byte(data.ServerID), nil
+}
+
+// bit pattern: 32, len(data.TextBytes)
+//    - 32: ClientID (uint32)
+//    - len(data.TextBytes): TextBytes
+func (data MsgClientText) MarshalBinary() (bin []byte, err error) {
+	buf := new(bytes.Buffer)
+
+	err = binary.Write(buf, binary.BigEndian, data.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.Write(data.TextBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	msgBytes = buf.Bytes()
-	return // msgBytes, nil
+	return buf.Bytes(), nil
 }
 
-// first 32 bits (uint32) of buf should ALWAYS be the length of the
-// following (binary-encoded) message
-func (msg *Message) handleDataToBinary() (bin []byte, err error) {
-	switch msg.Data.(type) {
-	case MsgClientText:
-		bin, err = dataToBinary(msg.Data.(MsgClientText))
-	default:
-		panic("handleDataToBinary(): unknown Message type.")
+// bit pattern: 32, len(data.TextBytes)
+//    - 32: ClientID (uint32)
+//    - len(data.TextBytes): TextBytes
+func (data MsgDirectText) MarshalBinary() (bin []byte, err error) {
+	return MsgClientText{data.ClientID, data.TextBytes}.MarshalBinary()
+}
+
+// bit pattern: 32, 8
+//    - 32: ClientID (uint32)
+//    - 8: Status (uint8)
+func (data MsgDirectAck) MarshalBinary() (bin []byte, err error) {
+	buf := new(bytes.Buffer)
+
+	err = binary.Write(buf, binary.BigEndian, data.ClientID)
+	if err != nil {
+		return nil, err
 	}
+	err = binary.Write(buf, binary.BigEndian, data.Status)
 	if err != nil {
 		return nil, err
 	}
 
-	return // bin, nil
+	return buf.Bytes(), nil
+}
+
+// bit pattern: len(data.CommID)
+//    - len(data.CommID): UTF-8 encoded CommID
+func (data MsgJoinComm) MarshalBinary() (bin []byte, err error) {
+	return []byte(data.CommID), nil
+}
+
+// bit pattern: (empty)
+func (data MsgLeaveComm) MarshalBinary() (bin []byte, err error) {
+	return []byte{}, nil
+}
+
+// bit pattern: len(data.CommID)
+//    - len(data.CommID): UTF-8 encoded CommID
+func (data MsgCommJoined) MarshalBinary() (bin []byte, err error) {
+	return []byte(data.CommID), nil
 }
 
-// bit pattern: 32, 16, len(data.TextBytes)
-//    - 32: length of following message
-//    - 32: ClientID (uint16)
-//    - len(data.TextBytes): data.TextBytes
-func dataToBinary(data MsgClientText) (dataBytes []byte, err error) {
+// bit pattern: 8, len(data.Text)
+//    - 8: Code (uint8)
+//    - len(data.Text): UTF-8 encoded Text
+func (data MsgError) MarshalBinary() (bin []byte, err error) {
 	buf := new(bytes.Buffer)
-	dataBuf := new(bytes.Buffer)
 
-	err = binary.Write(dataBuf, binary.BigEndian, data.ClientID)
+	err = binary.Write(buf, binary.BigEndian, data.Code)
 	if err != nil {
 		return nil, err
 	}
-	_, err = dataBuf.Write(data.TextBytes)
+	_, err = buf.WriteString(data.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bit pattern: 32
+//    - 32: Caps (uint32)
+func (data MsgCapabilities) MarshalBinary() (bin []byte, err error) {
+	buf := new(bytes.Buffer)
+
+	err = binary.Write(buf, binary.BigEndian, data.Caps)
 	if err != nil {
 		return nil, err
 	}
 
-	bytes := dataBuf.Bytes()
-	err = binary.Write(buf, binary.BigEndian, uint32(len(bytes)))
+	return buf.Bytes(), nil
+}
+
+// bit pattern: 32, len(data.Name)
+//    - 32: ClientID (uint32)
+//    - len(data.Name): UTF-8 encoded Name
+func (data MsgUserLeft) MarshalBinary() (bin []byte, err error) {
+	buf := new(bytes.Buffer)
+
+	err = binary.Write(buf, binary.BigEndian, data.ClientID)
 	if err != nil {
 		return nil, err
 	}
-	_, err = buf.Write(bytes)
+	_, err = buf.WriteString(data.Name)
 	if err != nil {
 		return nil, err
 	}
 
-	dataBytes = buf.Bytes()
-	return // dataBytes, nil
+	return buf.Bytes(), nil
+}
+
+// bit pattern: 32, len(data.Name)
+//    - 32: ClientID (uint32)
+//    - len(data.Name): UTF-8 encoded Name
+func (data MsgUserJoined) MarshalBinary() (bin []byte, err error) {
+	return MsgUserLeft{data.ClientID, data.Name}.MarshalBinary()
+}
+
+// bit pattern: 32, len(data.Name)
+//    - 32: ClientID (uint32)
+//    - len(data.Name): UTF-8 encoded Name
+func (data MsgUserRenamed) MarshalBinary() (bin []byte, err error) {
+	return MsgUserLeft{data.ClientID, data.Name}.MarshalBinary()
+}
+
+// bit pattern: 64
+//    - 64: Nonce (uint64)
+func (data MsgPing) MarshalBinary() (bin []byte, err error) {
+	return binary.BigEndian.AppendUint64(nil, data.Nonce), nil
+}
+
+// bit pattern: 64
+//    - 64: Nonce (uint64)
+func (data MsgPong) MarshalBinary() (bin []byte, err error) {
+	return MsgPing{data.Nonce}.MarshalBinary()
+}
+
+// bit pattern: 32, len(data.Reason)
+//    - 32: ReconnectAfter (uint32, milliseconds)
+//    - len(data.Reason): UTF-8 encoded Reason
+func (data MsgServerShutdown) MarshalBinary() (bin []byte, err error) {
+	bin = binary.BigEndian.AppendUint32(nil, data.ReconnectAfter)
+	return append(bin, data.Reason...), nil
+}
+
+// bit pattern: 64, len(data.TextBytes)
+//    - 64: Nonce (uint64)
+//    - len(data.TextBytes): TextBytes
+func (data MsgSendText) MarshalBinary() (bin []byte, err error) {
+	bin = binary.BigEndian.AppendUint64(nil, data.Nonce)
+	return append(bin, data.TextBytes...), nil
+}
+
+// bit pattern: 64, 8, 64, 64, 64
+//    - 64: Nonce (uint64)
+//    - 8: Code (uint8)
+//    - 64: MsgID (uint64)
+//    - 64: Seq (uint64)
+//    - 64: Time in Unix milliseconds (int64; 0 unless accepted)
+func (data MsgSendAck) MarshalBinary() (bin []byte, err error) {
+	var timeMs int64
+	if data.Code == 0 {
+		timeMs = data.Time.UnixMilli()
+	}
+
+	bin = binary.BigEndian.AppendUint64(nil, data.Nonce)
+	bin = append(bin, data.Code)
+	bin = binary.BigEndian.AppendUint64(bin, data.MsgID)
+	bin = binary.BigEndian.AppendUint64(bin, data.Seq)
+	return binary.BigEndian.AppendUint64(bin, uint64(timeMs)), nil
+}
+
+// bit pattern: 32, 64, 64, 64, len(data.TextBytes)
+//    - 32: ClientID (uint32)
+//    - 64: MsgID (uint64)
+//    - 64: Seq (uint64)
+//    - 64: Time in Unix milliseconds (int64)
+//    - len(data.TextBytes): TextBytes
+func (data MsgCommText) MarshalBinary() (bin []byte, err error) {
+	bin = binary.BigEndian.AppendUint32(nil, data.ClientID)
+	bin = binary.BigEndian.AppendUint64(bin, data.MsgID)
+	bin = binary.BigEndian.AppendUint64(bin, data.Seq)
+	bin = binary.BigEndian.AppendUint64(bin, uint64(data.Time.UnixMilli()))
+	return append(bin, data.TextBytes...), nil
+}
+
+// bit pattern: 32, len(data.Token)
+//    - 32: Grace (uint32, milliseconds)
+//    - len(data.Token): UTF-8 encoded Token
+func (data MsgSession) MarshalBinary() (bin []byte, err error) {
+	bin = binary.BigEndian.AppendUint32(nil, data.Grace)
+	return append(bin, data.Token...), nil
+}
+
+// bit pattern: 64, len(data.Token)
+//    - 64: LastSeq (uint64)
+//    - len(data.Token): UTF-8 encoded Token
+func (data MsgResume) MarshalBinary() (bin []byte, err error) {
+	bin = binary.BigEndian.AppendUint64(nil, data.LastSeq)
+	return append(bin, data.Token...), nil
+}
+
+// bit pattern: 8, len(data.ServerID), len(data.Addr)
+//    - 8: length of ServerID (uint8)
+//    - len(data.ServerID): UTF-8 encoded ServerID
+//    - len(data.Addr): UTF-8 encoded Addr
+func (data MsgRedirect) MarshalBinary() (bin []byte, err error) {
+	if len(data.ServerID) > math.MaxUint8 {
+		return nil, errors.New(fmt.Sprintf(
+			"Server ID of %v bytes is too long", len(data.ServerID)))
+	}
+	bin = append([]byte{uint8(len(data.ServerID))}, data.ServerID...)
+	return append(bin, data.Addr...), nil
+}
+
+// Encoded size of an entry in a MsgRoster, excluding its Name
+const ROSTER_ENTRY_HEADER_LEN = 5 // bytes
+
+// bit pattern: 8, len(data.CommID), 8, 16, (32, 8, n)*
+//    - 8: len(data.CommID) (uint8)
+//    - len(data.CommID): UTF-8 encoded CommID
+//    - 8: More (uint8, 0 or 1)
+//    - 16: len(data.Members) (uint16)
+//    - then for each member:
+//        - 32: ClientID (uint32)
+//        - 8: len(Name) (uint8)
+//        - n: UTF-8 encoded Name
+func (data MsgRoster) MarshalBinary() (bin []byte, err error) {
+	if len(data.CommID) > math.MaxUint8 {
+		return nil, errors.New(fmt.Sprintf(
+			"Comm ID of %v bytes is too long", len(data.CommID)))
+	}
+	if len(data.Members) > math.MaxUint16 {
+		return nil, errors.New(fmt.Sprintf(
+			"%v roster members is too many", len(data.Members)))
+	}
+
+	buf := new(bytes.Buffer)
+
+	var more uint8
+	if data.More {
+		more = 1
+	}
+	header := []interface{}{
+		uint8(len(data.CommID)),
+		[]byte(data.CommID),
+		more,
+		uint16(len(data.Members)),
+	}
+	for _, v := range header {
+		if err = binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, member := range data.Members {
+		if len(member.Name) > math.MaxUint8 {
+			return nil, errors.New(fmt.Sprintf(
+				"Name of Client %v is too long", member.ClientID))
+		}
+		entry := []interface{}{
+			member.ClientID,
+			uint8(len(member.Name)),
+			[]byte(member.Name),
+		}
+		for _, v := range entry {
+			if err = binary.Write(buf, binary.BigEndian, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bit pattern: 64, 16
+//    - 64: BeforeSeq (uint64)
+//    - 16: Count (uint16)
+func (data MsgHistoryRequest) MarshalBinary() (bin []byte, err error) {
+	buf := new(bytes.Buffer)
+
+	err = binary.Write(buf, binary.BigEndian, data.BeforeSeq)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.BigEndian, data.Count)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Encoded size of an entry in a MsgHistory, excluding its TextBytes
+const HISTORY_ENTRY_HEADER_LEN = 24 // bytes
+
+// bit pattern: 8, len(data.CommID), 16, (64, 32, 64, 32, n)*
+//    - 8: len(data.CommID) (uint8)
+//    - len(data.CommID): UTF-8 encoded CommID
+//    - 16: len(data.Entries) (uint16)
+//    - then for each entry:
+//        - 64: Seq (uint64)
+//        - 32: ClientID (uint32)
+//        - 64: Time in Unix milliseconds (int64)
+//        - 32: len(TextBytes) (uint32)
+//        - n: TextBytes
+func (data MsgHistory) MarshalBinary() (bin []byte, err error) {
+	if len(data.CommID) > math.MaxUint8 {
+		return nil, errors.New(fmt.Sprintf(
+			"Comm ID of %v bytes is too long", len(data.CommID)))
+	}
+	if len(data.Entries) > math.MaxUint16 {
+		return nil, errors.New(fmt.Sprintf(
+			"%v history entries is too many", len(data.Entries)))
+	}
+
+	buf := new(bytes.Buffer)
+
+	err = binary.Write(buf, binary.BigEndian, uint8(len(data.CommID)))
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.WriteString(data.CommID)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.BigEndian, uint16(len(data.Entries)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range data.Entries {
+		header := []interface{}{
+			entry.Seq,
+			entry.ClientID,
+			entry.Time.UnixMilli(),
+			uint32(len(entry.TextBytes)),
+		}
+		for _, v := range header {
+			if err = binary.Write(buf, binary.BigEndian, v); err != nil {
+				return nil, err
+			}
+		}
+		_, err = buf.Write(entry.TextBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
 }
 
 // READING
-// bin is the binary encoding of the Message.Data
-// (i.e bin does not contain bit data for msgType NOR the length)
+// bin is the binary encoding of the Message.Data (the frame payload)
+// (i.e bin does not contain the frame header)
 func MsgFromBinary(msgType uint8, bin []byte) (msg *Message, err error) {
-	var data interface{}
+	var data interface {
+		UnmarshalBinary(bin []byte) error
+	}
 	switch msgType {
+	case MTypeClientAuth:
+		data = new(MsgClientAuth)
+	case MTypeClientID:
+		data = new(MsgClientID)
+	case MTypeClientName:
+		data = new(MsgClientName)
 	case MTypeClientText:
-		data, err = NewMsgClientText(bin)
+		data = new(MsgClientText)
+	case MTypeJoinComm:
+		data = new(MsgJoinComm)
+	case MTypeLeaveComm:
+		data = new(MsgLeaveComm)
+	case MTypeCommJoined:
+		data = new(MsgCommJoined)
+	case MTypeError:
+		data = new(MsgError)
+	case MTypeClientRegion:
+		data = new(MsgClientRegion)
+	case MTypeCapabilities:
+		data = new(MsgCapabilities)
+	case MTypeUserLeft:
+		data = new(MsgUserLeft)
+	case MTypeHistoryRequest:
+		data = new(MsgHistoryRequest)
+	case MTypeHistory:
+		data = new(MsgHistory)
+	case MTypeClientToken:
+		data = new(MsgClientToken)
+	case MTypeDirectText:
+		data = new(MsgDirectText)
+	case MTypeDirectAck:
+		data = new(MsgDirectAck)
+	case MTypeRoster:
+		data = new(MsgRoster)
+	case MTypeUserJoined:
+		data = new(MsgUserJoined)
+	case MTypeUserRenamed:
+		data = new(MsgUserRenamed)
+	case MTypePing:
+		data = new(MsgPing)
+	case MTypePong:
+		data = new(MsgPong)
+	case MTypeServerShutdown:
+		data = new(MsgServerShutdown)
+	case MTypeSendText:
+		data = new(MsgSendText)
+	case MTypeSendAck:
+		data = new(MsgSendAck)
+	case MTypeCommText:
+		data = new(MsgCommText)
+	case MTypeSession:
+		data = new(MsgSession)
+	case MTypeResume:
+		data = new(MsgResume)
+	case MTypeRedirect:
+		data = new(MsgRedirect)
 	default:
-		panic("MsgFromBinary(): unknown Message type.")
+		return nil, UnknownMsgTypeError{msgType}
 	}
-	if err != nil {
-		return nil, err
+
+	if err = data.UnmarshalBinary(bin); err != nil {
+		return nil, MalformedMsgError{msgType, err}
 	}
 
 	return &Message{msgType, data}, nil
 }
 
-func NewMsgClientText(bin []byte) (data *MsgClientText, err error) {
+// reads fixed-size values from bin, requiring bin to be fully consumed
+func readFixed(bin []byte, values ...interface{}) (err error) {
+	buf := bytes.NewReader(bin)
+	for _, v := range values {
+		if err = binary.Read(buf, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	if buf.Len() != 0 {
+		return errors.New(fmt.Sprintf(
+			"%v unexpected trailing bytes", buf.Len()))
+	}
+	return
+}
+
+// reads fixed-size values from the front of bin & returns the rest
+func readPrefix(bin []byte, values ...interface{}) (rest []byte, err error) {
+	buf := bytes.NewReader(bin)
+	for _, v := range values {
+		if err = binary.Read(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	return bin[len(bin)-buf.Len():], nil
+}
+
+func readUTF8(bin []byte, field string) (s string, err error) {
+	if !utf8.Valid(bin) {
+		return "", errors.New(fmt.Sprintf(
+			"%s is not valid UTF-8", field))
+	}
+	return string(bin), nil
+}
+
+func (data *MsgClientAuth) UnmarshalBinary(bin []byte) (err error) {
+	return readFixed(bin, &data.Version, &data.Caps)
+}
+
+func (data *MsgClientID) UnmarshalBinary(bin []byte) (err error) {
+	return readFixed(bin, &data.ID)
+}
+
+func (data *MsgClientName) UnmarshalBinary(bin []byte) (err error) {
+	data.Name, err = readUTF8(bin, "Client name")
+	return
+}
+
+func (data *MsgClientToken) UnmarshalBinary(bin []byte) (err error) {
+	data.Token, err = readUTF8(bin, "Token")
+	return
+}
+
+func (data *MsgClientRegion) UnmarshalBinary(bin []byte) (err error) {
+	data.ServerID, err = readUTF8(bin, "Region")
+	return
+}
+
+func (data *MsgClientText) UnmarshalBinary(bin []byte) (err error) {
+	data.TextBytes, err = readPrefix(bin, &data.ClientID)
+	return
+}
+
+func (data *MsgDirectText) UnmarshalBinary(bin []byte) (err error) {
+	data.TextBytes, err = readPrefix(bin, &data.ClientID)
+	return
+}
+
+func (data *MsgDirectAck) UnmarshalBinary(bin []byte) (err error) {
+	return readFixed(bin, &data.ClientID, &data.Status)
+}
+
+func (data *MsgJoinComm) UnmarshalBinary(bin []byte) (err error) {
+	data.CommID, err = readUTF8(bin, "Comm ID")
+	return
+}
+
+func (data *MsgLeaveComm) UnmarshalBinary(bin []byte) (err error) {
+	return readFixed(bin)
+}
+
+func (data *MsgCommJoined) UnmarshalBinary(bin []byte) (err error) {
+	data.CommID, err = readUTF8(bin, "Comm ID")
+	return
+}
+
+func (data *MsgError) UnmarshalBinary(bin []byte) (err error) {
+	text, err := readPrefix(bin, &data.Code)
+	if err != nil {
+		return err
+	}
+	data.Text, err = readUTF8(text, "Error text")
+	return
+}
+
+func (data *MsgCapabilities) UnmarshalBinary(bin []byte) (err error) {
+	return readFixed(bin, &data.Caps)
+}
+
+func (data *MsgUserLeft) UnmarshalBinary(bin []byte) (err error) {
+	name, err := readPrefix(bin, &data.ClientID)
+	if err != nil {
+		return err
+	}
+	data.Name, err = readUTF8(name, "Client name")
+	return
+}
+
+func (data *MsgUserJoined) UnmarshalBinary(bin []byte) (err error) {
+	var left MsgUserLeft
+	err = left.UnmarshalBinary(bin)
+	data.ClientID, data.Name = left.ClientID, left.Name
+	return
+}
+
+func (data *MsgUserRenamed) UnmarshalBinary(bin []byte) (err error) {
+	var left MsgUserLeft
+	err = left.UnmarshalBinary(bin)
+	data.ClientID, data.Name = left.ClientID, left.Name
+	return
+}
+
+func (data *MsgPing) UnmarshalBinary(bin []byte) (err error) {
+	return readFixed(bin, &data.Nonce)
+}
+
+func (data *MsgPong) UnmarshalBinary(bin []byte) (err error) {
+	return readFixed(bin, &data.Nonce)
+}
+
+func (data *MsgServerShutdown) UnmarshalBinary(bin []byte) (err error) {
+	reason, err := readPrefix(bin, &data.ReconnectAfter)
+	if err != nil {
+		return err
+	}
+	data.Reason, err = readUTF8(reason, "Shutdown reason")
+	return
+}
+
+func (data *MsgSendText) UnmarshalBinary(bin []byte) (err error) {
+	data.TextBytes, err = readPrefix(bin, &data.Nonce)
+	return
+}
+
+func (data *MsgSendAck) UnmarshalBinary(bin []byte) (err error) {
+	var timeMs int64
+	err = readFixed(bin,
+		&data.Nonce, &data.Code, &data.MsgID, &data.Seq, &timeMs)
+	if err == nil && data.Code == 0 {
+		data.Time = time.UnixMilli(timeMs)
+	}
+	return
+}
+
+func (data *MsgCommText) UnmarshalBinary(bin []byte) (err error) {
+	var timeMs int64
+	data.TextBytes, err = readPrefix(bin,
+		&data.ClientID, &data.MsgID, &data.Seq, &timeMs)
+	data.Time = time.UnixMilli(timeMs)
+	return
+}
+
+func (data *MsgSession) UnmarshalBinary(bin []byte) (err error) {
+	token, err := readPrefix(bin, &data.Grace)
+	if err != nil {
+		return err
+	}
+	data.Token, err = readUTF8(token, "Session token")
+	return
+}
+
+func (data *MsgResume) UnmarshalBinary(bin []byte) (err error) {
+	token, err := readPrefix(bin, &data.LastSeq)
+	if err != nil {
+		return err
+	}
+	data.Token, err = readUTF8(token, "Session token")
+	return
+}
+
+func (data *MsgRedirect) UnmarshalBinary(bin []byte) (err error) {
+	data.ServerID, bin, err = readShortUTF8(bin, "Server ID")
+	if err != nil {
+		return err
+	}
+	data.Addr, err = readUTF8(bin, "Addr")
+	return
+}
+
+// reads a uint8 length-prefixed UTF-8 string from the front of bin
+func readShortUTF8(bin []byte, field string) (s string, rest []byte,
+	err error) {
+	var strLen uint8
+	rest, err = readPrefix(bin, &strLen)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(rest) < int(strLen) {
+		return "", nil, errors.New(fmt.Sprintf(
+			"%s exceeds payload", field))
+	}
+	s, err = readUTF8(rest[:strLen], field)
+	return s, rest[strLen:], err
+}
+
+func (data *MsgRoster) UnmarshalBinary(bin []byte) (err error) {
+	data.CommID, bin, err = readShortUTF8(bin, "Comm ID")
+	if err != nil {
+		return err
+	}
+
 	var (
-		cID 		uint32
-		textBytes 	[]byte
+		more		uint8
+		numMembers	uint16
 	)
+	bin, err = readPrefix(bin, &more, &numMembers)
+	if err != nil {
+		return err
+	}
+	data.More = more != 0
 
-	buf := bytes.NewReader(bin)
-	err = binary.Read(buf, binary.BigEndian, cID)
+	data.Members = make([]RosterEntry, numMembers)
+	for i := range data.Members {
+		member := &data.Members[i]
+		bin, err = readPrefix(bin, &member.ClientID)
+		if err != nil {
+			return err
+		}
+		member.Name, bin, err = readShortUTF8(bin, "Client name")
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(bin) != 0 {
+		return errors.New(fmt.Sprintf(
+			"%v unexpected trailing bytes", len(bin)))
+	}
+	return
+}
+
+func (data *MsgHistoryRequest) UnmarshalBinary(bin []byte) (err error) {
+	return readFixed(bin, &data.BeforeSeq, &data.Count)
+}
+
+func (data *MsgHistory) UnmarshalBinary(bin []byte) (err error) {
+	var rest []byte
+	data.CommID, rest, err = readShortUTF8(bin, "Comm ID")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// TODO: Non-hardcoded value, 4*8 = 32
-	textBytes = bin[8:]
-	/*textBytes := make([]byte, len(bin)-8)
-	_, err = io.ReadFull(c.connReader, msgData)
+
+	var numEntries uint16
+	rest, err = readPrefix(rest, &numEntries)
 	if err != nil {
-		return nil, err
-	}*/
+		return err
+	}
+
+	data.Entries = make([]HistoryEntry, numEntries)
+	for i := range data.Entries {
+		entry := &data.Entries[i]
+		var (
+			timeMs		int64
+			textLen		uint32
+		)
+		rest, err = readPrefix(rest,
+			&entry.Seq, &entry.ClientID, &timeMs, &textLen)
+		if err != nil {
+			return err
+		}
+		if uint32(len(rest)) < textLen {
+			return errors.New(fmt.Sprintf(
+				"Text of history entry %v exceeds payload", entry.Seq))
+		}
+		entry.Time = time.UnixMilli(timeMs)
+		entry.TextBytes, rest = rest[:textLen], rest[textLen:]
+	}
 
-	return &MsgClientText{cID, textBytes}, nil
+	if len(rest) != 0 {
+		return errors.New(fmt.Sprintf(
+			"%v unexpected trailing bytes", len(rest)))
+	}
+	return
 }
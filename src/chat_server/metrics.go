@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are exported on the API's /metrics in the Prometheus text
+//    exposition format (version 0.0.4)
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Frame directions, for frame size metrics
+const (
+	FRAME_IN = "in"
+	FRAME_OUT = "out"
+)
+
+// Histogram buckets (upper bounds, ascending)
+var (
+	BROADCAST_SECONDS_BUCKETS = []float64{
+		0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05,
+		0.1, 0.25, 0.5, 1}
+	FRAME_BYTES_BUCKETS = []float64{
+		16, 64, 256, 1024, 4096, 16384, 65536, FRAME_HEADER_LEN + MAX_FRAME_LEN}
+)
+
+// Process-wide counters & histograms, updated by hooks in Client.readLoop(),
+//    Client.writeLoop(), Client.allowText(), Client.Disconnect(), the
+//    Community controlLoop (broadcasts & moderation), sw.handOff() &
+//    EncodeMsg()/DecodeMsg(); gauges are read from the ServerWrapper
+var metrics = newMetricsRegistry()
+
+type metricsRegistry struct {
+	msgsIn			[math.MaxUint8 + 1]uint64 // by MTypeX; sync/atomic
+	msgsOut			[math.MaxUint8 + 1]uint64 // by MTypeX; sync/atomic
+	authFailures	uint64 // sync/atomic
+	resumes			uint64 // sync/atomic
+	failedResumes	uint64 // sync/atomic
+	// by FLOOD_X verdict; sync/atomic
+	rateLimited		[FLOOD_DISCONNECT + 1]uint64
+
+	moderated		map[moderatedKey]uint64
+	moderatedMutex	sync.Mutex // guards moderated
+
+	disconnects			map[string]uint64 // by DISCONNECT_X reason
+	disconnectsMutex	sync.Mutex // guards disconnects
+
+	handoffs		map[string]uint64 // by HANDOFF_X action
+	handoffsMutex	sync.Mutex // guards handoffs
+
+	broadcastSeconds	*histogram
+	frameBytesIn		*histogram
+	frameBytesOut		*histogram
+}
+
+// A ModerationRule name & the MOD_X verdict it reached
+type moderatedKey struct {
+	rule	string
+	verdict	int
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		disconnects:		make(map[string]uint64),
+		moderated:			make(map[moderatedKey]uint64),
+		handoffs:			make(map[string]uint64),
+		broadcastSeconds:	newHistogram(BROADCAST_SECONDS_BUCKETS),
+		frameBytesIn:		newHistogram(FRAME_BYTES_BUCKETS),
+		frameBytesOut:		newHistogram(FRAME_BYTES_BUCKETS),
+	}
+}
+
+func (m *metricsRegistry) MsgIn(msgType uint8) {
+	atomic.AddUint64(&m.msgsIn[msgType], 1)
+}
+
+func (m *metricsRegistry) MsgOut(msgType uint8) {
+	atomic.AddUint64(&m.msgsOut[msgType], 1)
+}
+
+func (m *metricsRegistry) AuthFailure() {
+	atomic.AddUint64(&m.authFailures, 1)
+}
+
+// ok is false for an unknown or expired session
+func (m *metricsRegistry) Resume(ok bool) {
+	if ok {
+		atomic.AddUint64(&m.resumes, 1)
+	} else {
+		atomic.AddUint64(&m.failedResumes, 1)
+	}
+}
+
+func (m *metricsRegistry) RateLimited(verdict int) {
+	atomic.AddUint64(&m.rateLimited[verdict], 1)
+}
+
+// BLOCKING: m.moderatedMutex
+func (m *metricsRegistry) Moderated(rule string, verdict int) {
+	m.moderatedMutex.Lock()
+	defer m.moderatedMutex.Unlock()
+
+	m.moderated[moderatedKey{rule, verdict}]++
+}
+
+// BLOCKING: m.disconnectsMutex
+func (m *metricsRegistry) Disconnect(reason string) {
+	m.disconnectsMutex.Lock()
+	defer m.disconnectsMutex.Unlock()
+
+	m.disconnects[reason]++
+}
+
+// BLOCKING: m.handoffsMutex
+func (m *metricsRegistry) Handoff(action string) {
+	m.handoffsMutex.Lock()
+	defer m.handoffsMutex.Unlock()
+
+	m.handoffs[action]++
+}
+
+func (m *metricsRegistry) Broadcast(d time.Duration) {
+	m.broadcastSeconds.Observe(d.Seconds())
+}
+
+// frameLen includes the frame header
+func (m *metricsRegistry) Frame(direction string, frameLen int) {
+	if direction == FRAME_IN {
+		m.frameBytesIn.Observe(float64(frameLen))
+	} else {
+		m.frameBytesOut.Observe(float64(frameLen))
+	}
+}
+
+// A cumulative histogram w/ fixed buckets
+type histogram struct {
+	bounds		[]float64
+
+	mutex		sync.Mutex
+	counts		[]uint64 // per bound, non-cumulative; guarded by mutex
+	sum			float64 // guarded by mutex
+	count		uint64 // guarded by mutex
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds:	bounds,
+		counts:	make([]uint64, len(bounds)),
+	}
+}
+
+// BLOCKING: h.mutex
+func (h *histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	i := sort.SearchFloat64s(h.bounds, v) // first bound >= v
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// BLOCKING: h.mutex
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %v\n",
+			name, labels, sep, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %v\n",
+		name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braced(labels), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %v\n", name, braced(labels), h.count)
+}
+
+// GET /metrics
+func (api *APIServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	api.sw.writeMetrics(w)
+}
+
+// BLOCKING: see sw.Info(), sw.WriteQueueStats(), sw.cluster & metrics
+func (sw *ServerWrapper) writeMetrics(w io.Writer) {
+	writeHeader(w, "chat_clients", "gauge",
+		"Clients placed in each Community")
+	for _, s := range sw.Info() {
+		for _, comm := range s.Comms {
+			fmt.Fprintf(w, "chat_clients{server=%s,comm=%s} %v\n",
+				quoteLabel(s.ID), quoteLabel(comm.ID), len(comm.Clients))
+		}
+	}
+
+	stats := sw.WriteQueueStats()
+	writeHeader(w, "chat_connected_clients", "gauge",
+		"Authenticated Clients, whether or not placed in a Community")
+	fmt.Fprintf(w, "chat_connected_clients %v\n", stats.Clients)
+	writeHeader(w, "chat_write_queue_messages", "gauge",
+		"Messages waiting in all Clients' write queues")
+	fmt.Fprintf(w, "chat_write_queue_messages %v\n", stats.QueuedMsgs)
+	writeHeader(w, "chat_write_queue_dropped_total", "counter",
+		"Messages dropped from full write queues")
+	fmt.Fprintf(w, "chat_write_queue_dropped_total %v\n", stats.DroppedMsgs)
+
+	writeHeader(w, "chat_messages_received_total", "counter",
+		"Messages read from Clients by type")
+	metrics.writeMsgCounts(w, "chat_messages_received_total", &metrics.msgsIn)
+	writeHeader(w, "chat_messages_sent_total", "counter",
+		"Messages written to Clients by type")
+	metrics.writeMsgCounts(w, "chat_messages_sent_total", &metrics.msgsOut)
+
+	writeHeader(w, "chat_auth_failures_total", "counter",
+		"Connections that failed the auth handshake")
+	fmt.Fprintf(w, "chat_auth_failures_total %v\n",
+		atomic.LoadUint64(&metrics.authFailures))
+
+	writeHeader(w, "chat_session_resumes_total", "counter",
+		"MsgResume attempts, by result")
+	fmt.Fprintf(w, "chat_session_resumes_total{result=\"resumed\"} %v\n",
+		atomic.LoadUint64(&metrics.resumes))
+	fmt.Fprintf(w, "chat_session_resumes_total{result=\"expired\"} %v\n",
+		atomic.LoadUint64(&metrics.failedResumes))
+
+	writeHeader(w, "chat_rate_limited_total", "counter",
+		"MsgClientText dropped by rate limits, by action taken")
+	metrics.writeRateLimited(w)
+
+	writeHeader(w, "chat_moderated_total", "counter",
+		"MsgClientText redacted or rejected, by moderation rule")
+	metrics.writeModerated(w)
+
+	writeHeader(w, "chat_disconnects_total", "counter",
+		"Client disconnects by reason")
+	metrics.writeDisconnects(w)
+
+	writeHeader(w, "chat_cluster_handoffs_total", "counter",
+		"Clients that connected to a node not owning their region, by action")
+	metrics.writeHandoffs(w)
+	out, in := sw.cluster.ForwardedCounts()
+	writeHeader(w, "chat_forwarded_clients", "gauge",
+		"Clients forwarded over the cluster bus, by direction")
+	fmt.Fprintf(w, "chat_forwarded_clients{direction=\"out\"} %v\n", out)
+	fmt.Fprintf(w, "chat_forwarded_clients{direction=\"in\"} %v\n", in)
+
+	writeHeader(w, "chat_broadcast_seconds", "histogram",
+		"Time a Community takes to queue a Message for all its members")
+	metrics.broadcastSeconds.write(w, "chat_broadcast_seconds", "")
+
+	writeHeader(w, "chat_frame_bytes", "histogram",
+		"Size of frames read & written, header included")
+	metrics.frameBytesIn.write(w, "chat_frame_bytes",
+		"direction=" + quoteLabel(FRAME_IN))
+	metrics.frameBytesOut.write(w, "chat_frame_bytes",
+		"direction=" + quoteLabel(FRAME_OUT))
+}
+
+// Every known MTypeX is listed, even w/ a count of 0
+func (m *metricsRegistry) writeMsgCounts(w io.Writer, name string,
+	counts *[math.MaxUint8 + 1]uint64) {
+	for t := 0; t <= math.MaxUint8; t++ {
+		typeName := (&Message{Type: uint8(t)}).TypeToString()
+		if strings.HasPrefix(typeName, "MTypeUnknown") {
+			continue
+		}
+		fmt.Fprintf(w, "%s{type=%s} %v\n",
+			name, quoteLabel(typeName), atomic.LoadUint64(&counts[t]))
+	}
+}
+
+func (m *metricsRegistry) writeRateLimited(w io.Writer) {
+	actions := []struct {
+		verdict	int
+		name	string
+	}{
+		{FLOOD_LIMITED, "dropped"},
+		{FLOOD_MUTED, "muted"},
+		{FLOOD_STILL_MUTED, "dropped_muted"},
+		{FLOOD_DISCONNECT, "disconnected"},
+	}
+	for _, a := range actions {
+		fmt.Fprintf(w, "chat_rate_limited_total{action=%s} %v\n",
+			quoteLabel(a.name), atomic.LoadUint64(&m.rateLimited[a.verdict]))
+	}
+}
+
+// BLOCKING: m.moderatedMutex
+func (m *metricsRegistry) writeModerated(w io.Writer) {
+	m.moderatedMutex.Lock()
+	defer m.moderatedMutex.Unlock()
+
+	keys := make([]moderatedKey, 0, len(m.moderated))
+	for k := range m.moderated {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].rule != keys[j].rule {
+			return keys[i].rule < keys[j].rule
+		}
+		return keys[i].verdict < keys[j].verdict
+	})
+
+	for _, k := range keys {
+		verdict := "redacted"
+		if k.verdict == MOD_REJECT {
+			verdict = "rejected"
+		}
+		fmt.Fprintf(w, "chat_moderated_total{rule=%s,verdict=%s} %v\n",
+			quoteLabel(k.rule), quoteLabel(verdict), m.moderated[k])
+	}
+}
+
+// BLOCKING: m.disconnectsMutex
+func (m *metricsRegistry) writeDisconnects(w io.Writer) {
+	m.disconnectsMutex.Lock()
+	defer m.disconnectsMutex.Unlock()
+
+	reasons := make([]string, 0, len(m.disconnects))
+	for reason := range m.disconnects {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "chat_disconnects_total{reason=%s} %v\n",
+			quoteLabel(reason), m.disconnects[reason])
+	}
+}
+
+// Both actions are listed, even w/ a count of 0
+// BLOCKING: m.handoffsMutex
+func (m *metricsRegistry) writeHandoffs(w io.Writer) {
+	m.handoffsMutex.Lock()
+	defer m.handoffsMutex.Unlock()
+
+	for _, action := range []string{HANDOFF_FORWARDED, HANDOFF_REDIRECTED} {
+		fmt.Fprintf(w, "chat_cluster_handoffs_total{action=%s} %v\n",
+			quoteLabel(action), m.handoffs[action])
+	}
+}
+
+func writeHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	return fmt.Sprintf("%g", v)
+}
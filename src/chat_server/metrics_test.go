@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Scrapes /metrics into each sample's value, by name & labels as written
+func scrapeTestMetrics(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics = %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Content-Type") != METRICS_CONTENT_TYPE {
+		t.Fatalf("GET /metrics = %v w/ Content-Type %q", resp.Status,
+			resp.Header.Get("Content-Type"))
+	}
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if i < 0 || err != nil {
+			t.Fatalf("Malformed sample %q", line)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+// Traffic through a node shows in its /metrics
+func TestMetricsUpdated(t *testing.T) {
+	t.Setenv("HISTORY_DIR", "")
+	sw := startTestNode(t)
+	api := httptest.NewServer((&APIServer{sw: sw}).routes())
+	t.Cleanup(api.Close)
+	before := scrapeTestMetrics(t, api.URL)
+
+	sender, _ := dialTestSessionClient(t, sw, 1, "c1")
+	receiver, _ := dialTestSessionClient(t, sw, 2, "c1")
+	sender.sendAckedText(1, []byte("hello"))
+	receiver.expect(MTypeCommText)
+	// control chars are stripped
+	sender.sendAckedText(2, []byte("a\x00b"))
+	receiver.expect(MTypeCommText)
+
+	expectTestMetrics(t, api.URL, before, map[string]float64{
+		"chat_connected_clients":								2,
+		`chat_clients{server="main",comm="c1"}`:				2,
+		`chat_messages_received_total{type="MTypeSendText"}`:	2,
+		`chat_messages_received_total{type="MTypeJoinComm"}`:	2,
+		`chat_messages_sent_total{type="MTypeSendAck"}`:		2,
+		`chat_messages_sent_total{type="MTypeCommText"}`:		2,
+		`chat_moderated_total{rule="control_chars",verdict="redacted"}`: 1,
+	})
+	during := scrapeTestMetrics(t, api.URL)
+	for _, sample := range []string{
+		`chat_frame_bytes_count{direction="in"}`,
+		`chat_frame_bytes_count{direction="out"}`,
+		"chat_broadcast_seconds_count"} {
+		if during[sample] <= before[sample] {
+			t.Errorf("%s = %v, not above %v", sample, during[sample],
+				before[sample])
+		}
+	}
+
+	receiver.conn.Close()
+	expectTestMetrics(t, api.URL, before, map[string]float64{
+		"chat_connected_clients":					1,
+		`chat_disconnects_total{reason="closed"}`:	1,
+	})
+}
+
+// Scrapes url until each sample in want is reached, as counters are
+//    updated after the Messages they count are written; gauges (named
+//    w/o _total) are compared as is, counters by their rise since before
+func expectTestMetrics(t *testing.T, url string, before map[string]float64,
+	want map[string]float64) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		samples := scrapeTestMetrics(t, url)
+		var wrong []string
+		for sample, value := range want {
+			got := samples[sample]
+			if strings.Contains(sample, "_total") {
+				got -= before[sample]
+			}
+			if got != value {
+				wrong = append(wrong, fmt.Sprintf("%s = %v, want %v",
+					sample, got, value))
+			}
+		}
+		if len(wrong) == 0 {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatal(strings.Join(wrong, "; "))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ModerationRule verdicts, in increasing severity
+const (
+	MOD_ALLOW = iota
+	MOD_REDACT // relayed w/ the offending parts masked
+	MOD_REJECT // dropped; the sender gets an ECodeModeration MsgError
+)
+
+const (
+	DEFAULT_MAX_TEXT_LEN = 2000 // characters
+
+	// MODERATION_CONFIG scope matching every Community
+	MOD_SCOPE_ALL = "*"
+
+	// MODERATION_CONFIG rules
+	MOD_RULE_WORD = "word"
+	MOD_RULE_REGEX = "regex"
+	MOD_RULE_MAX_LEN = "max_len"
+
+	// masks each redacted character
+	MOD_REDACT_MASK = "*"
+)
+
+// Checks a text before its Community relays it; redacted is the text to
+// relay for MOD_REDACT & reason is reported to the sender for MOD_REJECT
+type ModerationRule interface {
+	Name() string
+	Moderate(text []byte) (verdict int, redacted []byte, reason string)
+}
+
+// Rules run in order, each on the text left by the one before
+type ModerationChain []ModerationRule
+
+// Runs text through the chain, stopping at the first MOD_REJECT; verdict
+//    is the most severe of the rules' & rule the name of the rule that
+//    rejected (or last redacted) the text
+func (chain ModerationChain) Moderate(text []byte) (verdict int,
+	out []byte, reason string, rule string) {
+	out = text
+	for _, r := range chain {
+		v, redacted, why := r.Moderate(out)
+		switch v {
+		case MOD_REJECT:
+			return MOD_REJECT, nil, why, r.Name()
+		case MOD_REDACT:
+			verdict, out, rule = MOD_REDACT, redacted, r.Name()
+		}
+	}
+	return verdict, out, "", rule
+}
+
+// Rejects text that isn't valid UTF-8
+type utf8Rule struct {}
+
+func (r utf8Rule) Name() string {
+	return "utf8"
+}
+
+func (r utf8Rule) Moderate(text []byte) (int, []byte, string) {
+	if !utf8.Valid(text) {
+		return MOD_REJECT, nil, "Text is not valid UTF-8"
+	}
+	return MOD_ALLOW, text, ""
+}
+
+// Strips control characters other than tabs & newlines; rejects text
+//    left empty
+type controlCharRule struct {}
+
+func (r controlCharRule) Name() string {
+	return "control_chars"
+}
+
+func (r controlCharRule) Moderate(text []byte) (int, []byte, string) {
+	stripped := bytes.Map(func(c rune) rune {
+		if unicode.IsControl(c) && c != '\t' && c != '\n' {
+			return -1
+		}
+		return c
+	}, text)
+
+	if len(stripped) == len(text) {
+		return MOD_ALLOW, text, ""
+	} else if len(stripped) == 0 {
+		return MOD_REJECT, nil, "Text has no printable characters"
+	}
+	return MOD_REDACT, stripped, ""
+}
+
+// Rejects text longer than maxLen characters
+type maxLenRule struct {
+	maxLen	int
+}
+
+func (r maxLenRule) Name() string {
+	return MOD_RULE_MAX_LEN
+}
+
+func (r maxLenRule) Moderate(text []byte) (int, []byte, string) {
+	if utf8.RuneCount(text) > r.maxLen {
+		return MOD_REJECT, nil, fmt.Sprintf(
+			"Text is longer than %v characters", r.maxLen)
+	}
+	return MOD_ALLOW, text, ""
+}
+
+// Redacts or rejects text matching re
+type patternRule struct {
+	name	string
+	re		*regexp.Regexp
+	action	int // MOD_REDACT or MOD_REJECT
+	reason	string
+}
+
+func (r patternRule) Name() string {
+	return r.name
+}
+
+func (r patternRule) Moderate(text []byte) (int, []byte, string) {
+	if !r.re.Match(text) {
+		return MOD_ALLOW, text, ""
+	}
+	if r.action == MOD_REJECT {
+		return MOD_REJECT, nil, r.reason
+	}
+	return MOD_REDACT, r.re.ReplaceAllFunc(text, func(match []byte) []byte {
+		return bytes.Repeat([]byte(MOD_REDACT_MASK), utf8.RuneCount(match))
+	}), ""
+}
+
+// Redacts or rejects text containing any of words on its own, i.e. not
+//    next to a letter, digit or '_' (in any script, unlike \b) at an end
+//    where the word has one; words are matched case-insensitively
+type wordRule struct {
+	re		*regexp.Regexp // any of the words, longest first
+	action	int // MOD_REDACT or MOD_REJECT
+	reason	string
+}
+
+func newWordRule(words []string, action int, reason string) wordRule {
+	sorted := append([]string(nil), words...)
+	// so a word isn't passed over for a shorter one it starts w/
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	for i, word := range sorted {
+		sorted[i] = regexp.QuoteMeta(word)
+	}
+
+	return wordRule{
+		re:		regexp.MustCompile(
+			`(?i)(?:` + strings.Join(sorted, "|") + `)`),
+		action:	action,
+		reason:	reason,
+	}
+}
+
+func (r wordRule) Name() string {
+	return MOD_RULE_WORD
+}
+
+// The [start, end) of each whole word in text
+func (r wordRule) matches(text []byte) (spans [][2]int) {
+	for pos := 0; pos < len(text); {
+		loc := r.re.FindIndex(text[pos:])
+		if loc == nil {
+			break
+		}
+		start, end := pos + loc[0], pos + loc[1]
+		if isWholeWord(text, start, end) {
+			spans = append(spans, [2]int{start, end})
+			pos = end
+			continue
+		}
+		// a word may still start inside the part match
+		_, size := utf8.DecodeRune(text[start:])
+		pos = start + size
+	}
+	return
+}
+
+func (r wordRule) Moderate(text []byte) (int, []byte, string) {
+	spans := r.matches(text)
+	if len(spans) == 0 {
+		return MOD_ALLOW, text, ""
+	}
+	if r.action == MOD_REJECT {
+		return MOD_REJECT, nil, r.reason
+	}
+
+	redacted := make([]byte, 0, len(text))
+	last := 0
+	for _, span := range spans {
+		redacted = append(redacted, text[last:span[0]]...)
+		redacted = append(redacted, bytes.Repeat([]byte(MOD_REDACT_MASK),
+			utf8.RuneCount(text[span[0]:span[1]]))...)
+		last = span[1]
+	}
+	return MOD_REDACT, append(redacted, text[last:]...), ""
+}
+
+// Whether text[start:end] isn't part of a longer word: a word char at
+//    either end of it mustn't have another next to it
+func isWholeWord(text []byte, start int, end int) bool {
+	first, _ := utf8.DecodeRune(text[start:end])
+	if before, _ := utf8.DecodeLastRune(text[:start]);
+		start > 0 && isWordChar(first) && isWordChar(before) {
+		return false
+	}
+	last, _ := utf8.DecodeLastRune(text[start:end])
+	if after, _ := utf8.DecodeRune(text[end:]);
+		end < len(text) && isWordChar(last) && isWordChar(after) {
+		return false
+	}
+	return true
+}
+
+// Letters & digits of any script, their combining marks, & '_'
+func isWordChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) ||
+		unicode.IsMark(r)
+}
+
+// Word & regex filters & length limits for every Community, each Server
+//    & each Community, merged by Chain()
+type ModerationConfig struct {
+	MaxLen	int // characters; 0 is unlimited
+	// run after the built-in rules in every Community's chain
+	Extra	[]ModerationRule
+
+	// by MOD_SCOPE_ALL, "<ServerID>" or "<ServerID>/<CommID>"
+	scopes	map[string]*moderationScope
+}
+
+type moderationScope struct {
+	maxLen		int // -1 if not overridden
+	filters		[]moderationFilter
+}
+
+type moderationFilter struct {
+	rule		string // MOD_RULE_WORD or MOD_RULE_REGEX
+	pattern		string
+	action		int // MOD_ALLOW lifts a broader scope's filter
+	re			*regexp.Regexp // MOD_RULE_REGEX only
+}
+
+func DefaultModerationConfig() ModerationConfig {
+	return ModerationConfig{
+		MaxLen:	DEFAULT_MAX_TEXT_LEN,
+		scopes:	make(map[string]*moderationScope),
+	}
+}
+
+// Builds the chain for Community commID of Server serverID: UTF-8
+//    validation, control character stripping, the length limit, word &
+//    regex filters, then mc.Extra. A Community's filters override its
+//    Server's, which override those for every Community.
+// Scopes name their ServerID & CommID exactly, as both are case-sensitive
+//    IDs; a word filter overrides another for the same word in any case,
+//    as words are matched ignoring case, while regex filters override only
+//    the same pattern
+func (mc ModerationConfig) Chain(serverID string, commID string) (
+	chain ModerationChain) {
+	maxLen := mc.MaxLen
+	var filters []moderationFilter
+	index := make(map[string]int) // by rule & pattern
+	for _, key := range []string{
+		MOD_SCOPE_ALL, serverID, serverID + "/" + commID} {
+		scope, ok := mc.scopes[key]
+		if !ok {
+			continue
+		}
+		if scope.maxLen >= 0 {
+			maxLen = scope.maxLen
+		}
+		for _, f := range scope.filters {
+			k := f.rule + " " + f.pattern
+			if f.rule == MOD_RULE_WORD {
+				k = f.rule + " " + strings.ToLower(f.pattern)
+			}
+			if i, ok := index[k]; ok {
+				filters[i] = f
+			} else {
+				index[k] = len(filters)
+				filters = append(filters, f)
+			}
+		}
+	}
+
+	chain = ModerationChain{utf8Rule{}, controlCharRule{}}
+	if maxLen > 0 {
+		chain = append(chain, maxLenRule{maxLen})
+	}
+
+	// 1 wordRule per action; rejections first, so redaction can't hide
+	// them
+	words := make(map[int][]string)
+	for _, f := range filters {
+		if f.rule == MOD_RULE_WORD && f.action != MOD_ALLOW {
+			words[f.action] = append(words[f.action], f.pattern)
+		}
+	}
+	for _, action := range []int{MOD_REJECT, MOD_REDACT} {
+		if len(words[action]) == 0 {
+			continue
+		}
+		chain = append(chain, newWordRule(words[action], action,
+			"Text contains a banned word"))
+	}
+
+	for _, f := range filters {
+		if f.rule == MOD_RULE_REGEX && f.action != MOD_ALLOW {
+			chain = append(chain, patternRule{
+				name:	MOD_RULE_REGEX,
+				re:		f.re,
+				action:	f.action,
+				reason:	"Text matches a blocked pattern",
+			})
+		}
+	}
+
+	return append(chain, mc.Extra...)
+}
+
+// Loads filters & length limits from path into mc; each non-empty line
+//    not starting w/ '#' is one of
+//    <scope> word <allow|redact|reject> <word>
+//    <scope> regex <allow|redact|reject> <pattern, to the end of the line>
+//    <scope> max_len <characters>
+//    where scope is *, "<ServerID>" or "<ServerID>/<CommID>", i.e:
+//    waterloo/kids    word    reject    heck
+func (mc *ModerationConfig) LoadRules(path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scopes := make(map[string]*moderationScope)
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return errors.New(fmt.Sprintf(
+				"%s:%v: expected \"<scope> <rule> <args>\"", path, lineNum))
+		}
+
+		scope, ok := scopes[fields[0]]
+		if !ok {
+			scope = &moderationScope{maxLen: -1}
+			scopes[fields[0]] = scope
+		}
+
+		if err = scope.parseRule(line, fields); err != nil {
+			return errors.New(fmt.Sprintf("%s:%v: %v", path, lineNum, err))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	mc.scopes = scopes
+	return nil
+}
+
+// Adds the rule on line (split into fields) to scope
+func (scope *moderationScope) parseRule(line string, fields []string) (
+	err error) {
+	switch fields[1] {
+	case MOD_RULE_MAX_LEN:
+		if len(fields) != 3 {
+			return errors.New("expected \"<scope> max_len <characters>\"")
+		}
+		scope.maxLen, err = strconv.Atoi(fields[2])
+		if err != nil || scope.maxLen < 0 {
+			return errors.New(fmt.Sprintf("Invalid max_len %q", fields[2]))
+		}
+		return nil
+	case MOD_RULE_WORD, MOD_RULE_REGEX:
+	default:
+		return errors.New(fmt.Sprintf("Unknown rule %q", fields[1]))
+	}
+
+	f := moderationFilter{rule: fields[1]}
+	switch fields[2] {
+	case "allow":
+		f.action = MOD_ALLOW
+	case "redact":
+		f.action = MOD_REDACT
+	case "reject":
+		f.action = MOD_REJECT
+	default:
+		return errors.New(fmt.Sprintf("Unknown action %q", fields[2]))
+	}
+
+	if f.rule == MOD_RULE_WORD {
+		if len(fields) != 4 {
+			return errors.New("expected \"<scope> word <action> <word>\"")
+		}
+		f.pattern = fields[3]
+	} else {
+		f.pattern = restOfLine(line, 3)
+		if f.pattern == "" {
+			return errors.New("expected \"<scope> regex <action> <pattern>\"")
+		}
+		if f.re, err = regexp.Compile(f.pattern); err != nil {
+			return errors.New(fmt.Sprintf("Invalid regex: %v", err))
+		}
+	}
+
+	scope.filters = append(scope.filters, f)
+	return nil
+}
+
+// What's left of line after its first n whitespace-separated fields
+func restOfLine(line string, n int) string {
+	for i := 0; i < n; i++ {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		end := strings.IndexFunc(line, unicode.IsSpace)
+		if end < 0 {
+			return ""
+		}
+		line = line[end:]
+	}
+	return strings.TrimSpace(line)
+}
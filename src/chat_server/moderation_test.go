@@ -0,0 +1,241 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Writes rules to a file & loads it into a ModerationConfig
+func loadTestRules(t *testing.T, rules string) (ModerationConfig, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "moderation.conf")
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mc := DefaultModerationConfig()
+	err := mc.LoadRules(path)
+	return mc, err
+}
+
+// Flags every text w/ its own verdict, to check the chain's order
+type testModerationRule struct {
+	name	string
+	seen	*[]string
+}
+
+func (r testModerationRule) Name() string {
+	return r.name
+}
+
+func (r testModerationRule) Moderate(text []byte) (int, []byte, string) {
+	*r.seen = append(*r.seen, string(text))
+	return MOD_ALLOW, text, ""
+}
+
+func TestModerationVerdicts(t *testing.T) {
+	mc, err := loadTestRules(t, "* word redact darn\n"+
+		"* word reject spamword\n"+
+		"* regex reject (?i)free\\s+crypto\n"+
+		"* regex redact [0-9]{3}-[0-9]{4}\n"+
+		"* max_len 20\n")
+	if err != nil {
+		t.Fatalf("LoadRules() = %v", err)
+	}
+	chain := mc.Chain("main", "c1")
+
+	cases := []struct {
+		text	string
+		verdict	int
+		out		string
+		rule	string
+	}{
+		{"hello", MOD_ALLOW, "hello", ""},
+		{"oh darn it", MOD_REDACT, "oh **** it", MOD_RULE_WORD},
+		{"call 555-1234", MOD_REDACT, "call ********", MOD_RULE_REGEX},
+		{"buy SPAMWORD now", MOD_REJECT, "", MOD_RULE_WORD},
+		{"FREE  crypto", MOD_REJECT, "", MOD_RULE_REGEX},
+		{"\xff", MOD_REJECT, "", "utf8"},
+		{"a\x00b\tc", MOD_REDACT, "ab\tc", "control_chars"},
+		{"\x01\x02", MOD_REJECT, "", "control_chars"},
+		{strings.Repeat("é", 20), MOD_ALLOW, strings.Repeat("é", 20), ""},
+		{strings.Repeat("a", 21), MOD_REJECT, "", MOD_RULE_MAX_LEN},
+		// control chars are stripped before the length is checked
+		{strings.Repeat("a", 20) + "\x00", MOD_REDACT,
+			strings.Repeat("a", 20), "control_chars"},
+	}
+	for _, tc := range cases {
+		verdict, out, reason, rule := chain.Moderate([]byte(tc.text))
+		if verdict != tc.verdict || string(out) != tc.out || rule != tc.rule {
+			t.Errorf("Moderate(%q) = %v, %q, %q; want %v, %q, %q", tc.text,
+				verdict, out, rule, tc.verdict, tc.out, tc.rule)
+		}
+		if (verdict == MOD_REJECT) != (reason != "") {
+			t.Errorf("Moderate(%q) gave reason %q w/ verdict %v", tc.text,
+				reason, verdict)
+		}
+	}
+}
+
+func TestModerationChainOrder(t *testing.T) {
+	var seen []string
+	mc, err := loadTestRules(t, "* regex redact [0-9]+\n"+
+		"* word redact darn\n"+
+		"* word reject heck\n")
+	if err != nil {
+		t.Fatalf("LoadRules() = %v", err)
+	}
+	mc.Extra = []ModerationRule{testModerationRule{"extra", &seen}}
+	chain := mc.Chain("main", "c1")
+
+	var names []string
+	for _, r := range chain {
+		names = append(names, r.Name())
+	}
+	want := []string{"utf8", "control_chars", MOD_RULE_MAX_LEN,
+		MOD_RULE_WORD, MOD_RULE_WORD, MOD_RULE_REGEX, "extra"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("Chain() = %v, want %v", names, want)
+	}
+	// rejected words come before redacted ones, so masking can't hide them
+	if r := chain[3].(wordRule); r.action != MOD_REJECT {
+		t.Errorf("1st word rule has action %v, want MOD_REJECT", r.action)
+	}
+
+	// each rule sees the text left by the one before; Extra runs last
+	verdict, out, _, rule := chain.Moderate([]byte("darn 42"))
+	if verdict != MOD_REDACT || string(out) != "**** **" ||
+		rule != MOD_RULE_REGEX {
+		t.Errorf("Moderate() = %v, %q, %q", verdict, out, rule)
+	}
+	if len(seen) != 1 || seen[0] != "**** **" {
+		t.Errorf("Extra saw %q, want the redacted text", seen)
+	}
+
+	// nothing runs after a rejection
+	seen = nil
+	if verdict, _, _, _ := chain.Moderate([]byte("heck")); verdict !=
+		MOD_REJECT || len(seen) != 0 {
+		t.Errorf("Moderate() = %v, & Extra saw %q", verdict, seen)
+	}
+}
+
+// Words match whole, in any case, bounded by letters & digits of any
+//    script
+func TestModerationWordBoundaries(t *testing.T) {
+	r := newWordRule([]string{"darn", "café", "über", "c++", "dar"},
+		MOD_REDACT, "")
+
+	cases := []struct {
+		text	string
+		out		string
+	}{
+		{"darn", "****"},
+		{"Darn!", "****!"},
+		{"DARN darn", "**** ****"},
+		{"darned", "darned"},
+		{"undarn", "undarn"},
+		{"darn_it", "darn_it"},
+		{"darn-it", "****-it"},
+		{"dar", "***"}, // not passed over for darn
+		{"café!", "****!"},
+		{"cafés", "cafés"},
+		{"Lüber", "Lüber"},
+		{"ÜBER alles", "**** alles"},
+		{"1über", "1über"},
+		{"über\u0301", "über\u0301"}, // followed by a combining mark
+		{"c++ code", "*** code"},
+		{"abc++", "abc++"}, // c is part of abc
+		{"c+++", "***+"}, // no word char at its end to bound
+		{"dardarn darn", "dardarn ****"},
+	}
+	for _, tc := range cases {
+		verdict, out, _ := r.Moderate([]byte(tc.text))
+		if string(out) != tc.out {
+			t.Errorf("Moderate(%q) = %q, want %q", tc.text, out, tc.out)
+		}
+		if (verdict == MOD_REDACT) != (tc.out != tc.text) {
+			t.Errorf("Moderate(%q) verdict %v", tc.text, verdict)
+		}
+	}
+}
+
+func TestModerationLoadRulesErrors(t *testing.T) {
+	cases := []struct {
+		rules	string
+		err		string
+	}{
+		{"# ok\n\n* word\n", ":3: expected"},
+		{"* words reject darn\n", ":1: Unknown rule"},
+		{"* word ban darn\n", ":1: Unknown action"},
+		{"* word reject darn heck\n", ":1: expected"},
+		{"* regex reject\n", ":1: expected"},
+		{"* regex reject (unclosed\n", ":1: Invalid regex"},
+		{"* max_len -1\n", ":1: Invalid max_len"},
+		{"* max_len 10 20\n", ":1: expected"},
+		{"* max_len ten\n", ":1: Invalid max_len"},
+	}
+	for _, tc := range cases {
+		_, err := loadTestRules(t, tc.rules)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("LoadRules(%q) = %v, want an error w/ %q", tc.rules,
+				err, tc.err)
+		}
+	}
+
+	mc := DefaultModerationConfig()
+	if err := mc.LoadRules(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("LoadRules() of a missing file succeeded")
+	}
+}
+
+// Overrides as in moderation.example.conf: scopes by exact IDs, words in
+//    any case
+func TestModerationOverrides(t *testing.T) {
+	mc, err := loadTestRules(t, "* word redact darn\n"+
+		"* regex reject (?i)free\\s+crypto\n"+
+		"* max_len 2000\n"+
+		"waterloo word reject heck\n"+
+		"waterloo/kids word reject DARN\n"+
+		"waterloo/kids max_len 5\n"+
+		"waterloo/offtopic word allow Darn\n"+
+		"waterloo/offtopic word allow heck\n"+
+		"waterloo/offtopic regex allow (?i)FREE\\s+crypto\n"+
+		"waterloo/lobby max_len 0\n")
+	if err != nil {
+		t.Fatalf("LoadRules() = %v", err)
+	}
+
+	cases := []struct {
+		serverID	string
+		commID		string
+		text		string
+		verdict		int
+	}{
+		{"toronto", "c1", "darn", MOD_REDACT},
+		{"toronto", "c1", "heck", MOD_ALLOW},
+		{"waterloo", "c1", "heck", MOD_REJECT},
+		// DARN overrides darn
+		{"waterloo", "kids", "darn", MOD_REJECT},
+		{"waterloo", "kids", "123456", MOD_REJECT},
+		{"waterloo", "offtopic", "darn", MOD_ALLOW},
+		{"waterloo", "offtopic", "heck", MOD_ALLOW},
+		// only lifted by the same pattern
+		{"waterloo", "offtopic", "free crypto", MOD_REJECT},
+		{"waterloo", "lobby", strings.Repeat("a", 3000), MOD_ALLOW},
+		// scopes' IDs are case-sensitive
+		{"Waterloo", "c1", "heck", MOD_ALLOW},
+		{"waterloo", "Kids", "darn", MOD_REDACT},
+		{"waterloo", "Kids", strings.Repeat("a", 6), MOD_ALLOW},
+	}
+	for _, tc := range cases {
+		chain := mc.Chain(tc.serverID, tc.commID)
+		if verdict, _, _, _ := chain.Moderate([]byte(tc.text));
+			verdict != tc.verdict {
+			t.Errorf("%s/%s: Moderate(%.10q) = %v, want %v", tc.serverID,
+				tc.commID, tc.text, verdict, tc.verdict)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Message IDs are the Unix millisecond time a text was accepted, shifted
+//    left MSG_ID_COUNTER_BITS, plus a counter for texts accepted within
+//    the same millisecond; so they're unique & ordered across restarts
+//    (given a clock that doesn't go backwards)
+const MSG_ID_COUNTER_BITS = 16
+
+// Stamps every text any Community accepts
+var msgIDs = new(MsgIDGenerator)
+
+type MsgIDGenerator struct {
+	mutex	sync.Mutex
+	last	uint64 // guarded by mutex
+}
+
+// A new ID, greater than any returned before
+// BLOCKING: g.mutex
+func (g *MsgIDGenerator) Next(now time.Time) uint64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	id := uint64(now.UnixMilli()) << MSG_ID_COUNTER_BITS
+	if id <= g.last {
+		id = g.last + 1
+	}
+	g.last = id
+	return id
+}
+
+// Acks a MsgSendText w/ the ECodeX it was dropped w/
+func (c *Client) nackText(nonce uint64, code uint8) {
+	err := c.WriteMsg(&Message{MTypeSendAck, MsgSendAck{
+		Nonce:	nonce,
+		Code:	code,
+	}})
+	if err != nil {
+		c.Log().Warn("Unable to send ack", "err", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMsgIDGeneratorNext(t *testing.T) {
+	g := new(MsgIDGenerator)
+	now := time.UnixMilli(1700000000000)
+
+	first := g.Next(now)
+	if first != uint64(now.UnixMilli()) << MSG_ID_COUNTER_BITS {
+		t.Errorf("Next() = %v, want the time shifted", first)
+	}
+	// within the same millisecond, or w/ a clock gone backwards
+	if id := g.Next(now); id != first + 1 {
+		t.Errorf("2nd Next() = %v, want %v", id, first + 1)
+	}
+	if id := g.Next(now.Add(-time.Second)); id != first + 2 {
+		t.Errorf("Next() of an earlier time = %v, want %v", id, first + 2)
+	}
+	if id := g.Next(now.Add(time.Millisecond)); id !=
+		uint64(now.UnixMilli() + 1) << MSG_ID_COUNTER_BITS {
+		t.Errorf("Next() a millisecond later = %v", id)
+	}
+}
+
+// A MsgSendText is acked w/ the MsgID & Seq its MsgCommText is relayed
+//    w/, or w/ the ECodeX it was dropped w/; members w/o CapMessageIDs get
+//    a MsgClientText
+func TestSendTextAcked(t *testing.T) {
+	t.Setenv("HISTORY_DIR", "")
+	sw := startTestNode(t)
+
+	sender, _ := dialTestSessionClient(t, sw, 1, "c1")
+	stamped, _ := dialTestSessionClient(t, sw, 2, "c1")
+	legacy := dialTestClient(t, clientAddr(sw), 3, DEFAULT_SERVER_ID, 0)
+	legacy.expectRoster(ROOT_COMM_ID)
+	legacy.send(&Message{MTypeJoinComm, MsgJoinComm{"c1"}})
+	legacy.expectRoster("c1")
+
+	var lastID uint64
+	for i, text := range []string{"first", "second"} {
+		sent := time.Now()
+		sender.send(&Message{MTypeSendText, MsgSendText{uint64(i + 7),
+			[]byte(text)}})
+		ack := sender.expect(MTypeSendAck).Data.(*MsgSendAck)
+		if ack.Nonce != uint64(i + 7) || ack.Code != 0 ||
+			ack.Seq != uint64(i + 1) || ack.MsgID <= lastID ||
+			ack.Time.Before(sent.Truncate(time.Millisecond)) {
+			t.Errorf("Text %q acked w/ %+v", text, ack)
+		}
+		lastID = ack.MsgID
+
+		got := stamped.expect(MTypeCommText).Data.(*MsgCommText)
+		if got.ClientID != 1 || got.MsgID != ack.MsgID ||
+			got.Seq != ack.Seq || !got.Time.Equal(ack.Time) ||
+			string(got.TextBytes) != text {
+			t.Errorf("CommText %+v, want the fields of ack %+v", got, ack)
+		}
+		legacyText := legacy.expect(MTypeClientText).Data.(*MsgClientText)
+		if legacyText.ClientID != 1 || string(legacyText.TextBytes) != text {
+			t.Errorf("Legacy Client got %+v", legacyText)
+		}
+	}
+
+	// rejected by moderation: nacked, & neither stamped nor recorded
+	sender.send(&Message{MTypeSendText, MsgSendText{9, []byte("\x01")}})
+	ack := sender.expect(MTypeSendAck).Data.(*MsgSendAck)
+	if ack.Nonce != 9 || ack.Code != ECodeModeration || ack.MsgID != 0 ||
+		ack.Seq != 0 {
+		t.Errorf("Rejected text acked w/ %+v", ack)
+	}
+	if seq := sender.sendAckedText(10, []byte("third")); seq != 3 {
+		t.Errorf("Text after a rejection recorded as Seq %v, want 3", seq)
+	}
+	if got := stamped.expect(MTypeCommText).Data.(*MsgCommText);
+		string(got.TextBytes) != "third" {
+		t.Errorf("CommText %q after a rejection, want \"third\"",
+			got.TextBytes)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Wire framing (see PROTOCOL.md for the full spec)
+//
+// Every Message is sent as a single frame, all integers big-endian:
+//
+//    +---------+--------+-------------+--------------------+
+//    | version | type   | length      | payload            |
+//    | uint8   | uint8  | uint32      | length bytes       |
+//    +---------+--------+-------------+--------------------+
+//
+//    - version: PROTOCOL_VERSION of the sender
+//    - type: one of the MTypeX values in messages.go
+//    - length: number of payload bytes following the header
+//    - payload: Message.Data encoded by its MarshalBinary()
+const (
+	PROTOCOL_VERSION uint8 = 1
+	FRAME_HEADER_LEN = 6 // bytes
+	// frames w/ a longer payload are rejected before it is read
+	MAX_FRAME_LEN = 64 * 1024 // bytes
+)
+
+// Capabilities negotiated w/ MsgCapabilities; Clients that never send
+// a MsgCapabilities are assumed to support DEFAULT_CAPS
+const (
+	// MsgClientRegion is accepted during auth
+	CapRegions uint32 = 1 << iota
+	// MsgJoinComm & MsgLeaveComm are accepted after auth
+	CapCommunities
+	// Joining a Community replays its recent history in MsgHistory
+	CapHistory
+	// The Server sends MsgPing heartbeats, which must be answered
+	CapHeartbeat
+	// Community text is relayed as MsgCommText, not MsgClientText
+	CapMessageIDs
+	// A MsgSession is sent after auth, which MsgResume can resume
+	CapResume
+	// A MsgRedirect is sent, rather than forwarding the connection, if
+	// the Client's region is owned by another node
+	CapRedirect
+)
+
+const (
+	// w/o CapHeartbeat: a legacy Client wouldn't know to answer a MsgPing
+	DEFAULT_CAPS = CapRegions | CapCommunities | CapHistory
+	SERVER_CAPS = DEFAULT_CAPS | CapHeartbeat | CapMessageIDs | CapResume |
+		CapRedirect
+)
+
+// ProtocolError is implemented by the errors DecodeMsg() returns when a
+// peer violates the protocol; ECode() is the MsgError code reporting it
+type ProtocolError interface {
+	error
+	ECode() uint8
+}
+
+// A frame's version is not PROTOCOL_VERSION
+type UnsupportedVersionError struct {
+	Version		uint8
+}
+
+// A frame's type is not one of the MTypeX values
+type UnknownMsgTypeError struct {
+	Type		uint8
+}
+
+// A frame's payload does not match its type's encoding
+type MalformedMsgError struct {
+	Type		uint8
+	Err			error
+}
+
+// A frame's length exceeds MAX_FRAME_LEN
+type FrameTooLargeError struct {
+	Len			uint32
+}
+
+func (e UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("Unsupported protocol version %v", e.Version)
+}
+
+func (e UnsupportedVersionError) ECode() uint8 {
+	return ECodeUnsupportedVersion
+}
+
+func (e UnknownMsgTypeError) Error() string {
+	return fmt.Sprintf("Unknown message type %v", e.Type)
+}
+
+func (e UnknownMsgTypeError) ECode() uint8 {
+	return ECodeUnknownMsgType
+}
+
+func (e MalformedMsgError) Error() string {
+	return fmt.Sprintf("Malformed %s payload: %v",
+		Message{Type: e.Type}.TypeToString(), e.Err)
+}
+
+func (e MalformedMsgError) ECode() uint8 {
+	return ECodeMalformedMsg
+}
+
+func (e MalformedMsgError) Unwrap() error {
+	return e.Err
+}
+
+func (e FrameTooLargeError) Error() string {
+	return fmt.Sprintf("Frame length %v exceeds max of %v",
+		e.Len, MAX_FRAME_LEN)
+}
+
+func (e FrameTooLargeError) ECode() uint8 {
+	return ECodeFrameTooLarge
+}
+
+// Writes msg to w as a single frame
+func EncodeMsg(w io.Writer, msg *Message) (err error) {
+	payload, err := msg.ToBinary()
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Grow(FRAME_HEADER_LEN + len(payload))
+
+	// Write frame header
+	err = binary.Write(buf, binary.BigEndian, PROTOCOL_VERSION)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(buf, binary.BigEndian, msg.Type)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(buf, binary.BigEndian, uint32(len(payload)))
+	if err != nil {
+		return err
+	}
+	_, err = buf.Write(payload)
+	if err != nil {
+		return err
+	}
+
+	// a frame is always handed to w in a single Write()
+	n, err := w.Write(buf.Bytes())
+	if err == nil {
+		metrics.Frame(FRAME_OUT, n)
+	}
+	return
+}
+
+// Reads a single frame from r; the inverse of EncodeMsg()
+func DecodeMsg(r io.Reader) (msg *Message, err error) {
+	var (
+		version 	uint8
+		msgType 	uint8
+		msgLen 		uint32
+	)
+
+	// Read frame header
+	err = binary.Read(r, binary.BigEndian, &version)
+	if err != nil {
+		return nil, err
+	}
+	if version != PROTOCOL_VERSION {
+		return nil, UnsupportedVersionError{version}
+	}
+	err = binary.Read(r, binary.BigEndian, &msgType)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(r, binary.BigEndian, &msgLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if msgLen > MAX_FRAME_LEN {
+		return nil, FrameTooLargeError{msgLen}
+	}
+
+	payload := make([]byte, msgLen)
+	// read from r until payload is full (read msgLen bytes)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	metrics.Frame(FRAME_IN, FRAME_HEADER_LEN + int(msgLen))
+
+	return MsgFromBinary(msgType, payload)
+}
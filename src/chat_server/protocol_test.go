@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// One Message of every type, w/ every field set so a field dropped by
+//    MarshalBinary() or UnmarshalBinary() fails the round trip
+var roundTripMsgs = []Message{
+	{MTypeClientAuth, MsgClientAuth{PROTOCOL_VERSION, SERVER_CAPS}},
+	{MTypeClientID, MsgClientID{0xdeadbeef}},
+	{MTypeClientName, MsgClientName{"ünïcödé name"}},
+	{MTypeClientText, MsgClientText{7, []byte("hello")}},
+	{MTypeJoinComm, MsgJoinComm{"uWaterloo"}},
+	{MTypeLeaveComm, MsgLeaveComm{}},
+	{MTypeCommJoined, MsgCommJoined{"uWaterloo"}},
+	{MTypeError, MsgError{ECodeJoinComm, "no such community"}},
+	{MTypeClientRegion, MsgClientRegion{"east"}},
+	{MTypeCapabilities, MsgCapabilities{DEFAULT_CAPS}},
+	{MTypeUserLeft, MsgUserLeft{7, "bob"}},
+	{MTypeHistoryRequest, MsgHistoryRequest{42, 10}},
+	// MsgIDs aren't part of a MsgHistory's encoding
+	{MTypeHistory, MsgHistory{"uWaterloo", []HistoryEntry{
+		{1, 0, 7, time.UnixMilli(1700000000000), []byte("first")},
+		{2, 0, 8, time.UnixMilli(1700000000001), []byte("second")},
+	}}},
+	{MTypeClientToken, MsgClientToken{"header.payload.signature"}},
+	{MTypeDirectText, MsgDirectText{9, []byte("psst")}},
+	{MTypeDirectAck, MsgDirectAck{9, DirectOffline}},
+	{MTypeRoster, MsgRoster{"uWaterloo", true, []RosterEntry{
+		{7, "bob"}, {8, "alice"},
+	}}},
+	{MTypeUserJoined, MsgUserJoined{8, "alice"}},
+	{MTypeUserRenamed, MsgUserRenamed{8, "alice2"}},
+	{MTypePing, MsgPing{1 << 63}},
+	{MTypePong, MsgPong{1 << 63}},
+	{MTypeServerShutdown, MsgServerShutdown{1500, "maintenance"}},
+	{MTypeSendText, MsgSendText{3, []byte("acked")}},
+	{MTypeSendAck, MsgSendAck{3, 0, 100, 1, time.UnixMilli(1700000000000)}},
+	{MTypeCommText, MsgCommText{7, 100, 1, time.UnixMilli(1700000000000),
+		[]byte("acked")}},
+	{MTypeSession, MsgSession{"session-token", 120000}},
+	{MTypeResume, MsgResume{5, "session-token"}},
+	{MTypeRedirect, MsgRedirect{"west", "10.0.0.2:3333"}},
+}
+
+// Returns a frame header followed by payload
+func rawFrame(version uint8, msgType uint8, length uint32,
+	payload []byte) []byte {
+	frame := []byte{version, msgType}
+	frame = binary.BigEndian.AppendUint32(frame, length)
+	return append(frame, payload...)
+}
+
+func TestProtocolRoundTrip(t *testing.T) {
+	covered := make(map[uint8]bool)
+	for _, msg := range roundTripMsgs {
+		msg := msg
+		covered[msg.Type] = true
+
+		t.Run(msg.TypeToString(), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			if err := EncodeMsg(buf, &msg); err != nil {
+				t.Fatalf("EncodeMsg() = %v", err)
+			}
+			frameLen := buf.Len()
+
+			got, err := DecodeMsg(buf)
+			if err != nil {
+				t.Fatalf("DecodeMsg() = %v", err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("DecodeMsg() left %v of %v bytes unread",
+					buf.Len(), frameLen)
+			}
+			if got.Type != msg.Type {
+				t.Errorf("Type = %v, want %v", got.Type, msg.Type)
+			}
+			// decoded Data is a pointer to the value that was encoded
+			data := reflect.ValueOf(got.Data)
+			if data.Kind() != reflect.Pointer ||
+				!reflect.DeepEqual(data.Elem().Interface(), msg.Data) {
+				t.Errorf("Data = %#v, want &%#v", got.Data, msg.Data)
+			}
+		})
+	}
+
+	for msgType := MTypeClientAuth; msgType <= MTypeRedirect; msgType++ {
+		if !covered[msgType] {
+			t.Errorf("No round trip case for %v",
+				Message{Type: msgType}.TypeToString())
+		}
+	}
+}
+
+func TestProtocolLargestFrame(t *testing.T) {
+	text := bytes.Repeat([]byte("a"), MAX_FRAME_LEN - 4) // - ClientID
+	msg := Message{MTypeClientText, MsgClientText{7, text}}
+
+	buf := new(bytes.Buffer)
+	if err := EncodeMsg(buf, &msg); err != nil {
+		t.Fatalf("EncodeMsg() = %v", err)
+	}
+	if buf.Len() != FRAME_HEADER_LEN + MAX_FRAME_LEN {
+		t.Fatalf("Frame is %v bytes, want %v",
+			buf.Len(), FRAME_HEADER_LEN + MAX_FRAME_LEN)
+	}
+	if _, err := DecodeMsg(buf); err != nil {
+		t.Errorf("DecodeMsg() = %v", err)
+	}
+}
+
+func TestProtocolDecodeErrors(t *testing.T) {
+	clientID := rawFrame(PROTOCOL_VERSION, MTypeClientID, 4,
+		[]byte{0, 0, 0, 1})
+
+	cases := []struct {
+		name	string
+		frame	[]byte
+		want	error
+	}{
+		{
+			name: "wrong version",
+			frame: rawFrame(PROTOCOL_VERSION + 1, MTypeClientID, 4,
+				[]byte{0, 0, 0, 1}),
+			want: UnsupportedVersionError{PROTOCOL_VERSION + 1},
+		},
+		{
+			name: "unknown type",
+			frame: rawFrame(PROTOCOL_VERSION, MTypeRedirect + 1, 0, nil),
+			want: UnknownMsgTypeError{MTypeRedirect + 1},
+		},
+		{
+			// rejected from the header alone, before the payload is read
+			name: "oversized",
+			frame: rawFrame(PROTOCOL_VERSION, MTypeClientText,
+				MAX_FRAME_LEN + 1, nil),
+			want: FrameTooLargeError{MAX_FRAME_LEN + 1},
+		},
+		{
+			name: "empty",
+			frame: nil,
+			want: io.EOF,
+		},
+		{
+			name: "truncated header",
+			frame: clientID[:FRAME_HEADER_LEN - 1],
+			want: io.ErrUnexpectedEOF,
+		},
+		{
+			name: "truncated payload",
+			frame: clientID[:len(clientID) - 1],
+			want: io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeMsg(bytes.NewReader(tc.frame))
+			if !errors.Is(err, tc.want) {
+				t.Errorf("DecodeMsg() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestProtocolMalformedPayload(t *testing.T) {
+	cases := []struct {
+		name	string
+		frame	[]byte
+	}{
+		{"short fixed-size", rawFrame(PROTOCOL_VERSION, MTypeClientID, 2,
+			[]byte{0, 1})},
+		{"long fixed-size", rawFrame(PROTOCOL_VERSION, MTypeClientID, 5,
+			[]byte{0, 0, 0, 1, 0})},
+		{"short variable-size", rawFrame(PROTOCOL_VERSION,
+			MTypeClientText, 3, []byte{0, 0, 7})},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeMsg(bytes.NewReader(tc.frame))
+			var malformed MalformedMsgError
+			if !errors.As(err, &malformed) {
+				t.Fatalf("DecodeMsg() = %v, want a MalformedMsgError", err)
+			}
+			if malformed.Type != tc.frame[1] {
+				t.Errorf("Type = %v, want %v", malformed.Type, tc.frame[1])
+			}
+			if malformed.ECode() != ECodeMalformedMsg {
+				t.Errorf("ECode() = %v, want %v",
+					malformed.ECode(), ECodeMalformedMsg)
+			}
+		})
+	}
+}
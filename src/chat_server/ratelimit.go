@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_TEXT_RATE = 5 // MsgClientText per second, per Client
+	DEFAULT_TEXT_BURST = 10
+	DEFAULT_USER_TEXT_RATE = 10 // per UserID, across its connections
+	DEFAULT_USER_TEXT_BURST = 20
+	DEFAULT_MUTE_DURATION = 30 * time.Second
+
+	// rate limited texts within FLOOD_STRIKE_WINDOW of each other that
+	// get a user muted
+	FLOOD_STRIKES_BEFORE_MUTE = 3
+	FLOOD_STRIKE_WINDOW = 10 * time.Second
+	// mutes within FLOOD_MUTE_WINDOW of each other that get a user
+	// disconnected
+	FLOOD_MUTES_BEFORE_DISCONNECT = 3
+	FLOOD_MUTE_WINDOW = 10 * time.Minute
+	// how often idle users' flood state is dropped
+	FLOOD_PRUNE_INTERVAL = time.Minute
+)
+
+// FloodGuard.Check() verdicts
+const (
+	FLOOD_ALLOW = iota
+	FLOOD_LIMITED // over a limit; the text is dropped
+	FLOOD_MUTED // over a limit once too often; the user is now muted
+	FLOOD_STILL_MUTED // sent while muted; the text is dropped silently
+	FLOOD_DISCONNECT // muted once too often
+)
+
+// A token bucket refilled at Rate tokens per second, up to Burst; a Rate
+//    of 0 is unlimited
+type RateLimit struct {
+	Rate	float64
+	Burst	int
+}
+
+func (l RateLimit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+// Limits on MsgClientText; Text applies to each Client unless overridden
+//    for its Server or Community, UserText to all of a user's Clients
+type RateLimitConfig struct {
+	Text			RateLimit
+	UserText		RateLimit
+	MuteDuration	time.Duration
+
+	// by "<ServerID>" or "<ServerID>/<CommID>"
+	overrides		map[string]RateLimit
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Text:			RateLimit{DEFAULT_TEXT_RATE, DEFAULT_TEXT_BURST},
+		UserText:		RateLimit{DEFAULT_USER_TEXT_RATE,
+			DEFAULT_USER_TEXT_BURST},
+		MuteDuration:	DEFAULT_MUTE_DURATION,
+		overrides:		make(map[string]RateLimit),
+	}
+}
+
+// The per-Client limit in Community commID of Server serverID; the most
+//    specific override wins
+func (rc RateLimitConfig) TextLimit(serverID string, commID string) RateLimit {
+	if l, ok := rc.overrides[serverID + "/" + commID]; ok {
+		return l
+	}
+	if l, ok := rc.overrides[serverID]; ok {
+		return l
+	}
+	return rc.Text
+}
+
+// Loads per-Server & per-Community overrides from path into rc; each
+//    non-empty line not starting w/ '#' is of the form
+//    "<ServerID>[/<CommID>] <rate> <burst>", i.e:
+//    waterloo/lobby    1    3
+func (rc *RateLimitConfig) LoadOverrides(path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	overrides := make(map[string]RateLimit)
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return errors.New(fmt.Sprintf(
+				"%s:%v: expected \"<ServerID>[/<CommID>] <rate> <burst>\"",
+				path, lineNum))
+		}
+
+		l, err := ParseRateLimit(fields[1], fields[2])
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s:%v: %v", path, lineNum, err))
+		}
+		if _, ok := overrides[fields[0]]; ok {
+			return errors.New(fmt.Sprintf("%s:%v: duplicate entry for %s",
+				path, lineNum, fields[0]))
+		}
+		overrides[fields[0]] = l
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	rc.overrides = overrides
+	return nil
+}
+
+// Parses a rate (per second) & burst; a burst below 1 is only allowed
+//    w/ a rate of 0 (unlimited)
+func ParseRateLimit(rate string, burst string) (l RateLimit, err error) {
+	l.Rate, err = strconv.ParseFloat(rate, 64)
+	if err != nil || l.Rate < 0 {
+		return l, errors.New(fmt.Sprintf("Invalid rate %q", rate))
+	}
+	l.Burst, err = strconv.Atoi(burst)
+	if err != nil || l.Burst < 0 || (l.Burst == 0 && !l.Unlimited()) {
+		return l, errors.New(fmt.Sprintf("Invalid burst %q", burst))
+	}
+	return l, nil
+}
+
+type tokenBucket struct {
+	mutex	sync.Mutex
+	limit	RateLimit // guarded by mutex
+	tokens	float64 // guarded by mutex
+	last	time.Time // last refill; guarded by mutex
+}
+
+// Starts full
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{
+		limit:	limit,
+		tokens:	float64(limit.Burst),
+		last:	time.Now(),
+	}
+}
+
+// Takes a token if one is available
+// BLOCKING: b.mutex
+func (b *tokenBucket) Allow(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.limit.Unlimited() {
+		return true
+	}
+
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+		if b.tokens > float64(b.limit.Burst) {
+			b.tokens = float64(b.limit.Burst)
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Returns a token taken by Allow(), up to the burst
+// BLOCKING: b.mutex
+func (b *tokenBucket) Refund() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.tokens < float64(b.limit.Burst) {
+		b.tokens++
+	}
+}
+
+// Keeps the tokens already taken, so hopping between Communities
+//    doesn't refill the bucket
+// BLOCKING: b.mutex
+func (b *tokenBucket) SetLimit(limit RateLimit) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.limit.Unlimited() {
+		b.tokens = float64(limit.Burst)
+	} else if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+	b.limit = limit
+}
+
+// Tracks each user's text rate, strikes & mutes across all of its
+//    Clients, so reconnecting doesn't lift a mute
+type FloodGuard struct {
+	config		RateLimitConfig
+
+	mutex		sync.Mutex
+	users		map[string]*floodState // guarded by mutex
+	lastPrune	time.Time // guarded by mutex
+}
+
+type floodState struct {
+	mutex		sync.Mutex // guards the fields below
+	bucket		*tokenBucket
+	strikes		int
+	lastStrike	time.Time
+	mutes		int
+	lastMute	time.Time
+	mutedUntil	time.Time
+	lastSeen	time.Time
+}
+
+func NewFloodGuard(config RateLimitConfig) (g *FloodGuard) {
+	g = new(FloodGuard)
+	g.config = config
+	g.users = make(map[string]*floodState)
+	g.lastPrune = time.Now()
+	return
+}
+
+// BLOCKING: g.mutex
+func (g *FloodGuard) state(userKey string, now time.Time) *floodState {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if now.Sub(g.lastPrune) > FLOOD_PRUNE_INTERVAL {
+		g.prune(now)
+	}
+
+	st, ok := g.users[userKey]
+	if !ok {
+		st = &floodState{bucket: newTokenBucket(g.config.UserText)}
+		g.users[userKey] = st
+	}
+	return st
+}
+
+// Drops users that haven't sent text in FLOOD_MUTE_WINDOW & aren't muted
+// requires g.mutex to be held
+// BLOCKING: each floodState.mutex
+func (g *FloodGuard) prune(now time.Time) {
+	for userKey, st := range g.users {
+		st.mutex.Lock()
+		idle := now.Sub(st.lastSeen) > FLOOD_MUTE_WINDOW &&
+			now.After(st.mutedUntil)
+		st.mutex.Unlock()
+		if idle {
+			delete(g.users, userKey)
+		}
+	}
+	g.lastPrune = now
+}
+
+// Whether a text from the user w/ userKey, sent through a Client limited
+//    by clientBucket, may enter its Community; mutedUntil is set once
+//    the user is muted
+// BLOCKING: g.mutex, then the user's floodState.mutex
+func (g *FloodGuard) Check(userKey string, clientBucket *tokenBucket) (
+	verdict int, mutedUntil time.Time) {
+	now := time.Now()
+	st := g.state(userKey, now)
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	st.lastSeen = now
+	if now.Before(st.mutedUntil) {
+		return FLOOD_STILL_MUTED, st.mutedUntil
+	}
+	if clientBucket.Allow(now) {
+		if st.bucket.Allow(now) {
+			return FLOOD_ALLOW, mutedUntil
+		}
+		// the text is dropped, so it mustn't count against the Client
+		clientBucket.Refund()
+	}
+
+	if now.Sub(st.lastStrike) > FLOOD_STRIKE_WINDOW {
+		st.strikes = 0
+	}
+	st.strikes++
+	st.lastStrike = now
+	if st.strikes < FLOOD_STRIKES_BEFORE_MUTE {
+		return FLOOD_LIMITED, mutedUntil
+	}
+
+	st.strikes = 0
+	if now.Sub(st.lastMute) > FLOOD_MUTE_WINDOW {
+		st.mutes = 0
+	}
+	st.mutes++
+	st.lastMute = now
+	// still muted if it reconnects
+	st.mutedUntil = now.Add(g.config.MuteDuration)
+	if st.mutes >= FLOOD_MUTES_BEFORE_DISCONNECT {
+		return FLOOD_DISCONNECT, st.mutedUntil
+	}
+	return FLOOD_MUTED, st.mutedUntil
+}
+
+// Identifies the Client's user to c.flood; Client-sent IDs stand in
+//    when AUTH_MODE is none
+func (c *Client) floodKey() string {
+	if c.UserID != "" {
+		return c.UserID
+	}
+	return strconv.FormatUint(uint64(c.ID), 10)
+}
+
+// Applies the Client's & its user's text limits, warning, muting or
+//    disconnecting it as needed; returns the ECodeX the text must be
+//    dropped w/, or 0 if it may be sent
+func (c *Client) allowText() (code uint8) {
+	verdict, mutedUntil := c.flood.Check(c.floodKey(), c.textBucket)
+	if verdict == FLOOD_ALLOW {
+		return 0
+	}
+	metrics.RateLimited(verdict)
+
+	var msgErr MsgError
+	switch verdict {
+	case FLOOD_LIMITED:
+		msgErr = MsgError{ECodeRateLimited, "Sending too fast; text dropped"}
+	case FLOOD_MUTED:
+		mutedFor := time.Until(mutedUntil).Round(time.Second)
+		c.Log().Info("Muting Client for flooding", "muted_for", mutedFor)
+		msgErr = MsgError{ECodeMuted, fmt.Sprintf(
+			"Muted for %v for sending too fast", mutedFor)}
+	case FLOOD_STILL_MUTED:
+		c.Log().Debug("Dropping text from muted Client")
+		return ECodeMuted
+	case FLOOD_DISCONNECT:
+		c.Log().Warn("Disconnecting Client for repeated flooding")
+		c.sendErrorAndDisconnect(ECodeMuted,
+			errors.New("Disconnected for repeatedly sending too fast"),
+			DISCONNECT_RATE_LIMITED)
+		return ECodeMuted
+	}
+
+	if err := c.WriteMsg(&Message{MTypeError, msgErr}); err != nil {
+		c.Log().Warn("Unable to send error", "err", err)
+	}
+	return msgErr.Code
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A text the user's bucket drops mustn't spend the Client's token too
+func TestFloodGuardRefundsClientToken(t *testing.T) {
+	slow := RateLimit{Rate: 0.001, Burst: 2} // ~no refill during the test
+	g := NewFloodGuard(RateLimitConfig{
+		UserText:		RateLimit{Rate: 0.001, Burst: 1},
+		MuteDuration:	time.Minute,
+	})
+	client := newTokenBucket(slow)
+
+	if verdict, _ := g.Check("alice", client); verdict != FLOOD_ALLOW {
+		t.Fatalf("1st Check() = %v, want FLOOD_ALLOW", verdict)
+	}
+	if verdict, _ := g.Check("alice", client); verdict != FLOOD_LIMITED {
+		t.Fatalf("2nd Check() = %v, want FLOOD_LIMITED", verdict)
+	}
+
+	// the dropped text's token was given back
+	if !client.Allow(time.Now()) {
+		t.Errorf("Client's token was spent on a text the user's limit " +
+			"dropped")
+	}
+	if client.Allow(time.Now()) {
+		t.Errorf("Client has more tokens than its burst")
+	}
+}
+
+func TestTokenBucketRefundCapped(t *testing.T) {
+	b := newTokenBucket(RateLimit{Rate: 0.001, Burst: 1})
+	b.Refund()
+
+	if !b.Allow(time.Now()) {
+		t.Fatalf("Allow() = false on a full bucket")
+	}
+	if b.Allow(time.Now()) {
+		t.Errorf("Refund() on a full bucket raised it past its burst")
+	}
+}
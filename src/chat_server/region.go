@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// RegionResolver maps a Client's IP address to the ID of the region
+//    Server it should be placed in
+type RegionResolver interface {
+	// never returns an empty ServerID; unknown IPs map to a default
+	ServerIDFromIP(ip net.IP) string
+	// whether serverID is a region this resolver can route to
+	HasServerID(serverID string) bool
+}
+
+// CIDRResolver routes IPs by longest-prefix match against a table of
+//    CIDR ranges, falling back to DefaultServerID
+type CIDRResolver struct {
+	DefaultServerID		string
+
+	entries				[]cidrEntry
+}
+
+type cidrEntry struct {
+	ipNet		*net.IPNet
+	serverID	string
+}
+
+// Resolves the region Server ID for a conn's remote address
+//    (either "host:port" or a bare host)
+func ServerIDFromIP(resolver RegionResolver, ipAddr string) (
+	serverID string, err error) {
+	host, _, err := net.SplitHostPort(ipAddr)
+	if err != nil {
+		host = ipAddr // no port
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", errors.New(fmt.Sprintf(
+			"Unable to parse IP from address %s", ipAddr))
+	}
+
+	return resolver.ServerIDFromIP(ip), nil
+}
+
+func NewCIDRResolver(defaultServerID string) (r *CIDRResolver) {
+	r = new(CIDRResolver)
+	r.DefaultServerID = defaultServerID
+	return
+}
+
+// Loads a CIDR table from path; each non-empty line not starting
+//    w/ '#' is of the form "<CIDR> <ServerID>", i.e:
+//    10.1.0.0/16    waterloo
+func LoadCIDRResolver(path string, defaultServerID string) (
+	r *CIDRResolver, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r = NewCIDRResolver(defaultServerID)
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New(fmt.Sprintf(
+				"%s:%v: expected \"<CIDR> <ServerID>\"", path, lineNum))
+		}
+		if err = r.Add(fields[0], fields[1]); err != nil {
+			return nil, errors.New(fmt.Sprintf(
+				"%s:%v: %v", path, lineNum, err))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return // r, nil
+}
+
+func (r *CIDRResolver) Add(cidr string, serverID string) (err error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	if serverID == "" {
+		return errors.New(fmt.Sprintf("Empty ServerID for %s", cidr))
+	}
+
+	r.entries = append(r.entries, cidrEntry{ipNet, serverID})
+	return
+}
+
+func (r *CIDRResolver) ServerIDFromIP(ip net.IP) string {
+	serverID := r.DefaultServerID
+	bestLen := -1
+
+	for _, e := range r.entries {
+		if !e.ipNet.Contains(ip) {
+			continue
+		}
+		if ones, _ := e.ipNet.Mask.Size(); ones > bestLen {
+			bestLen = ones
+			serverID = e.serverID
+		}
+	}
+
+	return serverID
+}
+
+func (r *CIDRResolver) HasServerID(serverID string) bool {
+	if serverID == r.DefaultServerID {
+		return true
+	}
+	for _, e := range r.entries {
+		if e.serverID == serverID {
+			return true
+		}
+	}
+	return false
+}
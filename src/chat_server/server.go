@@ -3,8 +3,10 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+    "strings"
     "sync"
+    "unicode"
 )
 
 // Server takes TCP clients from main and moves them into the
@@ -15,6 +17,11 @@ type Server struct {
     Comms       map[string]*Community
 
     // private fields
+    commsRWMutex    sync.RWMutex // guards Comms
+    history     HistoryConfig // outlives Comms shut down when empty
+    rateLimits  RateLimitConfig // resolved per Comm by s.newComm()
+    moderation  ModerationConfig // resolved per Comm by s.newComm()
+    logger      *slog.Logger // w/ server_id
     caChan      chan *ClientAction
     running     bool
     done        chan bool
@@ -22,17 +29,28 @@ type Server struct {
 }
 
 const (
+    DEFAULT_SERVER_ID = "main"
     ROOT_COMM_ID = "root"
+
+    // limits checked by s.shouldCreateComm()
+    MAX_COMMS_PER_SERVER = 1024
+    MAX_COMM_ID_LEN = 64 // bytes
+    COMM_ID_SYMBOLS = "-_." // allowed alongside letters & digits
 )
 
-func NewServer(id string) (s *Server) {
+func NewServer(id string, history HistoryConfig,
+    rateLimits RateLimitConfig, moderation ModerationConfig) (s *Server) {
     s = new(Server)
 
     s.ID = id;
+    s.history = history
+    s.rateLimits = rateLimits
+    s.moderation = moderation
+    s.logger = slog.With("server_id", id)
     s.caChan = make(chan *ClientAction)
 
     s.Comms = make(map[string]*Community)
-    s.Comms[ROOT_COMM_ID] = NewComm(ROOT_COMM_ID)
+    s.Comms[ROOT_COMM_ID] = s.newComm(ROOT_COMM_ID)
 
     s.done = make(chan bool)
 
@@ -68,13 +86,16 @@ func (s *Server) Shutdown() (err error) {
     s.loopWG.Wait()
 
     // closes all client connections in s.Comms
+    s.commsRWMutex.RLock()
+    defer s.commsRWMutex.RUnlock()
+
     var wg sync.WaitGroup
     for _, comm := range s.Comms {
         wg.Add(1)
         go func(wg *sync.WaitGroup, comm *Community) {
             defer wg.Done()
             comm.Shutdown()
-            log.Printf("Successfully shutdown Comm %v\n", comm.ID)
+            s.logger.Info("Shut down Comm", "comm_id", comm.ID)
         }(&wg, comm)
     }
     wg.Wait()
@@ -84,7 +105,7 @@ func (s *Server) Shutdown() (err error) {
 
 func (s *Server) controlLoop() {
     defer func() {
-        log.Printf("Server %s exiting controlLoop()\n", s.ID)
+        s.logger.Debug("Exiting controlLoop()")
         s.loopWG.Done()
     }()
 
@@ -92,7 +113,6 @@ ControlLoop:
     for {
         select {
         case <-s.done:
-            log.Printf("Server %s exiting control loop.\n", s.ID)
             break ControlLoop
         case caPtr := <-s.caChan:
             s.handleCA(caPtr)
@@ -102,13 +122,31 @@ ControlLoop:
     // deferred s.loopWG.Done() called
 }
 
+// Communities recreated w/ the same ID pick up the same history
+func (s *Server) newComm(commID string) *Community {
+    return NewComm(commID, s.history, HistoryLogID(s.ID, commID),
+        s.rateLimits.TextLimit(s.ID, commID),
+        s.moderation.Chain(s.ID, commID), s.logger)
+}
+
+func (s *Server) route() caRoute {
+    return caRoute{s.caChan, s.done}
+}
+
 // method implementations in client_actions.go
 func (s *Server) handleCA(caPtr *ClientAction) {
     switch caPtr.Action.(type) {
     case JoinServer:
         s.CAJoinServer(caPtr)
+    case JoinComm:
+        s.CAJoinComm(caPtr)
+    case LeaveComm:
+        s.CALeaveComm(caPtr)
+    case LeaveServer:
+        s.CALeaveServer(caPtr)
     default: // should never happen
-        log.Fatalf("(s) Encountered invalid ClientAction: %v\n", (*caPtr))
+        fatal(s.logger, "Encountered invalid ClientAction",
+            "action", fmt.Sprintf("%#v", *caPtr))
     }
 }
 
@@ -124,52 +162,180 @@ func (s *Server) AddClientToRootComm(cPtr *Client) (err error) {
     return
 }
 
+// BLOCKING: s.commsRWMutex
 func (s *Server) AddClient(cPtr *Client) (err error) {
+    s.commsRWMutex.Lock()
     comm, ok := s.Comms[cPtr.CommID]
     if !ok {
         if s.shouldCreateComm(cPtr.CommID) {
-            s.Comms[cPtr.CommID] = NewComm(cPtr.CommID)
+            s.Comms[cPtr.CommID] = s.newComm(cPtr.CommID)
             comm = s.Comms[cPtr.CommID]
         } else {
+            s.commsRWMutex.Unlock()
             return errors.New(fmt.Sprintf(
                 "(s.AddClient) Comm %s DNE", cPtr.CommID))
         }
     }
 
-    if err = comm.AddClient(cPtr); err != nil {
+    if err = comm.Join(cPtr); err != nil {
+        s.commsRWMutex.Unlock()
         return errors.New(fmt.Sprintf(
             "(s.AddClient) %v", err))
     }
 
-    cPtr.SetCAChans(s.caChan, comm.caChan)
+    cPtr.setLogContext("server_id", s.ID, "comm_id", comm.ID)
+    cPtr.setPlacement(s.ID, comm.ID)
+    cPtr.textBucket.SetLimit(comm.TextLimit)
+    cPtr.SetCAChans(s.route(), comm.route())
+    s.commsRWMutex.Unlock()
+
+    // the Client may have disconnected while it had no chans to send its
+    // LeaveServer on (see Client.Disconnect())
+    if cPtr.IsDisconnected() {
+        s.RemoveClient(cPtr) // ignore errors
+    }
+
+    return
+}
+
+// Moves cPtr out of its current Community & into the Community w/ ID
+//    commID, which is created if s.shouldCreateComm(commID)
+func (s *Server) MoveClient(cPtr *Client, commID string) (err error) {
+    fromCommID := cPtr.CommID
+    if fromCommID == commID {
+        return // already in commID
+    }
+
+    if err = s.RemoveClient(cPtr); err != nil {
+        return err
+    }
+
+    cPtr.CommID = commID
+    if err = s.AddClient(cPtr); err != nil {
+        // put the Client back where it came from
+        cPtr.CommID = fromCommID
+        if addErr := s.AddClient(cPtr); addErr != nil {
+            s.logger.Error("Unable to return Client to its Comm",
+                "client_id", cPtr.ID, "comm_id", fromCommID, "err", addErr)
+        }
+        return err
+    }
 
     return
 }
 
+// Whether this Server may create a new Community w/ ID commID
+// requires s.commsRWMutex to be held
 func (s *Server) shouldCreateComm(commID string) bool {
-    // TODO: properly check whether or not this Server w/ ID s.ID
-    //       should actually create a Community w/ ID CommID
-    return true
+    if commID == "" || len(commID) > MAX_COMM_ID_LEN {
+        return false
+    }
+    for _, r := range commID {
+        if !unicode.IsLetter(r) && !unicode.IsDigit(r) &&
+            !strings.ContainsRune(COMM_ID_SYMBOLS, r) {
+            return false
+        }
+    }
+
+    return len(s.Comms) < MAX_COMMS_PER_SERVER
 }
 
+// Removes cPtr from its current Community, shutting the Community down
+//    if it's left empty (except for the root Community)
+// BLOCKING: s.commsRWMutex
 func (s *Server) RemoveClient(cPtr *Client) (err error) {
+    s.commsRWMutex.Lock()
     comm, ok := s.Comms[cPtr.CommID]
     if !ok {
+        s.commsRWMutex.Unlock()
         return errors.New(fmt.Sprintf(
             "(s.RemoveClient) Comm %s DNE", cPtr.CommID))
     }
+    if !comm.HasClient(cPtr) {
+        s.commsRWMutex.Unlock()
+        return errors.New(fmt.Sprintf(
+            "(s.RemoveClient) %s DNE in Comm %s",
+            cPtr.ToString(), comm.ID))
+    }
+
+    // waits for any in-flight ClientAction from cPtr to reach comm
+    cPtr.RemoveCAChans()
 
-    // remove Client from current Community
-    if err = comm.RemoveClient(cPtr); err != nil {
+    // remove Client from current Community, notifying the remaining members
+    if err = comm.Leave(cPtr); err != nil {
+        s.commsRWMutex.Unlock()
         return errors.New(fmt.Sprintf(
             "(s.RemoveClient) %v", err))
     }
 
-    cPtr.RemoveCAChans()
+    // no Client holds a route to an empty Community
+    if comm.ID != ROOT_COMM_ID && comm.Len() == 0 {
+        delete(s.Comms, comm.ID)
+        s.commsRWMutex.Unlock()
 
-    // replace Client in "root" Community
-    cPtr.CommID = ROOT_COMM_ID
-    s.AddClient(cPtr)
+        s.logger.Info("Shutting down empty Comm", "comm_id", comm.ID)
+        return comm.Shutdown()
+    }
+    s.commsRWMutex.Unlock()
+
+    return
+}
+
+// BLOCKING: s.commsRWMutex (read)
+func (s *Server) GetComm(commID string) (comm *Community, ok bool) {
+    s.commsRWMutex.RLock()
+    defer s.commsRWMutex.RUnlock()
 
+    comm, ok = s.Comms[commID]
     return
+}
+
+// BLOCKING: s.commsRWMutex (read)
+func (s *Server) FindClient(cID uint32) (cPtr *Client, ok bool) {
+    s.commsRWMutex.RLock()
+    defer s.commsRWMutex.RUnlock()
+
+    for _, comm := range s.Comms {
+        comm.clientsRWMutex.RLock()
+        cPtr, ok = comm.Clients[cID]
+        comm.clientsRWMutex.RUnlock()
+        if ok {
+            return
+        }
+    }
+
+    return nil, false
+}
+
+// Disconnects every Client in the Community; the root Community
+//    cannot be shut down
+// BLOCKING: s.commsRWMutex
+func (s *Server) ShutdownComm(commID string) (err error) {
+    if commID == ROOT_COMM_ID {
+        return errors.New(fmt.Sprintf(
+            "Cannot shut down Comm %s", ROOT_COMM_ID))
+    }
+
+    s.commsRWMutex.Lock()
+    comm, ok := s.Comms[commID]
+    if ok {
+        delete(s.Comms, commID)
+    }
+    s.commsRWMutex.Unlock()
+
+    if !ok {
+        return errors.New(fmt.Sprintf(
+            "(s.ShutdownComm) Comm %s DNE", commID))
+    }
+
+    // members' sessions resume in the root Community rather than
+    //    recreating this one; see also SessionStore.ClearComm()
+    comm.clientsRWMutex.RLock()
+    for _, cPtr := range comm.Clients {
+        cPtr.setPlacement(s.ID, "")
+    }
+    comm.clientsRWMutex.RUnlock()
+
+    s.logger.Info("Shutting down Comm", "comm_id", commID)
+    return comm.Shutdown()
 }
\ No newline at end of file
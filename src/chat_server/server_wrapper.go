@@ -2,9 +2,26 @@ package main
 
 import (
     "errors"
-    "log"
+    "fmt"
+    "log/slog"
+    "math/rand"
     "net"
+    "net/http"
     "sync"
+    "time"
+)
+
+const (
+    DEFAULT_SHUTDOWN_TIMEOUT = 5 * time.Second
+    // Clients are told to reconnect after a random delay in
+    //    [SHUTDOWN_RECONNECT_MIN, SHUTDOWN_RECONNECT_MIN +
+    //    SHUTDOWN_RECONNECT_SPREAD), so they don't all return at once
+    SHUTDOWN_RECONNECT_MIN = time.Second
+    SHUTDOWN_RECONNECT_SPREAD = 10 * time.Second
+    SHUTDOWN_REASON = "Server shutting down"
+
+    // wait after a failed Accept() before trying again
+    ACCEPT_RETRY_DELAY = 50 * time.Millisecond
 )
 
 // ServerWrapper houses the acceptLoop which takes TCP connections
@@ -14,8 +31,29 @@ type ServerWrapper struct {
     Servers       map[string]*Server
 
     // private fields
-    tcpl        *net.TCPListener
-    connChan    chan *net.Conn
+    serversRWMutex  sync.RWMutex // guards Servers; written by controlLoop
+    tcpl        net.Listener // wrapped by TLS if configured
+    wsl         net.Listener // nil unless WS_PORT is set
+    wsServer    *http.Server // serves WebSocket upgrades on wsl
+    connChan    chan ClientConn
+    resolver    RegionResolver // picks a Server for each new Client
+    auth        Authenticator // nil if Clients aren't verified
+    ids         *IDTable // assigns verified users' Client IDs
+
+    // every authenticated Client by ID, for direct messages; an ID is
+    // only held by 1 connected Client at a time (see addToDirectory())
+    directory   map[uint32]*Client
+    directoryRWMutex    sync.RWMutex // guards directory
+    history     HistoryConfig // shared by all Servers
+    writeQueue  WriteQueueConfig // applied to each new Client
+    heartbeat   HeartbeatConfig // applied to each new Client
+    rateLimits  RateLimitConfig // applied to each new Server
+    moderation  ModerationConfig // applied to each new Server
+    flood       *FloodGuard // tracks users' text rates & mutes
+    sessions    *SessionStore // lets Clients w/ CapResume reconnect
+    cluster     *Cluster // which node owns each region Server
+    // longest Shutdown() waits for Clients to receive MsgServerShutdown
+    shutdownTimeout time.Duration
 
     // TODO: make global method to send CA into sw.caChan (?)
     caChan		chan *ClientAction
@@ -27,33 +65,156 @@ type ServerWrapper struct {
 
 // newServerWrapper() defined in main.go (private to main)
 
+// Starts accepting & placing Clients, & handling the cluster's other
+//    nodes' envelopes
+func (sw *ServerWrapper) Start() (err error) {
+    if sw.cluster.bus != nil {
+        err = sw.cluster.bus.Listen(sw.handleBusEnvelope, sw.nodeDown)
+        if err != nil {
+            return errors.New(fmt.Sprintf(
+                "Unable to join cluster bus: %v", err))
+        }
+    }
+
+    sw.loopWG.Add(3)
+    go sw.acceptLoop()
+    go sw.clientBuilderLoop()
+    go sw.controlLoop()
+    if sw.wsServer != nil {
+        sw.loopWG.Add(1)
+        go sw.serveWebSocket()
+    }
+    return
+}
+
 func (sw *ServerWrapper) Shutdown() (err error) {
     if !sw.running { // TODO: atomic boolean/mutex
         return errors.New("ServerWrapper already stopped.")
     }
     sw.running = false
-    log.Println("Shutting down Servers (ServerWrapper.Shutdown()")
+    slog.Info("Shutting down Servers")
 
     // signal server loops to stop processing
     close(sw.done) // all receivers read the zero value (false)
     sw.tcpl.Close() // stop accepting TCP connections
-    close(sw.connChan) // stop building TCP Clients
+    if sw.wsServer != nil {
+        sw.wsServer.Close() // stop accepting WebSocket connections
+    }
     sw.loopWG.Wait()
 
-    // close all client connections in s.Comms
+    // Servers keep running, so drained Clients leave them as usual
+    sw.drainClients()
+
+    // close all remaining client connections in s.Comms
+    sw.serversRWMutex.RLock()
+    defer sw.serversRWMutex.RUnlock()
+
     var wg sync.WaitGroup
     for _, s := range sw.Servers {
         wg.Add(1)
         go func(wg *sync.WaitGroup, s *Server) {
             defer wg.Done()
             s.Shutdown()
-            log.Printf("Successfully shutdown Server %v\n", s.ID)
+            s.logger.Info("Shut down Server")
         }(&wg, s)
     }
-    log.Println("Waiting on all Servers to shut down...")
+    slog.Debug("Waiting on all Servers to shut down")
     wg.Wait()
-    log.Println("All Servers successfully shut down")
+    slog.Info("All Servers shut down")
+
+    if err = sw.history.Store.Close(); err != nil {
+        slog.Error("Unable to close history store", "err", err)
+    }
+    // left open until now for forwarded Clients to drain
+    if err = sw.cluster.Close(); err != nil {
+        slog.Error("Unable to close cluster bus", "err", err)
+    }
+
+    return
+}
+
+// Sends every Client a MsgServerShutdown & disconnects each once its
+//    queued Messages have been written; those still draining after
+//    sw.shutdownTimeout are left for the Servers to force-close
+func (sw *ServerWrapper) drainClients() {
+    clients := sw.allClients()
+    slog.Info("Draining Clients", "clients", len(clients),
+        "timeout", sw.shutdownTimeout)
+
+    var wg sync.WaitGroup
+    for _, c := range clients {
+        wg.Add(1)
+        go func(wg *sync.WaitGroup, c *Client) {
+            defer wg.Done()
+            err := c.WriteMsgAndWait(&Message{MTypeServerShutdown,
+                MsgServerShutdown{reconnectHint(), SHUTDOWN_REASON}})
+            if err != nil {
+                c.Log().Info("Unable to send shutdown", "err", err)
+            }
+            c.Disconnect(DISCONNECT_SHUTDOWN)
+        }(&wg, c)
+    }
+
+    drained := make(chan bool)
+    go func() {
+        wg.Wait()
+        close(drained)
+    }()
+
+    select {
+    case <-drained:
+        slog.Info("All Clients drained")
+    case <-time.After(sw.shutdownTimeout):
+        slog.Warn("Clients not drained in time; force-closing them",
+            "timeout", sw.shutdownTimeout)
+    }
+}
+
+// Milliseconds a Client should wait before reconnecting after shutdown
+func reconnectHint() uint32 {
+    delay := SHUTDOWN_RECONNECT_MIN +
+        time.Duration(rand.Int63n(int64(SHUTDOWN_RECONNECT_SPREAD)))
+    return uint32(delay / time.Millisecond)
+}
+
+// Every Client in sw.directory, placed in a Community of any Server or
+//    forwarded to another node; the directory holds Clients between
+//    Communities, the Communities hold Clients replaced in the directory
+//    by a newer connection
+// BLOCKING: sw.cluster.mutex, sw.directoryRWMutex (read),
+//    sw.serversRWMutex (read), s.commsRWMutex (read),
+//    comm.clientsRWMutex (read)
+func (sw *ServerWrapper) allClients() (clients []*Client) {
+    seen := make(map[*Client]bool)
+
+    for _, cPtr := range sw.cluster.forwardedClients() {
+        seen[cPtr] = true
+    }
+
+    sw.directoryRWMutex.RLock()
+    for _, cPtr := range sw.directory {
+        seen[cPtr] = true
+    }
+    sw.directoryRWMutex.RUnlock()
+
+    sw.serversRWMutex.RLock()
+    for _, s := range sw.Servers {
+        s.commsRWMutex.RLock()
+        for _, comm := range s.Comms {
+            comm.clientsRWMutex.RLock()
+            for _, cPtr := range comm.Clients {
+                seen[cPtr] = true
+            }
+            comm.clientsRWMutex.RUnlock()
+        }
+        s.commsRWMutex.RUnlock()
+    }
+    sw.serversRWMutex.RUnlock()
 
+    clients = make([]*Client, 0, len(seen))
+    for cPtr := range seen {
+        clients = append(clients, cPtr)
+    }
     return
 }
 
@@ -62,28 +223,28 @@ func (sw *ServerWrapper) Shutdown() (err error) {
 func (sw *ServerWrapper) acceptLoop() {
     // sw.tcpl should've been resolved and initialized already
     defer func() {
-        log.Println("ServerWrapper exiting acceptLoop()")
+        slog.Debug("ServerWrapper exiting acceptLoop()")
         sw.loopWG.Done()
     }()
 
 AcceptLoop:
     for {
         conn, err := sw.tcpl.Accept()
-        // TODO: check if err is "use of closed connection" -> break
-        if err != nil {
-            log.Printf("Unable to accept TCP connection: %v\n", err)
-        }
-        if conn == nil { // tcpl was closed
+        if errors.Is(err, net.ErrClosed) { // closed by sw.Shutdown()
             break AcceptLoop
+        } else if err != nil {
+            slog.Error("Unable to accept TCP connection", "err", err)
+            time.Sleep(ACCEPT_RETRY_DELAY) // e.g. out of file descriptors
+            continue
         }
 
         select {
         case <-sw.done:
             conn.Close() // ignoring errors
             break AcceptLoop // exit for-loop
-        case sw.connChan <- &conn: // send conn to client builder
+        case sw.connChan <- newTCPConn(conn): // send to client builder
         /*case <-time.After(time.Millisecond*10000):
-            log.Println(`ServerWrapper timed out trying to send
+            slog.Warn(`ServerWrapper timed out trying to send
                 conn to clientBuilderLoop; closing conn`)
             conn.Close() // ignoring errors*/
         }
@@ -92,46 +253,136 @@ AcceptLoop:
     // deferred sw.loopWG.Done() called
 }
 
-// Performs initial Client building process from a net.Conn
+// Performs initial Client building process from a ClientConn
 func (sw *ServerWrapper) clientBuilderLoop() {
     defer func() {
-        log.Println("ServerWrapper exiting clientBuilderLoop()")
+        slog.Debug("ServerWrapper exiting clientBuilderLoop()")
         sw.loopWG.Done()
     }()
 
 CBLoop:
-    for connPtr := range sw.connChan {
-        if (connPtr == nil) {
-            break CBLoop // sw.connChan was closed
-        }
-
-        c, err := NewClient(connPtr)
-        if err != nil {
-            log.Printf(
-                "Unable to create Client object for conn: %v\n",
-                err)
-            continue // wait for next conn
-        }
-
+    for {
         select {
         case <-sw.done:
-            c.Disconnect() 
-            break // exit for-loop
-        case sw.caChan <- &ClientAction{
-                ClientID:   (*c).ID,
-                Action:     JoinServer{c.ServerID, c},
-            }:
+            break CBLoop
+        case conn := <-sw.connChan:
+            // auth may take up to AUTH_TIMEOUT; don't block other conns
+            sw.loopWG.Add(1)
+            go sw.buildClient(conn)
         }
     }
 
     // deferred sw.loopWG.Done() called
 }
 
+// Builds & authenticates a single Client, then hands it off to
+//    sw.controlLoop() for Server placement, or to the node owning its
+//    region
+func (sw *ServerWrapper) buildClient(conn ClientConn) {
+    defer sw.loopWG.Done()
+
+    c, err := NewClient(conn, sw)
+    if err != nil {
+        slog.Info("Unable to create Client for conn",
+            "remote_addr", conn.RemoteAddr().String(), "err", err)
+        return
+    }
+
+    if owner, local := sw.cluster.Owner(c.ServerID); !local {
+        sw.handOff(c, owner)
+        return
+    }
+    c.setRouted(nil)
+    sw.placeClient(c)
+}
+
+// Lists the Client in sw.directory & sends it to sw.controlLoop() for
+//    Server placement
+func (sw *ServerWrapper) placeClient(c *Client) {
+    // the resumed session's old connection may not have noticed the drop
+    if c.resumed != nil && c.resumed.prev != nil {
+        c.resumed.prev.Disconnect(DISCONNECT_RESUMED)
+    }
+
+    replaced, err := sw.addToDirectory(c)
+    if err != nil {
+        c.Log().Warn("Auth failed", "err", err)
+        metrics.AuthFailure()
+        c.sendErrorAndDisconnect(ECodeAuth, err, DISCONNECT_AUTH_FAILED)
+        return
+    }
+    // sends its LeaveServer before c's JoinServer is sent
+    if replaced != nil {
+        replaced.Disconnect(DISCONNECT_REPLACED)
+    }
+    c.issueSession()
+    go func() {
+        <-c.Closed()
+        sw.removeFromDirectory(c)
+        sw.sessions.Detach(c)
+    }()
+
+    select {
+    case <-sw.done:
+        c.Disconnect(DISCONNECT_SHUTDOWN)
+    case sw.caChan <- &ClientAction{
+            ClientID:   (*c).ID,
+            Action:     JoinServer{c.ServerID, c},
+        }:
+    }
+}
+
+// Fails if another connected Client already holds c's ID, so a Client
+//    can't take over another's direct messages by sending its ID; a
+//    verified user's newer connection replaces its older one instead,
+//    which is returned for the caller to disconnect
+// BLOCKING: sw.directoryRWMutex
+func (sw *ServerWrapper) addToDirectory(c *Client) (replaced *Client,
+    err error) {
+    sw.directoryRWMutex.Lock()
+    defer sw.directoryRWMutex.Unlock()
+
+    if prev, ok := sw.directory[c.ID]; ok && prev != c &&
+        !prev.IsDisconnected() {
+        if c.UserID == "" || prev.UserID != c.UserID {
+            return nil, errors.New(fmt.Sprintf(
+                "Client ID %v is already connected", c.ID))
+        }
+        replaced = prev
+    }
+    sw.directory[c.ID] = c
+    return
+}
+
+// No-op if c's ID has since been taken by a newer connection
+// BLOCKING: sw.directoryRWMutex
+func (sw *ServerWrapper) removeFromDirectory(c *Client) {
+    sw.directoryRWMutex.Lock()
+    defer sw.directoryRWMutex.Unlock()
+
+    if sw.directory[c.ID] == c {
+        delete(sw.directory, c.ID)
+    }
+}
+
+// BLOCKING: sw.directoryRWMutex (read)
+func (sw *ServerWrapper) lookupDirectory(cID uint32) (c *Client, ok bool) {
+    sw.directoryRWMutex.RLock()
+    defer sw.directoryRWMutex.RUnlock()
+
+    c, ok = sw.directory[cID]
+    return
+}
+
+func (sw *ServerWrapper) route() caRoute {
+    return caRoute{sw.caChan, sw.done}
+}
+
 // Controls processing of major events in response to tcp conn,
 //    API requests, internal Server-Server communication, etc.
 func (sw *ServerWrapper) controlLoop() {
     defer func() {
-        log.Println("ServerWrapper exiting controlLoop()")
+        slog.Debug("ServerWrapper exiting controlLoop()")
         sw.loopWG.Done()
     }()
 
@@ -153,7 +404,45 @@ func (sw *ServerWrapper) handleCA(caPtr *ClientAction) {
 	switch caPtr.Action.(type) {
 	case JoinServer:
 		sw.CAJoinServer(caPtr)
+	case SendDirect:
+		sw.CASendDirect(caPtr)
 	default: // should never happen
-		log.Fatalf("(sw) Encountered invalid ClientAction: %v\n", (*caPtr))
+		fatal(slog.Default(), "Encountered invalid ClientAction",
+			"action", fmt.Sprintf("%#v", *caPtr))
 	}
 }
+
+// BLOCKING: sw.serversRWMutex (read)
+func (sw *ServerWrapper) GetServer(sID string) (s *Server, ok bool) {
+    sw.serversRWMutex.RLock()
+    defer sw.serversRWMutex.RUnlock()
+
+    s, ok = sw.Servers[sID]
+    return
+}
+
+// Searches every Server if sID is empty, then the Clients this node
+//    forwarded to others
+// BLOCKING: sw.serversRWMutex (read), sw.cluster.mutex
+func (sw *ServerWrapper) FindClient(sID string, cID uint32) (
+    cPtr *Client, ok bool) {
+    sw.serversRWMutex.RLock()
+    for _, s := range sw.Servers {
+        if sID != "" && s.ID != sID {
+            continue
+        }
+        if cPtr, ok = s.FindClient(cID); ok {
+            sw.serversRWMutex.RUnlock()
+            return
+        }
+    }
+    sw.serversRWMutex.RUnlock()
+
+    for _, cPtr = range sw.cluster.forwardedClients() {
+        if cPtr.ID == cID && (sID == "" || cPtr.ServerID == sID) {
+            return cPtr, true
+        }
+    }
+
+    return nil, false
+}
\ No newline at end of file
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Shutdown() writes each Client what was queued for it, then a
+//    MsgServerShutdown, before closing its conn & the listener
+func TestShutdownDrainsClients(t *testing.T) {
+	t.Setenv("HISTORY_DIR", "")
+	t.Setenv("TEXT_RATE", "1000")
+	t.Setenv("TEXT_BURST", "1000")
+	t.Setenv("USER_TEXT_RATE", "1000")
+	t.Setenv("USER_TEXT_BURST", "1000")
+	sw := startTestNode(t)
+	before := disconnectCount(DISCONNECT_SHUTDOWN)
+
+	sender := dialTestClient(t, clientAddr(sw), 1, DEFAULT_SERVER_ID, 0)
+	sender.expectRoster(ROOT_COMM_ID)
+	receiver := dialTestClient(t, clientAddr(sw), 2, DEFAULT_SERVER_ID, 0)
+	receiver.expectRoster(ROOT_COMM_ID)
+
+	// left unread by receiver until the shutdown; once the last is acked,
+	//    the Community has relayed them all
+	const queued = 20
+	for i := 0; i < queued - 1; i++ {
+		sender.send(&Message{MTypeClientText, MsgClientText{
+			1, []byte(fmt.Sprint(i))}})
+	}
+	sender.sendAckedText(1, []byte(fmt.Sprint(queued - 1)))
+
+	shutDown := make(chan error, 1)
+	go func() { shutDown <- sw.Shutdown() }()
+
+	next := 0
+	var notice *MsgServerShutdown
+	for notice == nil {
+		msg := receiver.read()
+		switch msg.Type {
+		case MTypeClientText:
+			if text := msg.Data.(*MsgClientText);
+				string(text.TextBytes) != fmt.Sprint(next) {
+				t.Fatalf("Text %q, want %v", text.TextBytes, next)
+			}
+			next++
+		case MTypeServerShutdown:
+			notice = msg.Data.(*MsgServerShutdown)
+		}
+	}
+	if next != queued {
+		t.Errorf("%v texts written before the shutdown, want %v", next,
+			queued)
+	}
+	after := time.Duration(notice.ReconnectAfter) * time.Millisecond
+	if after < SHUTDOWN_RECONNECT_MIN || after >=
+		SHUTDOWN_RECONNECT_MIN + SHUTDOWN_RECONNECT_SPREAD ||
+		notice.Reason != SHUTDOWN_REASON {
+		t.Errorf("Shutdown notice %+v", notice)
+	}
+	receiver.expectClosed()
+	sender.expect(MTypeServerShutdown)
+	sender.expectClosed()
+
+	select {
+	case err := <-shutDown:
+		if err != nil {
+			t.Errorf("Shutdown() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown() still draining")
+	}
+	if n := disconnectCount(DISCONNECT_SHUTDOWN); n != before + 2 {
+		t.Errorf("%v shutdown disconnects, want %v", n, before + 2)
+	}
+	if conn, err := net.Dial("tcp", clientAddr(sw)); err == nil {
+		conn.Close()
+		t.Errorf("Connected after Shutdown()")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how long a disconnected Client's session may be resumed for
+	DEFAULT_SESSION_GRACE = 2 * time.Minute
+	SESSION_TOKEN_LEN = 32 // random bytes, before encoding
+	// how often expired sessions are dropped
+	SESSION_PRUNE_INTERVAL = time.Minute
+	// most history entries replayed to a resumed Client; it may page
+	// back through the rest w/ MsgHistoryRequest
+	MAX_RESUME_REPLAY = 500
+)
+
+var errSessionExpired = errors.New("Unknown or expired session")
+
+// Issues session tokens to Clients w/ CapResume & resumes their sessions
+//    on a new connection, until grace after they disconnect
+type SessionStore struct {
+	grace		time.Duration
+
+	mutex		sync.Mutex
+	sessions	map[string]*session // by token; guarded by mutex
+	lastPrune	time.Time // guarded by mutex
+}
+
+// What a resumed Client picks back up
+type session struct {
+	id			uint32
+	userID		string
+	name		string
+	client		*Client // nil once it disconnects
+	serverID	string // where client was placed when it disconnected
+	commID		string
+	expires		time.Time // set once client disconnects
+}
+
+// The session a Client resumed w/ a MsgResume
+type resumedSession struct {
+	serverID	string
+	commID		string
+	lastSeq		uint64 // highest Seq of commID the Client had received
+	prev		*Client // still connected, if it hadn't noticed the drop
+	replayed	int32 // 1 once the missed entries were replayed; sync/atomic
+}
+
+// Where a Client was last placed; see Server.AddClient()
+type placement struct {
+	serverID	string
+	commID		string // "" once the Community was shut down
+}
+
+// A grace of 0 disables sessions
+func NewSessionStore(grace time.Duration) (ss *SessionStore) {
+	ss = new(SessionStore)
+	ss.grace = grace
+	ss.sessions = make(map[string]*session)
+	ss.lastPrune = time.Now()
+	return
+}
+
+func (ss *SessionStore) Enabled() bool {
+	return ss.grace > 0
+}
+
+// Starts a session for c, which must have completed auth
+// BLOCKING: ss.mutex
+func (ss *SessionStore) Issue(c *Client) (token string, err error) {
+	bin := make([]byte, SESSION_TOKEN_LEN)
+	if _, err = rand.Read(bin); err != nil {
+		return "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(bin)
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.pruneIfDue(time.Now())
+	ss.sessions[token] = &session{
+		id:		c.ID,
+		userID:	c.UserID,
+		name:	c.DisplayName(),
+		client:	c,
+	}
+	c.sessionToken = token
+	return token, nil
+}
+
+// Takes over the session w/ token, which can't be resumed again
+// BLOCKING: ss.mutex
+func (ss *SessionStore) Resume(token string) (sess session, err error) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	now := time.Now()
+	ss.pruneIfDue(now)
+
+	s, ok := ss.sessions[token]
+	if !ok || (s.client == nil && now.After(s.expires)) {
+		return sess, errSessionExpired
+	}
+	delete(ss.sessions, token)
+
+	if s.client != nil {
+		s.serverID, s.commID = s.client.Placement()
+	}
+	return *s, nil
+}
+
+// Starts c's grace window, now that it's disconnected; no-op if its
+//    session was resumed or ended
+// BLOCKING: ss.mutex
+func (ss *SessionStore) Detach(c *Client) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	s, ok := ss.sessions[c.sessionToken]
+	if !ok || s.client != c {
+		return
+	}
+	s.client = nil
+	s.serverID, s.commID = c.Placement()
+	s.expires = time.Now().Add(ss.grace)
+}
+
+// Ends c's session, so it can't be resumed
+// BLOCKING: ss.mutex
+func (ss *SessionStore) End(c *Client) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if s, ok := ss.sessions[c.sessionToken]; ok && s.client == c {
+		delete(ss.sessions, c.sessionToken)
+	}
+}
+
+// Drops Community commID of Server serverID, which was shut down, from
+//    the sessions of Clients that left it before, so they resume in the
+//    root Community rather than recreating it
+// BLOCKING: ss.mutex
+func (ss *SessionStore) ClearComm(serverID string, commID string) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	for _, s := range ss.sessions {
+		if s.client == nil && s.serverID == serverID && s.commID == commID {
+			s.commID = ""
+		}
+	}
+}
+
+// requires ss.mutex to be held
+func (ss *SessionStore) pruneIfDue(now time.Time) {
+	if now.Sub(ss.lastPrune) < SESSION_PRUNE_INTERVAL {
+		return
+	}
+	for token, s := range ss.sessions {
+		if s.client == nil && now.After(s.expires) {
+			delete(ss.sessions, token)
+		}
+	}
+	ss.lastPrune = now
+}
+
+// Picks up the session w/ token, as sent in a MsgResume during auth;
+//    c's identity & placement are the session's
+func (c *Client) resumeSession(token string, lastSeq uint64) (err error) {
+	if c.ID != INVALID_CLIENT_USERID || c.UserID != "" {
+		return errors.New("Resume must come before ClientID & ClientToken")
+	}
+
+	sess, err := c.sessions.Resume(token)
+	if err != nil {
+		metrics.Resume(false)
+		return err
+	}
+	metrics.Resume(true)
+
+	c.ID = sess.id
+	c.UserID = sess.userID
+	c.SetName(sess.name)
+	c.resumed = &resumedSession{
+		serverID:	sess.serverID,
+		commID:		sess.commID,
+		lastSeq:	lastSeq,
+		prev:		sess.client,
+	}
+	c.Log().Info("Resumed session", "client_id", c.ID,
+		"server_id", sess.serverID, "comm_id", sess.commID,
+		"last_seq", lastSeq)
+	return
+}
+
+// Tells the Client its session token; sessions are only issued to
+//    Clients w/ CapResume, & not to those forwarded from another node,
+//    which they'd reconnect to
+func (c *Client) issueSession() {
+	if !c.sessions.Enabled() || c.Caps() & CapResume == 0 ||
+		c.forwardedFrom != "" {
+		return
+	}
+
+	token, err := c.sessions.Issue(c)
+	if err != nil {
+		c.Log().Error("Unable to issue session", "err", err)
+		return
+	}
+
+	err = c.WriteMsg(&Message{MTypeSession, MsgSession{
+		Token:	token,
+		Grace:	uint32(c.sessions.grace / time.Millisecond),
+	}})
+	if err != nil {
+		c.Log().Warn("Unable to send session", "err", err)
+	}
+}
+
+// The Server & Community the Client was last added to
+func (c *Client) Placement() (serverID string, commID string) {
+	if p := c.placement.Load(); p != nil {
+		return p.serverID, p.commID
+	}
+	return "", ""
+}
+
+func (c *Client) setPlacement(serverID string, commID string) {
+	c.placement.Store(&placement{serverID, commID})
+}
+
+// The Seq the Client had received up to in its resumed Community commID;
+//    ok is true only the 1st time it (re)joins commID
+func (c *Client) missedAfter(commID string) (lastSeq uint64, ok bool) {
+	r := c.resumed
+	if r == nil || r.commID != commID || r.lastSeq == 0 {
+		return 0, false
+	}
+	if !atomic.CompareAndSwapInt32(&r.replayed, 0, 1) {
+		return 0, false
+	}
+	return r.lastSeq, true
+}
+
+// Sends c the entries after lastSeq it missed while disconnected; only
+//    the newest MAX_RESUME_REPLAY, if it missed more
+func (comm *Community) replayMissed(c *Client, lastSeq uint64) {
+	var missed []HistoryEntry
+	var beforeSeq uint64 // 0 for the newest page
+	for len(missed) < MAX_RESUME_REPLAY {
+		page, err := comm.history.Store.Before(
+			comm.logID, beforeSeq, MAX_HISTORY_PAGE_LEN)
+		if err != nil {
+			comm.logger.Error("Unable to read history", "err", err)
+			return
+		}
+
+		i := sort.Search(len(page), func(i int) bool {
+			return page[i].Seq > lastSeq
+		})
+		missed = append(page[i:], missed...)
+		if i > 0 || len(page) < MAX_HISTORY_PAGE_LEN {
+			break // reached lastSeq or the start of the log
+		}
+		beforeSeq = page[0].Seq
+	}
+	if len(missed) > MAX_RESUME_REPLAY {
+		missed = missed[len(missed) - MAX_RESUME_REPLAY:]
+	}
+	if len(missed) == 0 {
+		return
+	}
+
+	if err := comm.writeHistory(c, missed); err != nil {
+		comm.logger.Warn("Unable to replay missed history",
+			"client_id", c.ID, "err", err)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestSessionClient(id uint32, serverID string, commID string) *Client {
+	c := &Client{ID: id, UserID: fmt.Sprint("user-", id)}
+	c.SetName(fmt.Sprint("name-", id))
+	c.setPlacement(serverID, commID)
+	return c
+}
+
+func TestSessionStoreResume(t *testing.T) {
+	ss := NewSessionStore(time.Minute)
+	c := newTestSessionClient(7, "main", "c1")
+	token, err := ss.Issue(c)
+	if err != nil {
+		t.Fatalf("Issue() = %v", err)
+	}
+
+	// a Client that moved after its session was issued is resumed where
+	//    it last was
+	c.setPlacement("main", "c2")
+	ss.Detach(c)
+
+	sess, err := ss.Resume(token)
+	if err != nil {
+		t.Fatalf("Resume() = %v", err)
+	}
+	if sess.id != 7 || sess.userID != "user-7" || sess.name != "name-7" ||
+		sess.serverID != "main" || sess.commID != "c2" || sess.client != nil {
+		t.Errorf("Resume() = %+v", sess)
+	}
+
+	// consumed by the 1st Resume()
+	if _, err = ss.Resume(token); err != errSessionExpired {
+		t.Errorf("2nd Resume() = %v, want errSessionExpired", err)
+	}
+	if _, err = ss.Resume("unknown"); err != errSessionExpired {
+		t.Errorf("Resume() of an unknown token = %v, want "+
+			"errSessionExpired", err)
+	}
+}
+
+// A Client that hasn't noticed its connection dropped is taken over
+func TestSessionStoreResumeConnected(t *testing.T) {
+	ss := NewSessionStore(time.Minute)
+	c := newTestSessionClient(7, "main", "c1")
+	token, _ := ss.Issue(c)
+
+	sess, err := ss.Resume(token)
+	if err != nil {
+		t.Fatalf("Resume() = %v", err)
+	}
+	if sess.client != c || sess.commID != "c1" {
+		t.Errorf("Resume() = %+v, want the connected Client's session",
+			sess)
+	}
+	// its later Detach() leaves nothing to resume
+	ss.Detach(c)
+	if _, err = ss.Resume(token); err != errSessionExpired {
+		t.Errorf("Resume() after Detach() = %v, want errSessionExpired",
+			err)
+	}
+}
+
+func TestSessionStoreGrace(t *testing.T) {
+	ss := NewSessionStore(20 * time.Millisecond)
+	expired := newTestSessionClient(1, "main", "c1")
+	expiredToken, _ := ss.Issue(expired)
+	ss.Detach(expired)
+
+	// still connected, so its grace hasn't started
+	connected := newTestSessionClient(2, "main", "c1")
+	connectedToken, _ := ss.Issue(connected)
+
+	ended := newTestSessionClient(3, "main", "c1")
+	endedToken, _ := ss.Issue(ended)
+	ss.End(ended)
+
+	time.Sleep(40 * time.Millisecond)
+	if _, err := ss.Resume(expiredToken); err != errSessionExpired {
+		t.Errorf("Resume() after grace = %v, want errSessionExpired", err)
+	}
+	if _, err := ss.Resume(connectedToken); err != nil {
+		t.Errorf("Resume() of a connected Client's session = %v", err)
+	}
+	if _, err := ss.Resume(endedToken); err != errSessionExpired {
+		t.Errorf("Resume() of an ended session = %v, want "+
+			"errSessionExpired", err)
+	}
+
+	if NewSessionStore(0).Enabled() {
+		t.Errorf("Sessions enabled w/ a grace of 0")
+	}
+}
+
+func TestClientMissedAfter(t *testing.T) {
+	c := &Client{}
+	if _, ok := c.missedAfter("c1"); ok {
+		t.Errorf("missedAfter() w/o a resumed session")
+	}
+
+	c.resumed = &resumedSession{commID: "c1", lastSeq: 5}
+	if _, ok := c.missedAfter(ROOT_COMM_ID); ok {
+		t.Errorf("missedAfter() for another Community")
+	}
+	if lastSeq, ok := c.missedAfter("c1"); !ok || lastSeq != 5 {
+		t.Errorf("missedAfter() = %v, %v; want 5, true", lastSeq, ok)
+	}
+	// replayed once; a later rejoin replays history as usual
+	if _, ok := c.missedAfter("c1"); ok {
+		t.Errorf("missedAfter() true after the 1st call")
+	}
+}
+
+// Connects w/ CapResume & starts a session on sw, then joins commID; the
+//    session token is returned
+func dialTestSessionClient(t *testing.T, sw *ServerWrapper, id uint32,
+	commID string) (tc *testClient, token string) {
+	t.Helper()
+
+	tc = dialTestClient(t, clientAddr(sw), id, DEFAULT_SERVER_ID,
+		SERVER_CAPS)
+	token = tc.expect(MTypeSession).Data.(*MsgSession).Token
+	tc.expectRoster(ROOT_COMM_ID)
+	tc.send(&Message{MTypeJoinComm, MsgJoinComm{commID}})
+	tc.expectRoster(commID)
+	return tc, token
+}
+
+// Sends text as a MsgSendText & returns its Seq once acked
+func (tc *testClient) sendAckedText(nonce uint64, text []byte) uint64 {
+	tc.t.Helper()
+
+	tc.send(&Message{MTypeSendText, MsgSendText{nonce, text}})
+	ack := tc.expect(MTypeSendAck).Data.(*MsgSendAck)
+	if ack.Nonce != nonce || ack.Code != 0 {
+		tc.t.Fatalf("Text %v acked w/ %+v", nonce, ack)
+	}
+	return ack.Seq
+}
+
+// Resuming through ServerWrapper returns the Client to its Community &
+//    replays the texts it missed, in order, over several MsgHistory
+func TestSessionResume(t *testing.T) {
+	t.Setenv("SESSION_GRACE", "1m")
+	t.Setenv("HISTORY_DIR", "")
+	t.Setenv("TEXT_RATE", "1000")
+	t.Setenv("TEXT_BURST", "1000")
+	t.Setenv("USER_TEXT_RATE", "1000")
+	t.Setenv("USER_TEXT_BURST", "1000")
+	sw := startTestNode(t)
+
+	resumer, token := dialTestSessionClient(t, sw, 1, "c1")
+	sender, _ := dialTestSessionClient(t, sw, 2, "c1")
+
+	sender.sendAckedText(1, []byte("seen"))
+	seen := resumer.expect(MTypeCommText).Data.(*MsgCommText)
+	resumer.conn.Close()
+
+	// more than fit in 1 MsgHistory, or 1 page of the history store
+	const missedLen = MAX_HISTORY_PAGE_LEN + 50
+	text := func(i int) []byte {
+		return append([]byte(fmt.Sprint(i, ":")),
+			bytes.Repeat([]byte("a"), 1000)...)
+	}
+	var missedSeqs []uint64
+	for i := 0; i < missedLen; i++ {
+		missedSeqs = append(missedSeqs,
+			sender.sendAckedText(uint64(i + 2), text(i)))
+	}
+
+	resumed := connectTestClient(t, clientAddr(sw), 1)
+	resumed.send(&Message{MTypeCapabilities, MsgCapabilities{SERVER_CAPS}})
+	resumed.send(&Message{MTypeResume, MsgResume{seen.Seq, token}})
+
+	var replayed []HistoryEntry
+	frames := 0
+	for {
+		msg := resumed.read()
+		if msg.Type == MTypeHistory {
+			history := msg.Data.(*MsgHistory)
+			if history.CommID != "c1" {
+				t.Fatalf("History of %q, want c1", history.CommID)
+			}
+			replayed = append(replayed, history.Entries...)
+			frames++
+		}
+		if msg.Type == MTypeRoster && msg.Data.(*MsgRoster).CommID == "c1" {
+			break // replayed before the roster
+		}
+		if msg.Type == MTypeRoster || msg.Type == MTypeError {
+			t.Fatalf("Resumed Client got %+v, want c1's roster", msg.Data)
+		}
+	}
+
+	if frames < 2 {
+		t.Errorf("Missed texts replayed in %v MsgHistory, want several",
+			frames)
+	}
+	if len(replayed) != missedLen {
+		t.Fatalf("Replayed %v texts, want the %v missed", len(replayed),
+			missedLen)
+	}
+	for i, entry := range replayed {
+		if entry.Seq != missedSeqs[i] || entry.ClientID != 2 ||
+			!bytes.Equal(entry.TextBytes, text(i)) {
+			t.Fatalf("Replayed entry %v has Seq %v from %v, want Seq %v "+
+				"from 2", i, entry.Seq, entry.ClientID, missedSeqs[i])
+		}
+	}
+
+	// the resumed Client is back in c1 w/ its ID
+	sender.sendAckedText(uint64(missedLen + 2), []byte("welcome back"))
+	if got := resumed.expect(MTypeCommText).Data.(*MsgCommText);
+		string(got.TextBytes) != "welcome back" {
+		t.Errorf("Resumed Client got %q", got.TextBytes)
+	}
+
+	// the token was consumed
+	again := connectTestClient(t, clientAddr(sw), 1)
+	again.send(&Message{MTypeResume, MsgResume{0, token}})
+	if e := again.expect(MTypeError).Data.(*MsgError); e.Code != ECodeResume {
+		t.Errorf("Reused token got %+v, want ECodeResume", e)
+	}
+}
+
+// An unknown token is answered w/ ECodeResume, & auth continues as usual
+func TestSessionResumeUnknownToken(t *testing.T) {
+	t.Setenv("SESSION_GRACE", "1m")
+	sw := startTestNode(t)
+
+	tc := connectTestClient(t, clientAddr(sw), 1)
+	tc.send(&Message{MTypeResume, MsgResume{3, "unknown"}})
+	if e := tc.expect(MTypeError).Data.(*MsgError); e.Code != ECodeResume {
+		t.Fatalf("Unknown token got %+v, want ECodeResume", e)
+	}
+
+	tc.send(&Message{MTypeClientID, MsgClientID{1}})
+	tc.send(&Message{MTypeClientName, MsgClientName{"fresh"}})
+	roster := tc.expectRoster(ROOT_COMM_ID)
+	if len(roster.Members) != 1 || roster.Members[0].ClientID != 1 {
+		t.Errorf("Roster = %+v, want just Client 1", roster)
+	}
+}
+
+// Sessions detached from a Community that was then shut down resume in
+//    the root Community instead
+func TestSessionStoreClearComm(t *testing.T) {
+	ss := NewSessionStore(time.Minute)
+	left := newTestSessionClient(1, "main", "c1")
+	leftToken, _ := ss.Issue(left)
+	ss.Detach(left)
+	elsewhere := newTestSessionClient(2, "other", "c1")
+	elsewhereToken, _ := ss.Issue(elsewhere)
+	ss.Detach(elsewhere)
+
+	ss.ClearComm("main", "c1")
+	if sess, _ := ss.Resume(leftToken); sess.serverID != "main" ||
+		sess.commID != "" {
+		t.Errorf("Resume() = %+v, want main w/o a Community", sess)
+	}
+	if sess, _ := ss.Resume(elsewhereToken); sess.commID != "c1" {
+		t.Errorf("Resume() on another Server = %+v, want c1", sess)
+	}
+}
+
+// Resuming after the Client's Community was shut down through the API
+//    returns it to the root Community, w/o recreating the one shut down
+func TestSessionResumeAfterCommShutdown(t *testing.T) {
+	t.Setenv("SESSION_GRACE", "1m")
+	t.Setenv("HISTORY_DIR", "")
+	sw := startTestNode(t)
+	api := httptest.NewServer((&APIServer{sw: sw}).routes())
+	t.Cleanup(api.Close)
+
+	// detached before the shutdown, & disconnected by it
+	left, leftToken := dialTestSessionClient(t, sw, 1, "c1")
+	shutDown, shutDownToken := dialTestSessionClient(t, sw, 2, "c1")
+	left.conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		sw.sessions.mutex.Lock()
+		detached := sw.sessions.sessions[leftToken].client == nil
+		sw.sessions.mutex.Unlock()
+		if detached {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Session of a closed connection not detached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	resp, err := http.Post(api.URL+"/comm/shutdown?server="+
+		DEFAULT_SERVER_ID+"&comm=c1", "", nil)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("POST /comm/shutdown = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	shutDown.expectClosed()
+
+	for i, token := range []string{leftToken, shutDownToken} {
+		resumed := connectTestClient(t, clientAddr(sw), uint32(i + 1))
+		resumed.send(&Message{MTypeCapabilities,
+			MsgCapabilities{SERVER_CAPS}})
+		resumed.send(&Message{MTypeResume, MsgResume{1, token}})
+		roster := resumed.expect(MTypeRoster).Data.(*MsgRoster)
+		if roster.CommID != ROOT_COMM_ID {
+			t.Errorf("Client %v resumed in %q, want %q", i + 1,
+				roster.CommID, ROOT_COMM_ID)
+		}
+	}
+
+	s, _ := sw.GetServer(DEFAULT_SERVER_ID)
+	s.commsRWMutex.RLock()
+	_, recreated := s.Comms["c1"]
+	s.commsRWMutex.RUnlock()
+	if recreated {
+		t.Errorf("Resuming recreated the Community shut down")
+	}
+}
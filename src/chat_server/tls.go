@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// How a TLSReloader treats client certificates when it has a client CA
+const (
+	// only Clients presenting a cert signed by the client CA may connect
+	TLS_CLIENT_AUTH_REQUIRE = "require"
+	// Clients may connect w/o a cert; those presenting one must be signed
+	// by the client CA & are marked trusted (see Client.TrustedPeer)
+	TLS_CLIENT_AUTH_OPTIONAL = "optional"
+)
+
+// TLSReloader serves the cert/key pair & client CA in its files, reloading
+//    them on the next handshake after any of the files is modified
+type TLSReloader struct {
+	CertFile		string
+	KeyFile			string
+	ClientCAFile	string // mutual TLS is disabled if empty
+	ClientAuth		tls.ClientAuthType
+
+	mutex			sync.Mutex
+	config			*tls.Config // served to handshakes until reloaded
+	modTimes		[]time.Time // of the files above, as last loaded
+}
+
+// Loads the files up front so a bad cert fails startup, not handshakes
+func NewTLSReloader(certFile string, keyFile string, clientCAFile string,
+	clientAuth string) (r *TLSReloader, err error) {
+	r = new(TLSReloader)
+	r.CertFile = certFile
+	r.KeyFile = keyFile
+	r.ClientCAFile = clientCAFile
+
+	switch {
+	case clientCAFile == "":
+		r.ClientAuth = tls.NoClientCert
+	case clientAuth == "" || clientAuth == TLS_CLIENT_AUTH_REQUIRE:
+		r.ClientAuth = tls.RequireAndVerifyClientCert
+	case clientAuth == TLS_CLIENT_AUTH_OPTIONAL:
+		r.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, errors.New(fmt.Sprintf(
+			"Unknown TLS client auth mode %q", clientAuth))
+	}
+
+	if _, err = r.currentConfig(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// The tls.Config for listeners; every handshake is served r's current
+//    config by GetConfigForClient
+func (r *TLSReloader) ListenerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:			tls.VersionTLS12,
+		GetConfigForClient:	r.getConfigForClient,
+	}
+}
+
+func (r *TLSReloader) getConfigForClient(*tls.ClientHelloInfo) (
+	*tls.Config, error) {
+	return r.currentConfig()
+}
+
+// Returns the last loaded config if reloading fails, so a half-written
+//    cert doesn't take the listener down
+// BLOCKING: r.mutex
+func (r *TLSReloader) currentConfig() (config *tls.Config, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	modTimes, err := r.statFiles()
+	if err == nil && r.config != nil && sameTimes(modTimes, r.modTimes) {
+		return r.config, nil
+	}
+	if err == nil {
+		config, err = r.load()
+	}
+
+	if err != nil {
+		if r.config == nil {
+			return nil, err
+		}
+		slog.Error("Unable to reload TLS config; keeping the last",
+			"err", err)
+		return r.config, nil
+	}
+
+	if r.config != nil {
+		slog.Info("Reloaded TLS certificate", "cert_file", r.CertFile)
+	}
+	r.config, r.modTimes = config, modTimes
+	return config, nil
+}
+
+func (r *TLSReloader) statFiles() (modTimes []time.Time, err error) {
+	for _, path := range []string{r.CertFile, r.KeyFile, r.ClientCAFile} {
+		if path == "" {
+			modTimes = append(modTimes, time.Time{})
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return
+}
+
+func sameTimes(a []time.Time, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *TLSReloader) load() (config *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config = &tls.Config{
+		MinVersion:		tls.VersionTLS12,
+		Certificates:	[]tls.Certificate{cert},
+		ClientAuth:		r.ClientAuth,
+	}
+
+	if r.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf(
+				"No certificates found in %s", r.ClientCAFile))
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A cert & its key, signed by a CA testCert (or self-signed)
+type testCert struct {
+	cert	*x509.Certificate
+	key		*ecdsa.PrivateKey
+	certPEM	[]byte
+	keyPEM	[]byte
+}
+
+var testSerial int64
+
+// Issues a cert for commonName, signed by parent (self-signed if nil)
+func newTestCert(t *testing.T, commonName string, parent *testCert,
+	isCA bool) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:	big.NewInt(testSerial),
+		Subject:		pkix.Name{CommonName: commonName},
+		NotBefore:		time.Now().Add(-time.Hour),
+		NotAfter:		time.Now().Add(time.Hour),
+		KeyUsage:		x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:	[]x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:		[]string{"localhost"},
+		IPAddresses:	[]net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer,
+		&key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert:		cert,
+		key:		key,
+		certPEM:	pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:		pem.EncodeToMemory(
+			&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (tc *testCert) tlsCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	cert, err := tls.X509KeyPair(tc.certPEM, tc.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// Writes data to path w/ a modification time of modTime
+func writeTestFile(t *testing.T, path string, data []byte,
+	modTime time.Time) {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Cert, key & client CA files in a temp dir
+type testTLSFiles struct {
+	certFile		string
+	keyFile			string
+	clientCAFile	string
+}
+
+func newTestTLSFiles(t *testing.T) testTLSFiles {
+	dir := t.TempDir()
+	return testTLSFiles{
+		certFile:		filepath.Join(dir, "cert.pem"),
+		keyFile:		filepath.Join(dir, "key.pem"),
+		clientCAFile:	filepath.Join(dir, "client-ca.pem"),
+	}
+}
+
+// Writes server's cert & key w/ a modification time of modTime
+func (f testTLSFiles) writeServerCert(t *testing.T, server *testCert,
+	modTime time.Time) {
+	writeTestFile(t, f.certFile, server.certPEM, modTime)
+	writeTestFile(t, f.keyFile, server.keyPEM, modTime)
+}
+
+// The outcome of one handshake w/ a listener serving r.ListenerConfig()
+type testHandshake struct {
+	serverErr	error // from the accepted tcpConn's Handshake()
+	trustedPeer	string
+	serverCN	string // of the cert the server presented
+}
+
+// Handshakes w/ a listener serving r's config, trusting ca & presenting
+//    clientCert if it's non-nil
+func handshake(t *testing.T, r *TLSReloader, ca *testCert,
+	clientCert *testCert) (h testHandshake) {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", r.ListenerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan testHandshake, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- testHandshake{serverErr: err}
+			return
+		}
+		defer conn.Close()
+
+		tc := newTCPConn(conn)
+		err = tc.Handshake(5 * time.Second)
+		accepted <- testHandshake{
+			serverErr:		err,
+			trustedPeer:	tc.TrustedPeer(),
+		}
+	}()
+
+	config := &tls.Config{
+		RootCAs:	x509.NewCertPool(),
+		ServerName:	"localhost",
+	}
+	config.RootCAs.AddCert(ca.cert)
+	if clientCert != nil {
+		// sent even if it isn't signed by a CA the server asks for
+		cert := clientCert.tlsCert(t)
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (
+			*tls.Certificate, error) {
+			return &cert, nil
+		}
+	}
+	conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+	if err == nil {
+		state := conn.ConnectionState()
+		h.serverCN = state.PeerCertificates[0].Subject.CommonName
+		// TLS 1.3 servers check the client cert after the client's
+		//    handshake completes; a read reports the rejection
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	serverSide := <-accepted
+	h.serverErr, h.trustedPeer = serverSide.serverErr, serverSide.trustedPeer
+	return
+}
+
+func TestTLSHandshake(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	server := newTestCert(t, "server", ca, false)
+	files := newTestTLSFiles(t)
+	files.writeServerCert(t, server, time.Now())
+
+	r, err := NewTLSReloader(files.certFile, files.keyFile, "", "")
+	if err != nil {
+		t.Fatalf("NewTLSReloader() = %v", err)
+	}
+	h := handshake(t, r, ca, nil)
+	if h.serverErr != nil {
+		t.Fatalf("Handshake() = %v", h.serverErr)
+	}
+	if h.serverCN != "server" {
+		t.Errorf("Server presented %q, want %q", h.serverCN, "server")
+	}
+	if h.trustedPeer != "" {
+		t.Errorf("TrustedPeer() = %q w/o mutual TLS", h.trustedPeer)
+	}
+}
+
+func TestTLSReloaderRotation(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	files := newTestTLSFiles(t)
+	modTime := time.Now().Add(-time.Minute)
+	files.writeServerCert(t, newTestCert(t, "server-1", ca, false), modTime)
+
+	r, err := NewTLSReloader(files.certFile, files.keyFile, "", "")
+	if err != nil {
+		t.Fatalf("NewTLSReloader() = %v", err)
+	}
+	if h := handshake(t, r, ca, nil); h.serverCN != "server-1" {
+		t.Fatalf("Server presented %q (err %v), want %q",
+			h.serverCN, h.serverErr, "server-1")
+	}
+
+	// rotated files are picked up by the next handshake
+	modTime = modTime.Add(time.Second)
+	files.writeServerCert(t, newTestCert(t, "server-2", ca, false), modTime)
+	if h := handshake(t, r, ca, nil); h.serverCN != "server-2" {
+		t.Fatalf("Server presented %q (err %v) after rotation, want %q",
+			h.serverCN, h.serverErr, "server-2")
+	}
+
+	// a half-written cert keeps the last one served
+	modTime = modTime.Add(time.Second)
+	writeTestFile(t, files.certFile, []byte("-----BEGIN CERT"), modTime)
+	if h := handshake(t, r, ca, nil); h.serverCN != "server-2" {
+		t.Errorf("Server presented %q (err %v) after a bad rotation, "+
+			"want %q", h.serverCN, h.serverErr, "server-2")
+	}
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	clientCA := newTestCert(t, "client-ca", nil, true)
+	otherCA := newTestCert(t, "other-ca", nil, true)
+	trusted := newTestCert(t, "client-1", clientCA, false)
+	untrusted := newTestCert(t, "client-2", otherCA, false)
+
+	files := newTestTLSFiles(t)
+	files.writeServerCert(t, newTestCert(t, "server", ca, false),
+		time.Now())
+	writeTestFile(t, files.clientCAFile, clientCA.certPEM, time.Now())
+
+	cases := []struct {
+		name		string
+		clientAuth	string
+		clientCert	*testCert
+		wantErr		bool
+		wantPeer	string
+	}{
+		{"require w/o cert", TLS_CLIENT_AUTH_REQUIRE, nil, true, ""},
+		{"require trusted", TLS_CLIENT_AUTH_REQUIRE, trusted, false,
+			"client-1"},
+		{"require untrusted", TLS_CLIENT_AUTH_REQUIRE, untrusted, true, ""},
+		{"default requires", "", nil, true, ""},
+		{"optional w/o cert", TLS_CLIENT_AUTH_OPTIONAL, nil, false, ""},
+		{"optional trusted", TLS_CLIENT_AUTH_OPTIONAL, trusted, false,
+			"client-1"},
+		{"optional untrusted", TLS_CLIENT_AUTH_OPTIONAL, untrusted, true,
+			""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewTLSReloader(files.certFile, files.keyFile,
+				files.clientCAFile, tc.clientAuth)
+			if err != nil {
+				t.Fatalf("NewTLSReloader() = %v", err)
+			}
+
+			h := handshake(t, r, ca, tc.clientCert)
+			if (h.serverErr != nil) != tc.wantErr {
+				t.Errorf("Handshake() = %v, want error: %v",
+					h.serverErr, tc.wantErr)
+			}
+			if h.trustedPeer != tc.wantPeer {
+				t.Errorf("TrustedPeer() = %q, want %q",
+					h.trustedPeer, tc.wantPeer)
+			}
+		})
+	}
+
+	_, err := NewTLSReloader(files.certFile, files.keyFile,
+		files.clientCAFile, "sometimes")
+	if err == nil {
+		t.Errorf("NewTLSReloader() accepted an unknown client auth mode")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ClientConn carries a Client's Message frames over some transport (raw
+//    TCP/TLS or WebSocket); a Client only ever has 1 concurrent reader
+//    & 1 concurrent writer
+type ClientConn interface {
+	// Completes any transport handshake; called before ReadMsg/WriteMsg
+	Handshake(timeout time.Duration) (err error)
+	ReadMsg() (msg *Message, err error)
+	// Bounds the next ReadMsg calls; the zero Time removes the bound
+	SetReadDeadline(t time.Time) (err error)
+	WriteMsg(msg *Message) (err error)
+	// Bounds the next WriteMsg calls; the zero Time removes the bound
+	SetWriteDeadline(t time.Time) (err error)
+	RemoteAddr() net.Addr
+	// Common Name of the peer's verified mutual TLS cert, if any
+	TrustedPeer() string
+	Close() (err error)
+}
+
+// A ClientConn sending frames directly over a TCP (or TLS) stream
+type tcpConn struct {
+	conn		net.Conn
+	reader		*bufio.Reader
+	trustedPeer	string
+}
+
+func newTCPConn(conn net.Conn) *tcpConn {
+	return &tcpConn{
+		conn:	conn,
+		reader:	bufio.NewReader(conn),
+	}
+}
+
+// Completes the TLS handshake within timeout, rather than on the first
+//    read or write w/o a deadline; a no-op for plain TCP
+func (tc *tcpConn) Handshake(timeout time.Duration) (err error) {
+	tlsConn, ok := tc.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		return errors.New(fmt.Sprintf("TLS handshake failed: %v", err))
+	}
+	tc.trustedPeer = trustedPeer(tlsConn.ConnectionState())
+
+	return
+}
+
+// Reads a single frame (see protocol.go)
+func (tc *tcpConn) ReadMsg() (msg *Message, err error) {
+	return DecodeMsg(tc.reader)
+}
+
+// Writes msg as a single frame (see protocol.go)
+func (tc *tcpConn) WriteMsg(msg *Message) (err error) {
+	return EncodeMsg(tc.conn, msg)
+}
+
+func (tc *tcpConn) SetReadDeadline(t time.Time) (err error) {
+	return tc.conn.SetReadDeadline(t)
+}
+
+func (tc *tcpConn) SetWriteDeadline(t time.Time) (err error) {
+	return tc.conn.SetWriteDeadline(t)
+}
+
+func (tc *tcpConn) RemoteAddr() net.Addr {
+	return tc.conn.RemoteAddr()
+}
+
+func (tc *tcpConn) TrustedPeer() string {
+	return tc.trustedPeer
+}
+
+func (tc *tcpConn) Close() (err error) {
+	return tc.conn.Close()
+}
+
+// Only set if the peer's cert was verified against the client CA
+func trustedPeer(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket (RFC 6455) transport; every binary WebSocket message carries
+//    exactly 1 frame as described in protocol.go
+const (
+	WS_PATH = "/ws"
+	WS_ACCEPT_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// longest message a wsConn accepts: 1 full protocol frame
+	MAX_WS_MSG_LEN = FRAME_HEADER_LEN + MAX_FRAME_LEN // bytes
+	// longest a wsConn waits to write a close frame when closing
+	WS_CLOSE_TIMEOUT = time.Second
+)
+
+// WebSocket opcodes
+const (
+	wsOpContinuation byte = 0x0
+	wsOpText byte = 0x1
+	wsOpBinary byte = 0x2
+	wsOpClose byte = 0x8
+	wsOpPing byte = 0x9
+	wsOpPong byte = 0xA
+)
+
+// WebSocket close codes
+const (
+	wsCloseNormal uint16 = 1000
+	wsCloseProtocolError uint16 = 1002
+	wsCloseUnsupportedData uint16 = 1003
+	wsCloseTooBig uint16 = 1009
+)
+
+// A ClientConn sending each frame as a binary WebSocket message
+type wsConn struct {
+	conn		net.Conn
+	reader		*bufio.Reader
+	trustedPeer	string
+
+	// guards writes to conn, as ReadMsg() answers pings & closes
+	writeMutex	sync.Mutex
+	closeSent	bool // guarded by writeMutex
+}
+
+// A peer violated the WebSocket protocol
+type wsProtocolError struct {
+	code		uint16 // close code sent to the peer
+	msg			string
+}
+
+func (e wsProtocolError) Error() string {
+	return fmt.Sprintf("WebSocket protocol error: %s", e.msg)
+}
+
+// Serves WS_PATH on sw.wsl until sw.wsServer is closed
+func (sw *ServerWrapper) serveWebSocket() {
+	defer func() {
+		slog.Debug("ServerWrapper exiting serveWebSocket()")
+		sw.loopWG.Done()
+	}()
+
+	err := sw.wsServer.Serve(sw.wsl)
+	if err != nil && err != http.ErrServerClosed {
+		slog.Error("WebSocket server failed", "err", err)
+	}
+}
+
+func (sw *ServerWrapper) wsRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(WS_PATH, sw.handleWebSocket)
+	return mux
+}
+
+// Upgrades the request & hands the wsConn to sw.clientBuilderLoop()
+func (sw *ServerWrapper) handleWebSocket(w http.ResponseWriter,
+	r *http.Request) {
+	wc, err := upgradeWebSocket(w, r)
+	if err != nil {
+		slog.Info("Unable to upgrade WebSocket",
+			"remote_addr", r.RemoteAddr, "err", err)
+		return
+	}
+
+	select {
+	case <-sw.done:
+		wc.Close() // ignoring errors
+	case sw.connChan <- wc:
+	}
+}
+
+// Performs the server side of the opening handshake; on failure an HTTP
+//    error has already been written
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (
+	wc *wsConn, err error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("Not a GET request")
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("Missing WebSocket upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, errors.New("Unsupported Sec-WebSocket-Version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key);
+		err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("Invalid Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return nil, errors.New("ResponseWriter can't be hijacked")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	accept := sha1.Sum([]byte(key + WS_ACCEPT_GUID))
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	wc = &wsConn{
+		conn:	conn,
+		reader:	brw.Reader, // may already hold the first frames
+	}
+	if r.TLS != nil {
+		wc.trustedPeer = trustedPeer(*r.TLS)
+	}
+	return wc, nil
+}
+
+// Whether any comma-separated value of header name equals token
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The opening handshake is completed by upgradeWebSocket()
+func (wc *wsConn) Handshake(timeout time.Duration) (err error) {
+	return
+}
+
+// Reads the next binary message, answering any control frames before it
+func (wc *wsConn) ReadMsg() (msg *Message, err error) {
+	payload, err := wc.readMessage()
+	if err != nil {
+		var wsErr wsProtocolError
+		if errors.As(err, &wsErr) {
+			wc.writeClose(wsErr.code) // ignoring errors
+		}
+		return nil, err
+	}
+
+	reader := bytes.NewReader(payload)
+	msg, err = DecodeMsg(reader)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Len() != 0 {
+		return nil, MalformedMsgError{msg.Type, errors.New(fmt.Sprintf(
+			"%v unexpected bytes after frame", reader.Len()))}
+	}
+
+	return msg, nil
+}
+
+// Reassembles the next data message from its (possibly fragmented)
+//    WebSocket frames
+func (wc *wsConn) readMessage() (payload []byte, err error) {
+	inMessage := false
+	for {
+		fin, opcode, framePayload, err := wc.readFrame(
+			MAX_WS_MSG_LEN - len(payload))
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err = wc.writeFrame(wsOpPong, framePayload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			code := wsCloseNormal
+			if len(framePayload) >= 2 {
+				code = binary.BigEndian.Uint16(framePayload)
+			}
+			wc.writeClose(code) // ignoring errors
+			return nil, io.EOF
+		case wsOpText:
+			return nil, wsProtocolError{wsCloseUnsupportedData,
+				"text messages are not supported"}
+		case wsOpBinary:
+			if inMessage {
+				return nil, wsProtocolError{wsCloseProtocolError,
+					"new message before previous one finished"}
+			}
+			inMessage = true
+		case wsOpContinuation:
+			if !inMessage {
+				return nil, wsProtocolError{wsCloseProtocolError,
+					"continuation w/o a message"}
+			}
+		default:
+			return nil, wsProtocolError{wsCloseProtocolError,
+				fmt.Sprintf("unknown opcode %v", opcode)}
+		}
+
+		payload = append(payload, framePayload...)
+		if fin {
+			return payload, nil
+		}
+	}
+}
+
+// Reads a single masked frame whose payload is at most maxLen bytes
+//    (control frames are always allowed their 125 bytes)
+func (wc *wsConn) readFrame(maxLen int) (fin bool, opcode byte,
+	payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(wc.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0] & 0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1] & 0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	if header[0] & 0x70 != 0 {
+		return false, 0, nil, wsProtocolError{wsCloseProtocolError,
+			"reserved bits set"}
+	}
+	if !masked {
+		return false, 0, nil, wsProtocolError{wsCloseProtocolError,
+			"client frames must be masked"}
+	}
+
+	isControl := opcode & 0x8 != 0
+	if isControl && (!fin || length > 125) {
+		return false, 0, nil, wsProtocolError{wsCloseProtocolError,
+			"invalid control frame"}
+	}
+
+	switch length {
+	case 126:
+		var ext uint16
+		err = binary.Read(wc.reader, binary.BigEndian, &ext)
+		length = uint64(ext)
+	case 127:
+		err = binary.Read(wc.reader, binary.BigEndian, &length)
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if !isControl && length > uint64(maxLen) {
+		return false, 0, nil, wsProtocolError{wsCloseTooBig,
+			fmt.Sprintf("message exceeds %v bytes", MAX_WS_MSG_LEN)}
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(wc.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(wc.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i % 4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Writes msg as a single binary message
+func (wc *wsConn) WriteMsg(msg *Message) (err error) {
+	buf := new(bytes.Buffer)
+	if err = EncodeMsg(buf, msg); err != nil {
+		return err
+	}
+	return wc.writeFrame(wsOpBinary, buf.Bytes())
+}
+
+// Writes a single unmasked, unfragmented frame
+// BLOCKING: wc.writeMutex
+func (wc *wsConn) writeFrame(opcode byte, payload []byte) (err error) {
+	wc.writeMutex.Lock()
+	defer wc.writeMutex.Unlock()
+
+	if wc.closeSent {
+		return errors.New("WebSocket is closing")
+	}
+	if opcode == wsOpClose {
+		wc.closeSent = true
+	}
+
+	frame := make([]byte, 0, 10 + len(payload))
+	frame = append(frame, 0x80 | opcode)
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+
+	_, err = wc.conn.Write(frame)
+	return
+}
+
+func (wc *wsConn) writeClose(code uint16) (err error) {
+	return wc.writeFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+func (wc *wsConn) SetReadDeadline(t time.Time) (err error) {
+	return wc.conn.SetReadDeadline(t)
+}
+
+func (wc *wsConn) SetWriteDeadline(t time.Time) (err error) {
+	return wc.conn.SetWriteDeadline(t)
+}
+
+func (wc *wsConn) RemoteAddr() net.Addr {
+	return wc.conn.RemoteAddr()
+}
+
+func (wc *wsConn) TrustedPeer() string {
+	return wc.trustedPeer
+}
+
+// Sends a close frame (unless one was already sent) w/o waiting for the
+//    peer's reply, then closes the underlying conn
+func (wc *wsConn) Close() (err error) {
+	wc.conn.SetWriteDeadline(time.Now().Add(WS_CLOSE_TIMEOUT))
+	wc.writeClose(wsCloseNormal) // ignoring errors
+	return wc.conn.Close()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A frame as a client sends it; masked unless unmasked is set
+func wsTestFrame(fin bool, opcode byte, payload []byte,
+	unmasked bool) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+
+	var maskBit byte = 0x80
+	if unmasked {
+		maskBit = 0
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit | byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit | 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit | 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if unmasked {
+		return append(frame, payload...)
+	}
+
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b ^ mask[i % 4])
+	}
+	return frame
+}
+
+// A frame the server wrote
+type wsTestServerFrame struct {
+	fin		bool
+	opcode	byte
+	payload	[]byte
+}
+
+// Reads the server's unmasked frames from conn until it closes
+func readWSTestFrames(conn net.Conn) chan wsTestServerFrame {
+	frames := make(chan wsTestServerFrame, 16)
+	go func() {
+		defer close(frames)
+		reader := bufio.NewReader(conn)
+		for {
+			var header [2]byte
+			if _, err := io.ReadFull(reader, header[:]); err != nil {
+				return
+			}
+			length := uint64(header[1] & 0x7F)
+			switch length {
+			case 126:
+				var ext uint16
+				binary.Read(reader, binary.BigEndian, &ext)
+				length = uint64(ext)
+			case 127:
+				binary.Read(reader, binary.BigEndian, &length)
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			frames <- wsTestServerFrame{header[0] & 0x80 != 0,
+				header[0] & 0x0F, payload}
+		}
+	}()
+	return frames
+}
+
+// A wsConn over a pipe; the client writes its frames to client, & reads
+//    what the server wrote from frames
+func newTestWSConn(t *testing.T) (wc *wsConn, client net.Conn,
+	frames chan wsTestServerFrame) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	wc = &wsConn{conn: server, reader: bufio.NewReader(server)}
+	return wc, client, readWSTestFrames(client)
+}
+
+// Writes frames from a goroutine, as net.Pipe() writes block until read
+func writeWSTestFrames(client net.Conn, frames ...[]byte) {
+	go func() {
+		for _, frame := range frames {
+			if _, err := client.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func expectWSTestFrame(t *testing.T, frames chan wsTestServerFrame,
+	opcode byte) wsTestServerFrame {
+	t.Helper()
+
+	select {
+	case f, ok := <-frames:
+		if !ok {
+			t.Fatalf("Connection closed waiting for opcode %v", opcode)
+		}
+		if f.opcode != opcode || !f.fin {
+			t.Fatalf("Server sent opcode %v (fin %v), want %v",
+				f.opcode, f.fin, opcode)
+		}
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server sent no frame w/ opcode %v", opcode)
+		return wsTestServerFrame{}
+	}
+}
+
+func encodeTestMsg(t *testing.T, msg *Message) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	if err := EncodeMsg(buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if wc, err := upgradeWebSocket(w, r); err == nil {
+				wc.conn.Close()
+			}
+		}))
+	t.Cleanup(server.Close)
+
+	// the example handshake of RFC 6455 section 1.3
+	upgrade := func(headers string) (status string, accept string) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("GET /chat HTTP/1.1\r\n" +
+			"Host: server.example.com\r\n" + headers + "\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Status, resp.Header.Get("Sec-WebSocket-Accept")
+	}
+	const valid = "Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n"
+
+	status, accept := upgrade(valid)
+	if !strings.HasPrefix(status, "101") {
+		t.Fatalf("Upgrade status = %q", status)
+	}
+	if accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", accept)
+	}
+
+	cases := []struct {
+		name	string
+		headers	string
+		status	string
+	}{
+		{"no upgrade", strings.Replace(valid, "Upgrade: websocket\r\n",
+			"", 1), "426"},
+		{"old version", strings.Replace(valid, "Version: 13", "Version: 8",
+			1), "400"},
+		{"short key", strings.Replace(valid, "dGhlIHNhbXBsZSBub25jZQ==",
+			"c2hvcnQ=", 1), "400"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if status, _ := upgrade(tc.headers); !strings.HasPrefix(status,
+				tc.status) {
+				t.Errorf("Upgrade status = %q, want %s", status, tc.status)
+			}
+		})
+	}
+}
+
+// Fragments w/ a ping between them are reassembled & the ping answered
+func TestWebSocketFragmentedMessage(t *testing.T) {
+	wc, client, frames := newTestWSConn(t)
+	frame := encodeTestMsg(t, &Message{MTypeClientText,
+		MsgClientText{7, []byte("hello, fragments")}})
+
+	writeWSTestFrames(client,
+		wsTestFrame(false, wsOpBinary, frame[:3], false),
+		wsTestFrame(true, wsOpPing, []byte("are you there"), false),
+		wsTestFrame(false, wsOpContinuation, frame[3:10], false),
+		wsTestFrame(true, wsOpPong, nil, false), // unsolicited; ignored
+		wsTestFrame(true, wsOpContinuation, frame[10:], false))
+
+	msg, err := wc.ReadMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg() = %v", err)
+	}
+	text, ok := msg.Data.(*MsgClientText)
+	if !ok || string(text.TextBytes) != "hello, fragments" {
+		t.Errorf("ReadMsg() = %+v", msg)
+	}
+	pong := expectWSTestFrame(t, frames, wsOpPong)
+	if string(pong.payload) != "are you there" {
+		t.Errorf("Pong payload = %q", pong.payload)
+	}
+}
+
+// Payloads of over 125 bytes use a 16-bit length, over 65535 a 64-bit one,
+//    in both directions
+func TestWebSocketExtendedLengths(t *testing.T) {
+	for _, textLen := range []int{200, MAX_FRAME_LEN - 4} {
+		wc, client, frames := newTestWSConn(t)
+		sent := &Message{MTypeClientText,
+			MsgClientText{7, bytes.Repeat([]byte("a"), textLen)}}
+		writeWSTestFrames(client,
+			wsTestFrame(true, wsOpBinary, encodeTestMsg(t, sent), false))
+
+		msg, err := wc.ReadMsg()
+		if err != nil {
+			t.Fatalf("ReadMsg() of %v bytes = %v", textLen, err)
+		}
+		if got := msg.Data.(*MsgClientText); len(got.TextBytes) != textLen {
+			t.Errorf("ReadMsg() text of %v bytes, want %v",
+				len(got.TextBytes), textLen)
+		}
+
+		go wc.WriteMsg(sent)
+		f := expectWSTestFrame(t, frames, wsOpBinary)
+		if !bytes.Equal(f.payload, encodeTestMsg(t, sent)) {
+			t.Errorf("WriteMsg() wrote %v bytes, want %v", len(f.payload),
+				len(encodeTestMsg(t, sent)))
+		}
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	wc, client, frames := newTestWSConn(t)
+	writeWSTestFrames(client, wsTestFrame(true, wsOpClose,
+		binary.BigEndian.AppendUint16(nil, 1001), false))
+
+	if _, err := wc.ReadMsg(); err != io.EOF {
+		t.Errorf("ReadMsg() = %v, want io.EOF", err)
+	}
+	// the peer's close code is echoed
+	f := expectWSTestFrame(t, frames, wsOpClose)
+	if code := binary.BigEndian.Uint16(f.payload); code != 1001 {
+		t.Errorf("Close code = %v, want 1001", code)
+	}
+	if err := wc.WriteMsg(&Message{MTypeLeaveComm, MsgLeaveComm{}});
+		err == nil {
+		t.Errorf("WriteMsg() after close succeeded")
+	}
+}
+
+// Each violation fails ReadMsg() & closes w/ its close code
+func TestWebSocketProtocolErrors(t *testing.T) {
+	frame := encodeTestMsg(t, &Message{MTypeLeaveComm, MsgLeaveComm{}})
+
+	cases := []struct {
+		name	string
+		frames	[][]byte
+		code	uint16
+	}{
+		{"unmasked", [][]byte{wsTestFrame(true, wsOpBinary, frame, true)},
+			wsCloseProtocolError},
+		{"text", [][]byte{wsTestFrame(true, wsOpText, []byte("hi"), false)},
+			wsCloseUnsupportedData},
+		{"unknown opcode", [][]byte{wsTestFrame(true, 0x3, frame, false)},
+			wsCloseProtocolError},
+		{"reserved bits", [][]byte{append([]byte{0xC2},
+			wsTestFrame(true, wsOpBinary, frame, false)[1:]...)},
+			wsCloseProtocolError},
+		{"lone continuation", [][]byte{
+			wsTestFrame(true, wsOpContinuation, frame, false)},
+			wsCloseProtocolError},
+		{"interrupted message", [][]byte{
+			wsTestFrame(false, wsOpBinary, frame[:2], false),
+			wsTestFrame(true, wsOpBinary, frame, false)},
+			wsCloseProtocolError},
+		{"fragmented ping", [][]byte{
+			wsTestFrame(false, wsOpPing, nil, false)},
+			wsCloseProtocolError},
+		{"long ping", [][]byte{
+			wsTestFrame(true, wsOpPing, make([]byte, 126), false)},
+			wsCloseProtocolError},
+		{"too big", [][]byte{wsTestFrame(true, wsOpBinary,
+			make([]byte, MAX_WS_MSG_LEN + 1), false)}, wsCloseTooBig},
+		{"too big once reassembled", [][]byte{
+			wsTestFrame(false, wsOpBinary, make([]byte, MAX_WS_MSG_LEN),
+				false),
+			wsTestFrame(true, wsOpContinuation, []byte{0}, false)},
+			wsCloseTooBig},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			wc, client, frames := newTestWSConn(t)
+			writeWSTestFrames(client, tc.frames...)
+
+			_, err := wc.ReadMsg()
+			var wsErr wsProtocolError
+			if !errors.As(err, &wsErr) || wsErr.code != tc.code {
+				t.Fatalf("ReadMsg() = %v, want close code %v", err, tc.code)
+			}
+			f := expectWSTestFrame(t, frames, wsOpClose)
+			if code := binary.BigEndian.Uint16(f.payload); code != tc.code {
+				t.Errorf("Close code = %v, want %v", code, tc.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SLOW_CONSUMER_POLICY values: what happens when a Client's write queue
+//    is full
+const (
+	// the Client is disconnected
+	SLOW_CONSUMER_DISCONNECT = "disconnect"
+	// the oldest queued Message is dropped to make room
+	SLOW_CONSUMER_DROP_OLDEST = "drop_oldest"
+)
+
+const (
+	DEFAULT_WRITE_QUEUE_LEN = 256 // Messages
+	DEFAULT_WRITE_TIMEOUT = 10 * time.Second
+)
+
+// Limits on each Client's outbound Messages
+type WriteQueueConfig struct {
+	Len			int // max queued Messages
+	Timeout		time.Duration // max time to write a single Message
+	Policy		string // a SLOW_CONSUMER_X value
+}
+
+func DefaultWriteQueueConfig() WriteQueueConfig {
+	return WriteQueueConfig{
+		Len:		DEFAULT_WRITE_QUEUE_LEN,
+		Timeout:	DEFAULT_WRITE_TIMEOUT,
+		Policy:		SLOW_CONSUMER_DISCONNECT,
+	}
+}
+
+// Totals across every Client since startup; access w/ sync/atomic
+var (
+	totalDroppedMsgs		uint64
+	totalSlowDisconnects	uint64
+)
+
+type queuedMsg struct {
+	msg			*Message
+	written		chan error // nil unless the sender waits on the write
+}
+
+// writeQueue is a Client's bounded queue of Messages waiting for
+//    Client.writeLoop()
+type writeQueue struct {
+	config		WriteQueueConfig
+
+	mutex		sync.Mutex
+	msgs		[]queuedMsg
+	dropped		uint64 // guarded by mutex
+	ready		chan bool // holds a value while msgs may be non-empty
+	evicted		int32 // 1 once overflowed; access w/ sync/atomic
+}
+
+func newWriteQueue(config WriteQueueConfig) *writeQueue {
+	return &writeQueue{
+		config:	config,
+		ready:	make(chan bool, 1),
+	}
+}
+
+// Returns false if the queue is full under SLOW_CONSUMER_DISCONNECT
+// BLOCKING: q.mutex
+func (q *writeQueue) push(qm queuedMsg) (ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.msgs) >= q.config.Len {
+		if q.config.Policy != SLOW_CONSUMER_DROP_OLDEST {
+			return false
+		}
+
+		oldest := q.msgs[0]
+		q.msgs = q.msgs[1:]
+		q.dropped++
+		atomic.AddUint64(&totalDroppedMsgs, 1)
+		if oldest.written != nil {
+			oldest.written <- errors.New("Dropped from full write queue")
+		}
+	}
+	q.msgs = append(q.msgs, qm)
+
+	select {
+	case q.ready <- true:
+	default: // already signalled
+	}
+	return true
+}
+
+// BLOCKING: q.mutex
+func (q *writeQueue) pop() (qm queuedMsg, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.msgs) == 0 {
+		return qm, false
+	}
+	qm = q.msgs[0]
+	q.msgs[0] = queuedMsg{} // let the Message be collected
+	q.msgs = q.msgs[1:]
+	return qm, true
+}
+
+// Number of Messages waiting to be written
+// BLOCKING: q.mutex
+func (q *writeQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.msgs)
+}
+
+// Number of Messages dropped under SLOW_CONSUMER_DROP_OLDEST
+// BLOCKING: q.mutex
+func (q *writeQueue) Dropped() uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.dropped
+}
+
+// Number of the Client's Messages waiting to be written
+func (c *Client) QueueLen() int {
+	return c.writeQueue.Len()
+}
+
+// Number of the Client's Messages dropped from its full write queue
+func (c *Client) DroppedMsgs() uint64 {
+	return c.writeQueue.Dropped()
+}
+
+// Queues msg for c.writeLoop(); never blocks on c.conn. A full queue
+//    either drops its oldest Message or disconnects the Client, per its
+//    WriteQueueConfig.Policy
+func (c *Client) WriteMsg(msg *Message) (err error) {
+	return c.queueMsg(queuedMsg{msg: msg})
+}
+
+// Waits until the Messages queued so far have been written (or dropped)
+func (c *Client) Flush() (err error) {
+	return c.WriteMsgAndWait(nil)
+}
+
+// Like c.WriteMsg(), but waits until msg has been written to c.conn
+func (c *Client) WriteMsgAndWait(msg *Message) (err error) {
+	written := make(chan error, 1)
+	if err = c.queueMsg(queuedMsg{msg, written}); err != nil {
+		return err
+	}
+
+	select {
+	case err = <-written:
+		return err
+	case <-c.closed:
+		return errors.New("Client disconnected before write")
+	}
+}
+
+func (c *Client) queueMsg(qm queuedMsg) (err error) {
+	if c.IsDisconnected() {
+		return errors.New("Client is disconnected")
+	}
+
+	if !c.writeQueue.push(qm) {
+		if atomic.CompareAndSwapInt32(&c.writeQueue.evicted, 0, 1) {
+			atomic.AddUint64(&totalSlowDisconnects, 1)
+			c.Log().Warn("Write queue is full; disconnecting",
+				"queue_len", c.writeQueue.config.Len)
+			// may be called from a Community's controlLoop, which must
+			// not wait on the Client's Server
+			go c.Disconnect(DISCONNECT_SLOW_CONSUMER)
+		}
+		return errors.New(fmt.Sprintf(
+			"Write queue full (%v Messages)", c.writeQueue.config.Len))
+	}
+	return
+}
+
+// Writes queued Messages to c.conn until the Client is disconnected; a
+//    write that fails or exceeds the write timeout disconnects the Client
+func (c *Client) writeLoop() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-c.writeQueue.ready:
+		}
+
+		for {
+			qm, ok := c.writeQueue.pop()
+			if !ok {
+				break
+			}
+			if qm.msg == nil { // queued by c.Flush()
+				qm.written <- nil
+				continue
+			}
+
+			err := c.conn.SetWriteDeadline(
+				time.Now().Add(c.writeQueue.config.Timeout))
+			if err == nil {
+				err = c.conn.WriteMsg(qm.msg)
+			}
+			if qm.written != nil {
+				qm.written <- err
+			}
+
+			if err != nil {
+				c.Log().Info("Unable to write message",
+					"type", qm.msg.TypeToString(), "err", err)
+				c.Disconnect(DISCONNECT_WRITE_ERROR)
+				return
+			}
+			metrics.MsgOut(qm.msg.Type)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// A Client writing to a net.Pipe() that nothing reads until the test
+//    calls read(), so c.writeLoop() blocks on its 1st Message
+func newTestQueueClient(t *testing.T, queueLen int, policy string) (
+	c *Client, peer *testClient) {
+	server, client := net.Pipe()
+	c = &Client{
+		conn:		newTCPConn(server),
+		writeQueue:	newWriteQueue(WriteQueueConfig{
+			Len:		queueLen,
+			Timeout:	5 * time.Second,
+			Policy:		policy,
+		}),
+		closed:		make(chan bool),
+	}
+	c.setLogContext()
+	t.Cleanup(func() {
+		c.Disconnect(DISCONNECT_CLOSED)
+		client.Close()
+	})
+
+	go c.writeLoop()
+	return c, &testClient{t, client, 0}
+}
+
+func testQueueMsg(text string) *Message {
+	return &Message{MTypeClientText, MsgClientText{1, []byte(text)}}
+}
+
+// Waits until the Client's write queue holds n Messages
+func waitQueueLen(t *testing.T, c *Client, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); c.QueueLen() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Write queue holds %v Messages, want %v", c.QueueLen(),
+				n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Reads the texts of the next n Messages
+func (tc *testClient) readTexts(n int) (texts []string) {
+	tc.t.Helper()
+
+	for i := 0; i < n; i++ {
+		texts = append(texts,
+			string(tc.read().Data.(*MsgClientText).TextBytes))
+	}
+	return
+}
+
+func disconnectCount(reason string) uint64 {
+	metrics.disconnectsMutex.Lock()
+	defer metrics.disconnectsMutex.Unlock()
+
+	return metrics.disconnects[reason]
+}
+
+func TestWriteQueueDropOldest(t *testing.T) {
+	c, peer := newTestQueueClient(t, 2, SLOW_CONSUMER_DROP_OLDEST)
+
+	// "blocked" is taken by c.writeLoop(), which waits on the pipe
+	c.WriteMsg(testQueueMsg("blocked"))
+	waitQueueLen(t, c, 0)
+
+	dropped := make(chan error, 1)
+	go func() {
+		dropped <- c.WriteMsgAndWait(testQueueMsg("oldest"))
+	}()
+	waitQueueLen(t, c, 1)
+	for _, text := range []string{"middle", "newest"} {
+		if err := c.WriteMsg(testQueueMsg(text)); err != nil {
+			t.Fatalf("WriteMsg(%q) = %v", text, err)
+		}
+	}
+
+	select {
+	case err := <-dropped:
+		if err == nil {
+			t.Errorf("WriteMsgAndWait() of a dropped Message succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WriteMsgAndWait() of a dropped Message still waiting")
+	}
+	if c.DroppedMsgs() != 1 || c.QueueLen() != 2 {
+		t.Errorf("Dropped %v Messages & queued %v, want 1 & 2",
+			c.DroppedMsgs(), c.QueueLen())
+	}
+
+	texts := fmt.Sprint(peer.readTexts(3))
+	if texts != "[blocked middle newest]" {
+		t.Errorf("Client got %v, want [blocked middle newest]", texts)
+	}
+	if c.IsDisconnected() {
+		t.Errorf("Client disconnected under drop_oldest")
+	}
+}
+
+func TestWriteQueueDisconnect(t *testing.T) {
+	c, peer := newTestQueueClient(t, 2, SLOW_CONSUMER_DISCONNECT)
+	before := disconnectCount(DISCONNECT_SLOW_CONSUMER)
+
+	c.WriteMsg(testQueueMsg("blocked"))
+	waitQueueLen(t, c, 0)
+	for _, text := range []string{"1st", "2nd"} {
+		if err := c.WriteMsg(testQueueMsg(text)); err != nil {
+			t.Fatalf("WriteMsg(%q) = %v", text, err)
+		}
+	}
+	if err := c.WriteMsg(testQueueMsg("overflow")); err == nil {
+		t.Fatalf("WriteMsg() to a full queue succeeded")
+	}
+
+	select {
+	case <-c.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Client w/ a full queue not disconnected")
+	}
+	if n := disconnectCount(DISCONNECT_SLOW_CONSUMER); n != before + 1 {
+		t.Errorf("%v slow_consumer disconnects, want %v", n, before + 1)
+	}
+	if err := c.WriteMsg(testQueueMsg("after")); err == nil {
+		t.Errorf("WriteMsg() after disconnecting succeeded")
+	}
+	peer.expectClosed()
+}
+
+func TestWriteMsgAndWait(t *testing.T) {
+	c, peer := newTestQueueClient(t, 4, SLOW_CONSUMER_DISCONNECT)
+
+	written := make(chan error, 1)
+	go func() {
+		written <- c.WriteMsgAndWait(testQueueMsg("waited"))
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("WriteMsgAndWait() = %v before the Message was read", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if texts := peer.readTexts(1); texts[0] != "waited" {
+		t.Errorf("Client got %q", texts[0])
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Errorf("WriteMsgAndWait() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WriteMsgAndWait() still waiting once written")
+	}
+
+	// Flush() waits for what was queued before it
+	c.WriteMsg(testQueueMsg("queued"))
+	flushed := make(chan error, 1)
+	go func() { flushed <- c.Flush() }()
+	peer.readTexts(1)
+	if err := <-flushed; err != nil {
+		t.Errorf("Flush() = %v", err)
+	}
+
+	// a Client disconnected while the write waits
+	go func() {
+		written <- c.WriteMsgAndWait(testQueueMsg("never read"))
+	}()
+	waitQueueLen(t, c, 0)
+	c.Disconnect(DISCONNECT_CLOSED)
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Errorf("WriteMsgAndWait() succeeded w/o being read")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WriteMsgAndWait() still waiting once disconnected")
+	}
+}